@@ -9,6 +9,23 @@ func DefaultRWPaths() []string {
 	return []string{"/etc", "/root", "/home", "/opt", "/srv", "/usr/local", "/var"}
 }
 
+// DefaultRedactedKeys returns the names that make a key look like it names a secret, on their own or as the last
+// part of the key (kms_password, api_key). Values of matching keys are redacted from logs, summaries and any file
+// immucore writes. rd.immucore.redact= adds more.
+func DefaultRedactedKeys() []string {
+	return []string{"password", "passwd", "passphrase", "token", "secret", "key", "apikey", "credential", "credentials", "signature"}
+}
+
+// DefaultStepTimeouts returns the deadline, in seconds, of the steps that do not get StepDefaultTimeout.
+// 0 means no deadline: unlocking may wait for a passphrase typed at the console.
+func DefaultStepTimeouts() map[string]int {
+	return map[string]int{
+		OpKcryptUnlock:   0,
+		OpUkiKcrypt:      0,
+		OpFetchRootImage: 1800,
+	}
+}
+
 func GetCloudInitPaths() []string {
 	return []string{"/system/oem", "/oem/", "/usr/local/cloud-config/"}
 }
@@ -124,8 +141,30 @@ const (
 	OpUkiKcrypt            = "uki-unlock"
 	OpUkiMountLivecd       = "mount-livecd"
 	OpUkiExtractCerts      = "extract-certs"
+	OpUkiMountESP          = "mount-esp"
 	OpUkiTransitionSysext  = "uki-transition-sysext"
 	OpUkiCopySysExtensions = "enable-sysext-confext"
+	OpFetchRootImage       = "fetch-root-image"
+	OpMountNFSState        = "mount-nfs-state"
+	OpSANAttach            = "san-attach"
+	OpMdadmAssemble        = "mdadm-assemble"
+
+	// Yip stages run at points of the DAG besides rootfs and initramfs, each by
+	// an op of its own and, like every stage, with its .before and .after.
+	// They run outside the chroot with the system under the sysroot, and not
+	// on live media, where immucore neither unlocks nor mounts.
+	//   - StagePreUnlock runs right before the encrypted partitions are
+	//     unlocked, after mount-oem when the OEM partition is not encrypted.
+	//   - StagePostMount runs once the custom mounts, overlays and binds are
+	//     done, even if some failed.
+	//   - StagePreFstab runs after StagePostMount, right before the fstab is
+	//     written.
+	StagePreUnlock  = "immucore.pre-unlock"
+	StagePostMount  = "immucore.post-mount"
+	StagePreFstab   = "immucore.pre-fstab"
+	OpPreUnlockHook = "pre-unlock-hook"
+	OpPostMountHook = "post-mount-hook"
+	OpPreFstabHook  = "pre-fstab-hook"
 	// InRAMSentinelName is the extra sentinel file written under /run/cos/ when
 	// the kairos.ram workflow is active. It is additive: WriteSentinelDagStep
 	// still writes the BootState-driven sentinel (which is active_mode for
@@ -153,6 +192,226 @@ const (
 	CmdlineAutoCreatePartitionsWipe = "kairos.ram.wipe"
 	CmdlineAutoCreateOemSize        = "kairos.ram.oem="
 	CmdlineAutoCreatePersistentSize = "kairos.ram.persistent="
+
+	// OpFactoryReset reformats the partitions selected with CmdlineReset
+	// before anything unlocks or mounts them, so a node with a corrupted
+	// COS_PERSISTENT can be recovered without booting recovery. It is only
+	// in the graph when CmdlineReset is on the cmdline, and only acts on the
+	// partitions whose filesystem UUID is listed in CmdlineResetConfirm: the
+	// UUID is written to ResetMarker on the reformatted partition, which gets
+	// a new one, so leaving the stanzas on the cmdline does not wipe the disks
+	// on every boot.
+	// Once done it writes ResetSentinelName under /run/cos/ with the target,
+	// for cloud-init to provision the node again.
+	OpFactoryReset      = "factory-reset"
+	CmdlineReset        = "rd.immucore.reset="
+	CmdlineResetConfirm = "rd.immucore.reset.confirm="
+	ResetPersistent     = "persistent"
+	ResetOEM            = "oem"
+	ResetAll            = "all"
+	ResetMarker         = ".immucore-reset"
+	ResetSentinelName   = "factory_reset"
+
+	// CmdlineResetBind and ResetBindsFile select PERSISTENT_STATE_PATHS
+	// entries to reset to the image contents: their state dir under
+	// PERSISTENT_STATE_TARGET is moved to ResetArchiveDir/<timestamp> in
+	// the same target before the bind mount seeds it again. The file, one
+	// path per line in the state target, is removed once read. The cmdline
+	// stanza (comma separated paths) is recorded in ResetBindsDoneFile once
+	// done and resets again only after it changed or was off the cmdline.
+	CmdlineResetBind   = "rd.immucore.reset.bind="
+	ResetBindsFile     = ".reset-binds"
+	ResetBindsDoneFile = ".reset-binds.done"
+	ResetArchiveDir    = ".reset"
+
+	// BindsManifest, in PERSISTENT_STATE_TARGET, is the set of bind mounts
+	// of the last boot, to find the paths an upgrade added or removed. The
+	// state dirs of the paths no longer bind mounted are moved to
+	// BindArchiveDir in the same target, and moved back if the path comes
+	// back, e.g. when falling back to the previous image.
+	BindsManifest  = ".binds.json"
+	BindArchiveDir = ".removed"
+
+	// Policies seeding the state of a bind mount with the contents of the
+	// image, set per path with PERSISTENT_STATE_SYNC="<path>:<policy>" in
+	// cos-layout.env. SyncUpdate, the default, copies the files missing from
+	// the state and the ones the image has newer. SyncNewFilesOnly only
+	// copies the missing ones and SyncNever copies nothing once the state
+	// exists, it is seeded like SyncNewFilesOnly when created. SyncImageWins,
+	// given as <path>:image-wins:<list>, copies the missing files and the
+	// ones in <list>, a file of the image with a path relative to <path> per
+	// line, over the ones of the state.
+	SyncUpdate       = "update"
+	SyncNewFilesOnly = "copy-new-files-only"
+	SyncNever        = "never-sync"
+	SyncImageWins    = "image-wins"
+
+	// CmdlineBtrfsRoot switches MountRootDagStep from loop-mounting
+	// cos-img/filename to mounting a btrfs subvolume of COS_STATE as the
+	// root. The subvolume is picked from the boot state (see
+	// BtrfsSubvolActive/BtrfsSubvolPassive) unless CmdlineRootSubvolume
+	// names one explicitly, which also implies CmdlineBtrfsRoot.
+	CmdlineBtrfsRoot     = "rd.immucore.btrfs"
+	CmdlineRootSubvolume = "rd.immucore.subvol="
+	BtrfsSubvolActive    = "@active"
+	BtrfsSubvolPassive   = "@passive"
+
+	// Root providers selectable with CmdlineRootProvider. When the stanza is
+	// absent the provider is derived from root= (nfs:, iscsi:, http(s)://),
+	// then from the btrfs stanzas above, and defaults to the loop image.
+	// Every provider ends in OpMountRoot, see state.RootProvider.
+	CmdlineRootProvider   = "rd.immucore.rootprovider="
+	RootProviderLoop      = "loop"
+	RootProviderSubvolume = "subvolume"
+	RootProviderBlock     = "block"
+	RootProviderNFS       = "nfs"
+	RootProviderISCSI     = "iscsi"
+	RootProviderHTTP      = "http"
+	// HTTPRootImage is where the http provider downloads the root image to.
+	// /run is a tmpfs so the image lives in RAM.
+	HTTPRootImage = "/run/initramfs/root.img"
+	// CmdlineNFSState moves the persistent state target (PERSISTENT_STATE_TARGET)
+	// onto an nfs export, rd.immucore.nfs.state=server:/path[:options]. Without it
+	// the state target stays wherever the layout puts it, usually COS_PERSISTENT.
+	CmdlineNFSState = "rd.immucore.nfs.state="
+
+	// SAN volumes attached before the state partition is looked up, using the
+	// dracut stanza names so existing PXE configs keep working.
+	// netroot=iscsi: and rd.nvmf.discover= can be passed multiple times.
+	CmdlineISCSINetroot    = "netroot=iscsi:"
+	CmdlineISCSIInitiator  = "rd.iscsi.initiator="
+	CmdlineISCSITargetIP   = "rd.iscsi.target.ip="
+	CmdlineISCSITargetPort = "rd.iscsi.target.port="
+	CmdlineISCSITargetName = "rd.iscsi.target.name="
+	CmdlineISCSILun        = "rd.iscsi.lun="
+	CmdlineNVMfDiscover    = "rd.nvmf.discover="
+	CmdlineNVMfHostNQN     = "rd.nvmf.hostnqn="
+	CmdlineNVMfHostID      = "rd.nvmf.hostid="
+	ISCSIInitiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+	ISCSIDefaultPort       = "3260"
+
+	// Software RAID assembly. rd.md.uuid= keeps the dracut meaning (only
+	// assemble these arrays, can be passed multiple times) and makes the step
+	// fail if any of them is not running afterwards. rd.immucore.md.degraded
+	// starts arrays with missing members instead of leaving them inactive.
+	CmdlineMDUUID     = "rd.md.uuid="
+	CmdlineMDDegraded = "rd.immucore.md.degraded"
+
+	// LVM activation selection. Each value is a VG, a vg/lv pair or an @tag and
+	// ends up in the activation/volume_list override, so only matching volumes
+	// are activated. Without any of them every VG is activated.
+	CmdlineLVMVG  = "rd.immucore.lvm.vg="
+	CmdlineLVMTag = "rd.immucore.lvm.tag="
+
+	// Interactive failure console shown on the consoles when a normal boot
+	// fails. rd.immucore.failureconsole=<seconds> changes how long it waits
+	// for a key before carrying on with the usual failure handling, 0 disables it.
+	CmdlineFailureConsole        = "rd.immucore.failureconsole="
+	FailureConsoleDefaultTimeout = 120
+	FailureConsoleLogLines       = 15
+	// LogFile is the basename of the immucore log under LogDir.
+	LogFile = "immucore.log"
+	// FailureMediaLabel is the filesystem label of the removable media the
+	// failure console copies the logs to. Any removable partition with a
+	// filesystem is used when none carries it.
+	FailureMediaLabel      = "KAIROS_LOGS"
+	FailureMediaMountPoint = "/run/immucore-media"
+	// GrubOEMEnv and GrubEnv are the grub environment files the failure
+	// console sets next_entry in to reboot into recovery: the one the
+	// installer keeps on COS_STATE, then the one of the EFI partition.
+	GrubOEMEnv = "grub_oem_env"
+	GrubEnv    = "grubenv"
+
+	// Retrying the failed part of the DAG without rebooting. rd.immucore.retry=<n>
+	// re-runs the failed ops and the ones depending on them that did not succeed up to n times,
+	// rd.immucore.retrydelay=<seconds> apart. While something still fails,
+	// `immucore retry` asks for another attempt over RetrySocket, which stays
+	// up while the failure console is shown and rd.immucore.retrywait=<seconds>
+	// after the last automatic attempt.
+	CmdlineRetry      = "rd.immucore.retry="
+	CmdlineRetryDelay = "rd.immucore.retrydelay="
+	CmdlineRetryWait  = "rd.immucore.retrywait="
+	RetryDefaultDelay = 5
+	RetrySocket       = "/run/immucore/immucore.sock"
+	// TimelineTraceFile and FailureSummaryFile are the basenames of the boot
+	// timeline and the failure summary written under LogDir.
+	TimelineTraceFile  = "boot-timeline.json"
+	FailureSummaryFile = "boot_failure.log"
+	// Deadline of the steps of the DAG: a step still running after
+	// rd.immucore.steptimeout=<seconds>, or its own DefaultStepTimeouts, fails
+	// with a timeout. rd.immucore.steptimeout.<step>=<seconds> sets the deadline
+	// of one step, 0 disables it. There is no deadline by default
+	// (StepDefaultTimeout) as a step that times out is left running and the
+	// legit length of most (fsck, partitioning, yip stages) depends on the disk. The steps still running are logged every
+	// rd.immucore.stepwatchdog=<seconds>, 0 disables it.
+	CmdlineStepTimeout          = "rd.immucore.steptimeout="
+	CmdlineStepTimeoutPrefix    = "rd.immucore.steptimeout."
+	StepDefaultTimeout          = 0
+	CmdlineStepWatchdog         = "rd.immucore.stepwatchdog="
+	StepWatchdogDefaultInterval = 30
+	// Progress shown on plymouth, or on the consoles without it, while a step
+	// takes longer than rd.immucore.progress=<seconds>, 0 disables it.
+	CmdlineProgress          = "rd.immucore.progress="
+	ProgressDefaultThreshold = 5
+	// SystemdExtendInterval is how often, in seconds, immucore running as a
+	// service asks systemd for SystemdExtendTimeout more seconds until it is
+	// done, so its start timeout does not kill it in the middle of a step or
+	// while a failed boot waits to be fixed.
+	SystemdExtendInterval = 10
+	SystemdExtendTimeout  = 30
+	// Hardware watchdog: rd.immucore.watchdog=<seconds> arms WatchdogDevice with
+	// that timeout at start and pets it while the steps of the DAG make
+	// progress, so a stalled boot reboots the machine. It is disarmed before
+	// the failure console, emergency shells and handing over to the system,
+	// unless rd.immucore.watchdog.handoff leaves it armed for the next owner
+	// (systemd RuntimeWatchdogSec) to pet.
+	CmdlineWatchdog        = "rd.immucore.watchdog="
+	CmdlineWatchdogHandoff = "rd.immucore.watchdog.handoff"
+	WatchdogDevice         = "/dev/watchdog"
+	// ChromeTraceFile and OTLPTraceFile are the basenames of the boot timeline
+	// exported as Chrome trace events (Perfetto, chrome://tracing) and as
+	// OTLP json (OpenTelemetry), written under LogDir.
+	ChromeTraceFile = "boot-trace.json"
+	OTLPTraceFile   = "boot-trace.otlp.json"
+	// DAGStateFile is the basename of the json with the outcome of every op,
+	// written under LogDir after each run of the DAG.
+	DAGStateFile = "dag-state.json"
+	// BindMigrationFile is the basename of the json with the changes to the
+	// bind mounts since the last boot, written under LogDir.
+	BindMigrationFile = "bind-migration.json"
+
+	// CmdlineRedact adds keys to DefaultRedactedKeys, comma separated, e.g.
+	// rd.immucore.redact=challenger_server,pin.
+	CmdlineRedact = "rd.immucore.redact="
+
+	// PluginStepsDir holds the yaml files declaring extra ops for the DAG,
+	// dropped into the initramfs for site specific steps, see schema.PluginStep.
+	// A step failing stops the ops depending on it (fail, the default), is
+	// only logged (ignore) or stops the boot (fatal).
+	PluginStepsDir   = "/etc/immucore/steps.d"
+	PluginStepFail   = "fail"
+	PluginStepIgnore = "ignore"
+	PluginStepFatal  = "fatal"
+
+	// SupportBundleDir is where support bundles are stored on the filesystem
+	// they end up in (usb stick, OEM or ESP), keeping the last SupportBundleKeep.
+	SupportBundleDir  = "immucore-support"
+	SupportBundleKeep = 5
+
+	// Boot history kept on COS_PERSISTENT (COS_OEM without it) so a failure
+	// that caused a reboot can be looked at from the next boot: the log,
+	// timeline, dag state and failure summary of the last
+	// rd.immucore.history=<n> boots, 0 disables it. Files are capped to their
+	// last HistoryMaxFileSize bytes and the whole history to HistoryMaxSize.
+	CmdlineHistory     = "rd.immucore.history="
+	HistoryDir         = ".immucore/history"
+	HistoryDefaultKeep = 10
+	HistoryMaxSize     = 32 << 20
+	HistoryMaxFileSize = 4 << 20
+	HistoryRecordFile  = "boot.json"
+	HistoryMountPoint  = "/run/immucore-history"
+	BootIDFile         = "/proc/sys/kernel/random/boot_id"
+
 	UkiLivecdMountPoint    = "/run/initramfs/live"
 	UkiIsoBaseTree         = "/run/rootfsbase"
 	UkiIsoBootImage        = "efiboot.img"
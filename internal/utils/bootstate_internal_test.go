@@ -30,4 +30,16 @@ var _ = Describe("boot state to label", func() {
 		Entry("livecd has no target", state.LiveCD, ""),
 		Entry("unknown has no target", state.Unknown, ""),
 	)
+
+	DescribeTable("resolves the root subvolume",
+		func(boot state.Boot, expected string) {
+			Expect(bootStateToSubvolume(boot)).To(Equal(expected))
+		},
+		Entry("active", state.Active, "@active"),
+		Entry("passive", state.Passive, "@passive"),
+		Entry("recovery stays on its image", state.Recovery, ""),
+		Entry("autoreset stays on the recovery image", state.AutoReset, ""),
+		Entry("livecd has no target", state.LiveCD, ""),
+		Entry("unknown has no target", state.Unknown, ""),
+	)
 })
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -57,6 +58,41 @@ func bootStateToImagesLabel(b state.Boot) string {
 	}
 }
 
+// bootStateToSubvolume maps a boot state to the btrfs subvolume of COS_STATE
+// that holds its root. Only active and passive live as subvolumes: recovery
+// stays an image on its own partition so a broken snapshot filesystem can
+// still be recovered, and an empty string tells the caller to fall back to
+// the loop image.
+func bootStateToSubvolume(b state.Boot) string {
+	switch b {
+	case state.Active:
+		return constants.BtrfsSubvolActive
+	case state.Passive:
+		return constants.BtrfsSubvolPassive
+	case state.Recovery, state.AutoReset, state.LiveCD, state.Unknown:
+		return ""
+	default:
+		return ""
+	}
+}
+
+// GetRootSubvolume returns the btrfs subvolume to mount as root, or an empty
+// string when the root comes from the usual loop image. rd.immucore.subvol=
+// wins over the boot state so an operator can boot an older snapshot by hand.
+func GetRootSubvolume() string {
+	if subvol := CleanupSlice(ReadCMDLineArg(constants.CmdlineRootSubvolume)); len(subvol) > 0 {
+		return subvol[0]
+	}
+	if len(ReadCMDLineArg(constants.CmdlineBtrfsRoot)) == 0 {
+		return ""
+	}
+	runtime, err := state.NewRuntimeWithLogger(KLog.Logger)
+	if err != nil {
+		return ""
+	}
+	return bootStateToSubvolume(runtime.BootState)
+}
+
 // BootStateToLabelDevice lets us know the device we need to mount sysroot on based on labels.
 func BootStateToLabelDevice() string {
 	runtime, err := state.NewRuntimeWithLogger(KLog.Logger)
@@ -153,6 +189,13 @@ func GetTarget(dryRun bool) (string, string, error) {
 		return "fake", label, nil
 	}
 
+	// Only the providers that losetup an image out of COS_STATE need one
+	switch RootProviderName() {
+	case constants.RootProviderLoop, constants.RootProviderISCSI:
+	default:
+		return "", label, nil
+	}
+
 	imgs := CleanupSlice(ReadCMDLineArg("cos-img/filename="))
 
 	// If no image just panic here, we cannot longer continue
@@ -277,10 +320,7 @@ func HaltWithBanner(banner, logMsg string, err error) {
 	//     dance.
 	//  4. plymouth (if installed) re-enables status output on its own.
 	//     Quit it defensively.
-	_ = os.WriteFile("/proc/sys/kernel/printk", []byte("1 4 1 7\n"), 0o644)
-	_ = exec.Command("systemctl", "log-target", "null").Run()
-	signalShowStatusOff()
-	_ = exec.Command("plymouth", "quit", "--retain-splash").Run()
+	quietConsole()
 
 	// Paint once after a short settle delay: the silencing calls above race
 	// any status line systemd already has in flight, so give those a moment
@@ -305,6 +345,20 @@ func HaltWithBanner(banner, logMsg string, err error) {
 		KLog.Logger.Warn().Msg("no key press within grace period; rebooting")
 	}
 
+	rebootFailedBoot()
+}
+
+// quietConsole is the silencing stack described in HaltWithBanner, shared
+// with the failure console.
+func quietConsole() {
+	_ = os.WriteFile("/proc/sys/kernel/printk", []byte("1 4 1 7\n"), 0o644)
+	_ = exec.Command("systemctl", "log-target", "null").Run()
+	signalShowStatusOff()
+	_ = exec.Command("plymouth", "quit", "--retain-splash").Run()
+}
+
+// rebootFailedBoot reboots and never returns.
+func rebootFailedBoot() {
 	// Reboot through systemd's own service so the failed boot is visible to
 	// boot-assessment (boot counting / bless-boot): a raw reboot(2) would
 	// skip the shutdown machinery entirely.
@@ -541,7 +595,12 @@ func BootInRAM() bool {
 // CommandWithPath runs a command adding the usual PATH to environment
 // Useful under UKI as there is nothing setting the PATH.
 func CommandWithPath(c string) (string, error) {
-	cmd := exec.Command("/bin/sh", "-c", c)
+	return CommandWithPathContext(context.Background(), c)
+}
+
+// CommandWithPathContext is CommandWithPath killing the command when ctx is done.
+func CommandWithPathContext(ctx context.Context, c string) (string, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c)
 	cmd.Env = os.Environ()
 	pathAppend := "/usr/bin:/usr/sbin:/bin:/sbin"
 	// try to extract any existing path from the environment
@@ -592,11 +651,11 @@ func GetHostProcCmdline() string {
 func RenderFailureSummary(reason, logDir string) string {
 	var b strings.Builder
 
-	reason = normalizeFailureReason(reason)
+	reason = RedactSecrets(normalizeFailureReason(reason))
 
 	// Read the kernel cmdline best-effort; do not fail the summary if it errors.
 	cmdline, err := os.ReadFile(GetHostProcCmdline())
-	cmdlineStr := strings.TrimSpace(string(cmdline))
+	cmdlineStr := RedactSecrets(strings.TrimSpace(string(cmdline)))
 	if err != nil || cmdlineStr == "" {
 		cmdlineStr = "(unavailable)"
 	}
@@ -634,7 +693,7 @@ func WriteFailureSummary(dir, summary string) (string, error) {
 	// 0600: the summary embeds the kernel cmdline, which can carry secrets
 	// (tokens, KMS passwords, keys). Keep it root-only so non-root readers on the
 	// booted system cannot harvest them from the persisted file.
-	path := filepath.Join(dir, "boot_failure.log")
+	path := filepath.Join(dir, constants.FailureSummaryFile)
 	if err := os.WriteFile(path, []byte(summary), 0600); err != nil {
 		return "", err
 	}
@@ -667,16 +726,8 @@ func DropToEmergencyShellWithError(reason string) {
 }
 
 func DropToEmergencyShell() {
-	env := os.Environ()
-	// try to extract any existing path from the environment
-	pathAppend := constants.PathAppend
-	for _, e := range env {
-		splitted := strings.Split(e, "=")
-		if splitted[0] == constants.PATH {
-			pathAppend = fmt.Sprintf("%s:%s", pathAppend, splitted[1])
-		}
-	}
-	env = append(env, fmt.Sprintf("%s=%s", constants.PATH, pathAppend))
+	DisarmHardwareWatchdog("dropping to the emergency shell")
+	env := shellEnv()
 	if err := syscall.Exec("/bin/bash", []string{"/bin/bash"}, env); err != nil {
 		if err := syscall.Exec("/bin/sh", []string{"/bin/sh"}, env); err != nil {
 			if err := syscall.Exec("/sysroot/bin/bash", []string{"/sysroot/bin/bash"}, env); err != nil {
@@ -688,6 +739,20 @@ func DropToEmergencyShell() {
 	}
 }
 
+// shellEnv returns the environment for an emergency shell, with the usual sbin/bin dirs in PATH.
+func shellEnv() []string {
+	env := os.Environ()
+	// try to extract any existing path from the environment
+	pathAppend := constants.PathAppend
+	for _, e := range env {
+		splitted := strings.Split(e, "=")
+		if splitted[0] == constants.PATH {
+			pathAppend = fmt.Sprintf("%s:%s", pathAppend, splitted[1])
+		}
+	}
+	return append(env, fmt.Sprintf("%s=%s", constants.PATH, pathAppend))
+}
+
 // PCRExtend extends the given pcr with the give data.
 func PCRExtend(pcr int, data []byte) error {
 	t, err := transport.OpenTPM()
@@ -0,0 +1,429 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jaypipes/ghw"
+	"github.com/kairos-io/immucore/internal/constants"
+	sdkConstants "github.com/kairos-io/kairos-sdk/constants"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// Interactive failure console.
+//
+// When a normal boot fails, RunFailureConsole takes over the consoles with a
+// screen listing the failed DAG ops, the tail of the immucore log and the
+// disks/labels the kernel sees, and lets whoever is in front of the machine
+// pick what to do next with a single key. It is meant for field technicians
+// that know nothing about dracut: every action is spelled out on screen.
+//
+// Copying the logs and opening a shell return to the menu, rebooting into
+// recovery never returns, and retry is handed back to the caller, which owns
+// the DAG. Without input the console gives up after a timeout and the boot
+// fails exactly as it did without it, so unattended machines are not stuck.
+
+// FailedOp is a DAG op that errored, as shown on the failure console.
+type FailedOp struct {
+	Name string `json:"name"`
+	Err  string `json:"error"`
+}
+
+// FailureAction is what the operator picked on the failure console.
+type FailureAction int
+
+const (
+	// FailureActionContinue carries on with the usual failure handling.
+	FailureActionContinue FailureAction = iota
+	// FailureActionRetry re-runs the failed ops and their dependents.
+	FailureActionRetry
+)
+
+const failureConsoleActions = `[r] Retry the failed steps
+[v] Reboot into recovery
+[s] Open a shell (exit it to come back here)
+[l] Copy the logs to a USB stick (label ` + constants.FailureMediaLabel + ` preferred)
+[c] Continue, the boot fails as usual`
+
+// consoleKey is a key pressed on one of the consoles.
+type consoleKey struct {
+	dev string
+	key byte
+}
+
+// FailureConsoleTimeout returns how long the failure console waits for a key, from rd.immucore.failureconsole=.
+// Zero means the console is disabled.
+func FailureConsoleTimeout() time.Duration {
+	return CmdlineSeconds(constants.CmdlineFailureConsole, constants.FailureConsoleDefaultTimeout)
+}
+
+// RenderFailureConsole builds the failure console screen. status is a one-line result of the last action, if any.
+func RenderFailureConsole(failed []FailedOp, logTail []string, disks, status string) string {
+	var ops strings.Builder
+	if len(failed) == 0 {
+		ops.WriteString("No step reported an error.\n")
+	}
+	for _, f := range failed {
+		fmt.Fprintf(&ops, "%s: %s\n", Emphasize(f.Name), truncateLine(RedactSecrets(f.Err), 76-len(f.Name)-2))
+	}
+	sections := []FailureSection{
+		{Title: "Failed steps", Body: ops.String()},
+		{Title: "Last log lines", Body: strings.Join(logTail, "\n")},
+		{Title: "Disks", Body: disks},
+		{Title: "Actions", Body: failureConsoleActions},
+	}
+	intro := "Some of the steps that mount the system failed."
+	if status != "" {
+		intro = fmt.Sprintf("%s\n%s", intro, Emphasize(status))
+	}
+	return RenderFailureScreen("Mounting the system failed", intro, sections...)
+}
+
+// LogTail returns the last n lines of the immucore log at path, shortened to fit the screen.
+func LogTail(path string, n int) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return []string{fmt.Sprintf("(log unavailable: %s)", err)}
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	for i, l := range lines {
+		lines[i] = truncateLine(readableLogLine(l), 76)
+	}
+	return lines
+}
+
+// readableLogLine drops the timestamp the logger puts in front of every line, it only eats screen width.
+func readableLogLine(line string) string {
+	ts, rest, found := strings.Cut(line, " ")
+	if _, err := time.Parse(time.RFC3339, ts); !found || err != nil {
+		return line
+	}
+	return rest
+}
+
+func truncateLine(s string, width int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if width < 4 || len(s) <= width {
+		return s
+	}
+	return s[:width-3] + "..."
+}
+
+// DiskSummary returns the block devices with their filesystem and label, as lsblk prints them.
+func DiskSummary() string {
+	out, err := CommandWithPath("lsblk -o NAME,SIZE,TYPE,FSTYPE,LABEL")
+	if err != nil {
+		out, _ = CommandWithPath("blkid")
+	}
+	lines := CleanupSlice(strings.Split(out, "\n"))
+	if len(lines) == 0 {
+		return "(no block devices found)\n"
+	}
+	if len(lines) > 12 {
+		lines = append(lines[:11], fmt.Sprintf("... %d more", len(lines)-11))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RunFailureConsole shows the failure console on every console until the operator asks for a retry or to continue,
+// or the timeout expires without any key. It returns straight away with FailureActionContinue when disabled.
+func RunFailureConsole(failed []FailedOp) FailureAction {
+	timeout := FailureConsoleTimeout()
+	if timeout == 0 {
+		return FailureActionContinue
+	}
+	KLog.Logger.Info().Str("timeout", timeout.String()).Msg("Showing the failure console")
+
+	quietConsole()
+	devs := ConsoleDevices()
+	consoles := openConsolesForWriting(devs...)
+	defer func() {
+		for _, c := range consoles {
+			_ = c.Close()
+		}
+	}()
+
+	var status string
+	for {
+		screen := RenderFailureConsole(failed, LogTail(filepath.Join(constants.LogDir, constants.LogFile), constants.FailureConsoleLogLines), DiskSummary(), status)
+		paintBanner(consoles, screen+fmt.Sprintf("\n>>> Without input the boot fails as usual in %d seconds.\n", int(timeout.Seconds())))
+
+		k, ok := waitForConsoleKey(devs, timeout)
+		if !ok {
+			KLog.Logger.Warn().Msg("No input on the failure console")
+			return FailureActionContinue
+		}
+		switch k.key {
+		case 'r', 'R':
+			KLog.Logger.Info().Msg("Retry requested from the failure console")
+			return FailureActionRetry
+		case 'c', 'C':
+			KLog.Logger.Info().Msg("Continue requested from the failure console")
+			return FailureActionContinue
+		case 'v', 'V':
+			KLog.Logger.Info().Msg("Reboot into recovery requested from the failure console")
+			if err := RebootIntoRecovery(); err != nil {
+				status = fmt.Sprintf("Could not reboot into recovery: %s", err)
+			}
+		case 's', 'S':
+			KLog.Logger.Info().Str("console", k.dev).Msg("Shell requested from the failure console")
+			if err := runShellOn(k.dev); err != nil {
+				status = fmt.Sprintf("Shell failed: %s", err)
+			} else {
+				status = ""
+			}
+		case 'l', 'L':
+			paintBanner(consoles, "\nCopying the logs...\n")
+			dst, err := CopyLogsToRemovableMedia(constants.LogDir)
+			if err != nil {
+				status = fmt.Sprintf("Could not copy the logs: %s", err)
+			} else {
+				status = fmt.Sprintf("Logs copied to %s, the media can be removed", dst)
+			}
+		}
+	}
+}
+
+// waitForConsoleKey reads a single key from any of devs. Readers are stopped before returning so the next user of
+// the tty (a shell, the next prompt) does not lose input to them.
+func waitForConsoleKey(devs []string, timeout time.Duration) (consoleKey, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	keys := make(chan consoleKey, 1)
+	var wg sync.WaitGroup
+	for _, dev := range devs {
+		wg.Add(1)
+		go func(dev string) {
+			defer wg.Done()
+			readConsoleKeys(ctx, dev, keys)
+		}(dev)
+	}
+	defer wg.Wait()
+	select {
+	case k := <-keys:
+		return k, true
+	case <-ctx.Done():
+		return consoleKey{}, false
+	}
+}
+
+// readConsoleKeys puts dev in raw mode with a short read timeout, so it can notice ctx being done, and sends the
+// first key pressed to keys.
+func readConsoleKeys(ctx context.Context, dev string, keys chan<- consoleKey) {
+	f, err := os.OpenFile(dev, os.O_RDONLY|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return
+	}
+	defer func() { _ = term.Restore(fd, oldState) }()
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return
+	}
+	t.Cc[unix.VMIN] = 0
+	t.Cc[unix.VTIME] = 2
+	if err = unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		return
+	}
+
+	var b [1]byte
+	for ctx.Err() == nil {
+		n, err := f.Read(b[:])
+		if n == 1 {
+			select {
+			case keys <- consoleKey{dev: dev, key: b[0]}:
+			default:
+			}
+			return
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return
+		}
+	}
+}
+
+// runShellOn runs an interactive shell on dev and waits for it to exit.
+func runShellOn(dev string) error {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, sh := range []string{"/bin/bash", "/bin/sh"} {
+		if _, err = os.Stat(sh); err != nil {
+			continue
+		}
+		_, _ = f.WriteString("\r\nExit the shell to get back to the failure console.\r\n")
+		cmd := exec.Command(sh)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = f, f, f
+		cmd.Env = shellEnv()
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+		return cmd.Run()
+	}
+	return errors.New("no shell found")
+}
+
+// findLogMedia returns the removable partition to copy the logs to: the one labeled FailureMediaLabel wherever it
+// is, otherwise the first partition with a filesystem on a removable disk.
+func findLogMedia() string {
+	block, err := ghw.Block()
+	if err != nil {
+		return ""
+	}
+	var fallback string
+	for _, disk := range block.Disks {
+		for _, part := range disk.Partitions {
+			if part.FilesystemLabel == constants.FailureMediaLabel {
+				return "/dev/" + part.Name
+			}
+			if fallback == "" && disk.IsRemovable && part.Type != "" && part.Type != "unknown" {
+				fallback = "/dev/" + part.Name
+			}
+		}
+	}
+	return fallback
+}
+
+// CopyLogsToRemovableMedia copies dir into a timestamped directory on the removable media found by findLogMedia and
+// returns where it ended up.
+func CopyLogsToRemovableMedia(dir string) (string, error) {
+	dev := findLogMedia()
+	if dev == "" {
+		return "", errors.New("no usb stick with a filesystem found, plug one in and try again")
+	}
+	if err := os.MkdirAll(constants.FailureMediaMountPoint, 0700); err != nil {
+		return "", err
+	}
+	if out, err := CommandWithPath(fmt.Sprintf("mount %s %s", dev, constants.FailureMediaMountPoint)); err != nil {
+		return "", fmt.Errorf("mounting %s: %s", dev, strings.TrimSpace(out))
+	}
+	defer func() {
+		_, _ = CommandWithPath(fmt.Sprintf("umount %s", constants.FailureMediaMountPoint))
+	}()
+	name, err := copyLogs(dir, constants.FailureMediaMountPoint)
+	if err != nil {
+		return "", err
+	}
+	syscall.Sync()
+	return fmt.Sprintf("%s:/%s", dev, name), nil
+}
+
+// copyLogs copies dir into a timestamped directory under root and returns its name.
+func copyLogs(dir, root string) (string, error) {
+	name := fmt.Sprintf("immucore-%s", time.Now().Format("20060102-150405"))
+	if out, err := CommandWithPath(fmt.Sprintf("cp -r %s %s", dir, filepath.Join(root, name))); err != nil {
+		return "", fmt.Errorf("copying logs: %s", strings.TrimSpace(out))
+	}
+	return name, nil
+}
+
+// RebootIntoRecovery sets the next grub entry to recovery and reboots. The entry is written to the grub environment
+// the installer keeps on COS_STATE, or to the one of the EFI partition when COS_STATE cannot be written, so neither
+// a missing nor an encrypted OEM partition stops it. It only returns on error.
+func RebootIntoRecovery() error {
+	var errs []error
+	for _, env := range []struct{ label, file string }{
+		{sdkConstants.StateLabel, constants.GrubOEMEnv},
+		{sdkConstants.EfiLabel, constants.GrubEnv},
+	} {
+		err := setGrubEnv(env.label, env.file, "next_entry=recovery")
+		if err == nil {
+			rebootFailedBoot()
+			return nil
+		}
+		KLog.Logger.Warn().Err(err).Str("partition", env.label).Msg("Could not set the next boot entry")
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// setGrubEnv sets value in the grub environment file of the partition labeled label. A partition that is already
+// mounted, like COS_STATE at /run/initramfs/cos-state, is edited where it is, remounted rw for the edit when it is
+// mounted ro. Otherwise it is mounted in a temporary dir under /run, which is removed once done.
+func setGrubEnv(label, file, value string) error {
+	dev := filepath.Join("/dev/disk/by-label", label)
+	if _, err := os.Stat(dev); err != nil {
+		return fmt.Errorf("partition %s not found", label)
+	}
+	out, _ := CommandWithPath(fmt.Sprintf("findmnt -n -o TARGET,OPTIONS --source %s", dev))
+	target, readOnly := mountedAt(out)
+	var tmp string
+	if target == "" {
+		var err error
+		if tmp, err = os.MkdirTemp("/run", "immucore-grubenv"); err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+	}
+	mnt, mount, umount := grubEnvMountCommands(dev, target, readOnly, tmp)
+	if mount != "" {
+		if out, err := CommandWithPath(mount); err != nil {
+			return fmt.Errorf("mounting %s: %s", dev, strings.TrimSpace(out))
+		}
+	}
+	if umount != "" {
+		defer func() {
+			_, _ = CommandWithPath(umount)
+		}()
+	}
+	env := filepath.Join(mnt, file)
+	if out, err := CommandWithPath(fmt.Sprintf("grub2-editenv %[1]s set %[2]s || grub-editenv %[1]s set %[2]s", env, value)); err != nil {
+		return fmt.Errorf("setting %s in %s: %s", value, env, strings.TrimSpace(out))
+	}
+	syscall.Sync()
+	return nil
+}
+
+// mountedAt returns the first mountpoint in the output of `findmnt -n -o TARGET,OPTIONS` and whether it is
+// mounted ro, or "" when there is none.
+func mountedAt(findmnt string) (string, bool) {
+	lines := CleanupSlice(strings.Split(findmnt, "\n"))
+	if len(lines) == 0 {
+		return "", false
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) < 2 {
+		return "", false
+	}
+	return fields[0], slices.Contains(strings.Split(fields[1], ","), "ro")
+}
+
+// grubEnvMountCommands returns where the grub environment of dev is edited and the commands to run before and after
+// the edit, empty when none is needed: dev is remounted rw and back to ro when it is mounted ro at target, used as
+// it is when mounted rw, and mounted on tmp when it is not mounted at all.
+func grubEnvMountCommands(dev, target string, readOnly bool, tmp string) (mnt, mount, umount string) {
+	switch {
+	case target != "" && readOnly:
+		return target, fmt.Sprintf("mount -o remount,rw %s", target), fmt.Sprintf("mount -o remount,ro %s", target)
+	case target != "":
+		return target, "", ""
+	default:
+		return tmp, fmt.Sprintf("mount %s %s", dev, tmp), fmt.Sprintf("umount %s", tmp)
+	}
+}
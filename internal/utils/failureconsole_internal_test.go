@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"path/filepath"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("failure console", func() {
+	It("copies the failure summary with the logs", func() {
+		logDir := GinkgoT().TempDir()
+		root := GinkgoT().TempDir()
+		_, err := WriteFailureSummary(logDir, "mount-root failed")
+		Expect(err).ToNot(HaveOccurred())
+
+		name, err := copyLogs(logDir, root)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(root, name, constants.FailureSummaryFile)).To(BeARegularFile())
+	})
+
+	DescribeTable("finds where a partition is mounted",
+		func(findmnt, target string, readOnly bool) {
+			t, ro := mountedAt(findmnt)
+			Expect(t).To(Equal(target))
+			Expect(ro).To(Equal(readOnly))
+		},
+		Entry("not mounted", "", "", false),
+		Entry("mounted ro", "/run/initramfs/cos-state ro,relatime\n", "/run/initramfs/cos-state", true),
+		Entry("mounted rw", "/run/initramfs/cos-state rw,relatime\n", "/run/initramfs/cos-state", false),
+		Entry("mounted twice", "/run/initramfs/cos-state ro,relatime\n/sysroot rw\n", "/run/initramfs/cos-state", true),
+	)
+
+	DescribeTable("mounts the grub environment partition",
+		func(target string, readOnly bool, mnt, mount, umount string) {
+			m, before, after := grubEnvMountCommands("/dev/disk/by-label/COS_STATE", target, readOnly, "/run/immucore-grubenv1")
+			Expect(m).To(Equal(mnt))
+			Expect(before).To(Equal(mount))
+			Expect(after).To(Equal(umount))
+		},
+		Entry("already mounted ro", "/run/initramfs/cos-state", true, "/run/initramfs/cos-state",
+			"mount -o remount,rw /run/initramfs/cos-state", "mount -o remount,ro /run/initramfs/cos-state"),
+		Entry("already mounted rw", "/run/initramfs/cos-state", false, "/run/initramfs/cos-state", "", ""),
+		Entry("not mounted", "", false, "/run/immucore-grubenv1",
+			"mount /dev/disk/by-label/COS_STATE /run/immucore-grubenv1", "umount /run/immucore-grubenv1"),
+	)
+})
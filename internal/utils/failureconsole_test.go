@@ -0,0 +1,69 @@
+package utils_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("failure console", func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		fs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "",
+		})
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	DescribeTable("FailureConsoleTimeout",
+		func(cmdline string, expected time.Duration) {
+			Expect(fs.WriteFile("/proc/cmdline", []byte(cmdline), 0o600)).To(Succeed())
+			Expect(utils.FailureConsoleTimeout()).To(Equal(expected))
+		},
+		Entry("default", "cos-img/filename=/cOS/active.img", 120*time.Second),
+		Entry("custom", "rd.immucore.failureconsole=30", 30*time.Second),
+		Entry("disabled", "rd.immucore.failureconsole=0", time.Duration(0)),
+		Entry("garbage keeps the default", "rd.immucore.failureconsole=soon", 120*time.Second),
+	)
+
+	It("drops the timestamps from the log lines", func() {
+		log := filepath.Join(GinkgoT().TempDir(), "immucore.log")
+		Expect(os.WriteFile(log, []byte(
+			"2026-10-18T16:20:22Z INF first\n"+
+				"2026-10-18T16:20:22Z INF second\n"+
+				"2026-10-18T16:20:23Z ERR mounting oem error=\"no such device\"\n"+
+				"not a log line\n"), os.ModePerm)).To(Succeed())
+		Expect(utils.LogTail(log, 3)).To(Equal([]string{
+			"INF second",
+			`ERR mounting oem error="no such device"`,
+			"not a log line",
+		}))
+	})
+
+	It("renders the failed ops, the log tail, the disks and the actions", func() {
+		out := utils.RenderFailureConsole(
+			[]utils.FailedOp{{Name: "mount-oem", Err: "no such device"}},
+			[]string{"error mounting oem no such device"},
+			"sda 10G disk",
+			"Logs copied to /dev/sdb1:/immucore-1",
+		)
+		Expect(out).To(ContainSubstring("mount-oem"))
+		Expect(out).To(ContainSubstring("no such device"))
+		Expect(out).To(ContainSubstring("sda 10G disk"))
+		Expect(out).To(ContainSubstring("[r] Retry the failed steps"))
+		Expect(out).To(ContainSubstring("Logs copied to /dev/sdb1:/immucore-1"))
+	})
+})
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	sdkConstants "github.com/kairos-io/kairos-sdk/constants"
+	"github.com/kairos-io/kairos-sdk/state"
+)
+
+// Boot outcomes recorded in the history.
+const (
+	BootOutcomeSuccess = "success"
+	// BootOutcomeDegraded is a boot that went on with some steps failed, e.g. a custom mount.
+	BootOutcomeDegraded = "degraded"
+	BootOutcomeFailure  = "failure"
+)
+
+// BootRecord describes a boot in the history.
+type BootRecord struct {
+	BootID string    `json:"boot_id"`
+	Time   time.Time `json:"time"`
+	// Mode is the workflow immucore ran (normal, inram, nfs) and BootState what was booted (active_boot...).
+	Mode       string     `json:"mode"`
+	BootState  string     `json:"boot_state"`
+	DurationMs float64    `json:"duration_ms"`
+	Outcome    string     `json:"outcome"`
+	Failed     []FailedOp `json:"failed,omitempty"`
+}
+
+// TimelineStep is a step of the boot timeline, as written to TimelineTraceFile.
+type TimelineStep struct {
+	Name       string  `json:"name"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// historyFiles are the files of LogDir kept in the history.
+var historyFiles = []string{constants.LogFile, constants.TimelineTraceFile, constants.DAGStateFile, constants.BindMigrationFile, constants.FailureSummaryFile}
+
+// HistoryKeep returns how many boots are kept in the history, from rd.immucore.history=.
+func HistoryKeep() int {
+	return cmdlineInt(constants.CmdlineHistory, constants.HistoryDefaultKeep)
+}
+
+// BootID returns the id the kernel gave to this boot.
+func BootID() string {
+	id, err := os.ReadFile(constants.BootIDFile)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// NewBootRecord returns the record of the current boot, run in mode since start, failed being the steps that errored.
+func NewBootRecord(mode string, start time.Time, bootErr error, failed []FailedOp) BootRecord {
+	rec := BootRecord{
+		BootID:     BootID(),
+		Time:       time.Now().UTC(),
+		Mode:       mode,
+		BootState:  currentBootState(),
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+		Outcome:    BootOutcomeSuccess,
+	}
+	for _, f := range failed {
+		rec.Failed = append(rec.Failed, FailedOp{Name: f.Name, Err: RedactSecrets(f.Err)})
+	}
+	switch {
+	case bootErr != nil:
+		rec.Outcome = BootOutcomeFailure
+	case len(failed) > 0:
+		rec.Outcome = BootOutcomeDegraded
+	}
+	return rec
+}
+
+// currentBootState returns the boot state (active_boot, passive_boot...) as kairos sees it.
+func currentBootState() string {
+	runtime, err := state.NewRuntimeWithLogger(KLog.Logger)
+	if err != nil {
+		return string(state.Unknown)
+	}
+	return string(runtime.BootState)
+}
+
+// historyLabels are the filesystems tried, in order, to keep the history.
+func historyLabels() []string {
+	return []string{sdkConstants.PersistentLabel, GetOemLabel()}
+}
+
+// PersistBootHistory adds rec and the files in LogDir to the history on the first filesystem from historyLabels
+// found, mounting it if the boot did not. It returns where the boot ended up.
+func PersistBootHistory(rec BootRecord) (string, error) {
+	keep := HistoryKeep()
+	if keep == 0 {
+		return "", nil
+	}
+	var errs []string
+	for _, label := range historyLabels() {
+		dev := filepath.Join("/dev/disk/by-label", label)
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+		root, cleanup, err := mountForHistory(dev)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		path, err := WriteBootHistory(filepath.Join(root, constants.HistoryDir), constants.LogDir, rec, keep)
+		cleanup()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", label, err))
+			continue
+		}
+		return fmt.Sprintf("%s:/%s", label, strings.TrimPrefix(path, root+"/")), nil
+	}
+	if len(errs) > 0 {
+		return "", fmt.Errorf("keeping the boot history: %s", strings.Join(errs, "; "))
+	}
+	return "", fmt.Errorf("keeping the boot history: none of %s found", strings.Join(historyLabels(), ", "))
+}
+
+// FindBootHistory returns the history directory on the first filesystem from historyLabels that has one, mounting
+// it if needed. cleanup unmounts what was mounted here.
+func FindBootHistory() (dir string, cleanup func(), err error) {
+	for _, label := range historyLabels() {
+		dev := filepath.Join("/dev/disk/by-label", label)
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+		root, cleanup, err := mountForHistory(dev)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(root, constants.HistoryDir)
+		if _, err = os.Stat(dir); err == nil {
+			return dir, cleanup, nil
+		}
+		cleanup()
+	}
+	return "", nil, fmt.Errorf("no boot history found on %s", strings.Join(historyLabels(), ", "))
+}
+
+// mountForHistory returns where dev is mounted, mounting it under HistoryMountPoint when it is not. cleanup unmounts
+// what was mounted here.
+func mountForHistory(dev string) (root string, cleanup func(), err error) {
+	out, err := CommandWithPath(fmt.Sprintf("findmnt -n -o TARGET --source %s", dev))
+	if targets := CleanupSlice(strings.Split(out, "\n")); err == nil && len(targets) > 0 {
+		return targets[0], func() {}, nil
+	}
+	if err = os.MkdirAll(constants.HistoryMountPoint, 0700); err != nil {
+		return "", nil, err
+	}
+	if out, err = CommandWithPath(fmt.Sprintf("mount %s %s", dev, constants.HistoryMountPoint)); err != nil {
+		return "", nil, fmt.Errorf("mounting %s: %s", dev, strings.TrimSpace(out))
+	}
+	return constants.HistoryMountPoint, func() {
+		_, _ = CommandWithPath(fmt.Sprintf("umount %s", constants.HistoryMountPoint))
+	}, nil
+}
+
+// WriteBootHistory adds a directory for rec to the history in dir, with the files of logDir that are kept, and
+// rotates the history to keep boots and HistoryMaxSize bytes at most. It returns the directory of the boot.
+// Directories are named after the time and boot id so they sort from oldest to newest.
+func WriteBootHistory(dir, logDir string, rec BootRecord, keep int) (string, error) {
+	entry := filepath.Join(dir, fmt.Sprintf("%s-%s", rec.Time.Format("20060102-150405"), rec.BootID))
+	if err := os.MkdirAll(entry, 0700); err != nil {
+		return "", err
+	}
+	for _, name := range historyFiles {
+		if err := copyTail(filepath.Join(logDir, name), filepath.Join(entry, name), constants.HistoryMaxFileSize); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(filepath.Join(entry, constants.HistoryRecordFile), data, 0600); err != nil {
+		return "", err
+	}
+	rotateBootHistory(dir, keep, constants.HistoryMaxSize)
+	Sync()
+	return entry, nil
+}
+
+// copyTail copies the last max bytes of src to dst.
+func copyTail(src, dst string, max int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > max {
+		if _, err = in.Seek(info.Size()-max, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// bootHistoryEntries returns the boot directories in dir, oldest first.
+func bootHistoryEntries(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var boots []string
+	for _, e := range entries {
+		if e.IsDir() {
+			boots = append(boots, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(boots)
+	return boots
+}
+
+// rotateBootHistory drops the oldest boots in dir until there are keep at most and they take maxSize bytes at most.
+// The newest boot is always kept.
+func rotateBootHistory(dir string, keep int, maxSize int64) {
+	boots := bootHistoryEntries(dir)
+	sizes := make([]int64, len(boots))
+	var total int64
+	for i, b := range boots {
+		_ = filepath.Walk(b, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				sizes[i] += info.Size()
+			}
+			return nil
+		})
+		total += sizes[i]
+	}
+	for i := 0; i < len(boots)-1 && (len(boots)-i > keep || total > maxSize); i++ {
+		if err := os.RemoveAll(boots[i]); err != nil {
+			KLog.Logger.Warn().Err(err).Str("dir", boots[i]).Msg("Rotating the boot history")
+			continue
+		}
+		total -= sizes[i]
+	}
+}
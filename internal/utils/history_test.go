@@ -0,0 +1,137 @@
+package utils_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	"github.com/kairos-io/immucore/internal/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("boot history", func() {
+	var logDir, dir string
+
+	BeforeEach(func() {
+		logDir = GinkgoT().TempDir()
+		dir = filepath.Join(GinkgoT().TempDir(), constants.HistoryDir)
+		Expect(os.WriteFile(filepath.Join(logDir, constants.LogFile), []byte("INF booting\n"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(logDir, constants.DAGStateFile), []byte("{}"), 0600)).To(Succeed())
+	})
+
+	DescribeTable("NewBootRecord",
+		func(err error, failed []utils.FailedOp, outcome string) {
+			Expect(utils.NewBootRecord("normal", time.Now(), err, failed).Outcome).To(Equal(outcome))
+		},
+		Entry("success", nil, nil, utils.BootOutcomeSuccess),
+		Entry("degraded", nil, []utils.FailedOp{{Name: "custom-mount", Err: "no such device"}}, utils.BootOutcomeDegraded),
+		Entry("failure", errors.New("mounting the root failed"), []utils.FailedOp{{Name: "mount-root", Err: "no image"}}, utils.BootOutcomeFailure),
+	)
+
+	It("keeps the logs and the outcome of each boot", func() {
+		rec := utils.BootRecord{BootID: "b1", Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), Outcome: utils.BootOutcomeFailure,
+			Failed: []utils.FailedOp{{Name: "mount-root", Err: "no image"}}}
+		entry, err := utils.WriteBootHistory(dir, logDir, rec, 10)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry).To(Equal(filepath.Join(dir, "20260102-030405-b1")))
+		Expect(filepath.Join(entry, constants.LogFile)).To(BeARegularFile())
+		Expect(filepath.Join(entry, constants.DAGStateFile)).To(BeARegularFile())
+		Expect(filepath.Join(entry, "boot_failure.log")).ToNot(BeAnExistingFile())
+
+		data, err := os.ReadFile(filepath.Join(entry, constants.HistoryRecordFile))
+		Expect(err).ToNot(HaveOccurred())
+		var got utils.BootRecord
+		Expect(json.Unmarshal(data, &got)).To(Succeed())
+		Expect(got).To(Equal(rec))
+	})
+
+	It("keeps the last boots only", func() {
+		for i, id := range []string{"b1", "b2", "b3"} {
+			_, err := utils.WriteBootHistory(dir, logDir, utils.BootRecord{BootID: id, Time: time.Date(2026, 1, 2, 3, 4, i, 0, time.UTC)}, 2)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		entries, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Name()).To(HaveSuffix("b2"))
+		Expect(entries[1].Name()).To(HaveSuffix("b3"))
+	})
+
+	It("keeps the end of big logs", func() {
+		big := strings.Repeat("x", constants.HistoryMaxFileSize) + "the end\n"
+		Expect(os.WriteFile(filepath.Join(logDir, constants.LogFile), []byte(big), 0600)).To(Succeed())
+		entry, err := utils.WriteBootHistory(dir, logDir, utils.BootRecord{BootID: "b1"}, 10)
+		Expect(err).ToNot(HaveOccurred())
+		info, err := os.Stat(filepath.Join(entry, constants.LogFile))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(BeEquivalentTo(constants.HistoryMaxFileSize))
+		data, err := os.ReadFile(filepath.Join(entry, constants.LogFile))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(HaveSuffix("the end\n"))
+	})
+
+	Describe("reading it back", func() {
+		var entries []utils.BootHistoryEntry
+
+		BeforeEach(func() {
+			write := func(id string, sec int, outcome string, totalMs float64, steps string, summary string) {
+				Expect(os.WriteFile(filepath.Join(logDir, constants.TimelineTraceFile), []byte(steps), 0600)).To(Succeed())
+				_ = os.Remove(filepath.Join(logDir, constants.FailureSummaryFile))
+				if summary != "" {
+					Expect(os.WriteFile(filepath.Join(logDir, constants.FailureSummaryFile), []byte(summary), 0600)).To(Succeed())
+				}
+				_, err := utils.WriteBootHistory(dir, logDir, utils.BootRecord{
+					BootID: id, Time: time.Date(2026, 1, 2, 3, 4, sec, 0, time.UTC), Mode: "normal",
+					BootState: "active_boot", DurationMs: totalMs, Outcome: outcome,
+				}, 10)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			write("aaaaaaaa-1", 1, utils.BootOutcomeSuccess, 3000,
+				`[{"name":"mount-oem","duration_ms":500},{"name":"mount-root","duration_ms":1000},{"name":"kcrypt","duration_ms":200}]`, "")
+			write("bbbbbbbb-2", 2, utils.BootOutcomeFailure, 6000,
+				`[{"name":"mount-root","duration_ms":4000,"error":"no image"},{"name":"mount-oem","duration_ms":500}]`,
+				"IMMUCORE BOOT FAILED\nReason:  failed operations: mount-root: no image\n")
+			var err error
+			entries, err = utils.ReadBootHistory(dir)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the newest boot first with its slowest steps and failure reason", func() {
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0].BootID).To(Equal("bbbbbbbb-2"))
+			Expect(entries[0].Reason).To(Equal("failed operations: mount-root: no image"))
+			Expect(entries[1].Steps[0].Name).To(Equal("mount-root"))
+
+			out := utils.RenderBootHistory(entries)
+			Expect(out).To(ContainSubstring("bbbbbbbb"))
+			Expect(out).To(ContainSubstring("failure"))
+			Expect(out).To(ContainSubstring("mount-root 1s, mount-oem 500ms, kcrypt 200ms"))
+			Expect(out).To(ContainSubstring("failed operations: mount-root: no image"))
+		})
+
+		It("selects boots by number or boot id", func() {
+			e, err := utils.SelectBoot(entries, "2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.BootID).To(Equal("aaaaaaaa-1"))
+			e, err = utils.SelectBoot(entries, "bbbb")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.BootID).To(Equal("bbbbbbbb-2"))
+			_, err = utils.SelectBoot(entries, "3")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("compares the step durations, biggest changes first", func() {
+			out := utils.RenderBootComparison(entries[1], entries[0])
+			lines := strings.Split(out, "\n")
+			Expect(lines[2]).To(MatchRegexp(`^total\s+3s\s+6s\s+\+3s \(\+100%\)`))
+			Expect(lines[3]).To(MatchRegexp(`^mount-root\s+1s\s+4s\s+\+3s \(\+300%\)`))
+			Expect(lines[4]).To(MatchRegexp(`^kcrypt\s+200ms\s+-\s+-`))
+			Expect(lines[5]).To(MatchRegexp(`^mount-oem\s+500ms\s+500ms\s+\+0s \(\+0%\)`))
+		})
+	})
+})
@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/constants"
+)
+
+// historySlowestSteps is how many of the slowest steps are listed for each boot.
+const historySlowestSteps = 3
+
+// BootHistoryEntry is a boot read back from the history.
+type BootHistoryEntry struct {
+	BootRecord
+	Dir string
+	// Steps is the boot timeline, slowest first.
+	Steps []TimelineStep
+	// Reason is the failure reason from the failure summary, if the boot failed.
+	Reason string
+}
+
+// ReadBootHistory returns the boots kept in the history in dir, newest first.
+func ReadBootHistory(dir string) ([]BootHistoryEntry, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	boots := bootHistoryEntries(dir)
+	entries := make([]BootHistoryEntry, 0, len(boots))
+	for i := len(boots) - 1; i >= 0; i-- {
+		e := BootHistoryEntry{Dir: boots[i]}
+		data, err := os.ReadFile(filepath.Join(boots[i], constants.HistoryRecordFile))
+		if err != nil {
+			continue
+		}
+		if err = json.Unmarshal(data, &e.BootRecord); err != nil {
+			continue
+		}
+		if data, err = os.ReadFile(filepath.Join(boots[i], constants.TimelineTraceFile)); err == nil {
+			_ = json.Unmarshal(data, &e.Steps)
+		}
+		sort.SliceStable(e.Steps, func(a, b int) bool { return e.Steps[a].DurationMs > e.Steps[b].DurationMs })
+		e.Reason = failureSummaryReason(filepath.Join(boots[i], constants.FailureSummaryFile))
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// failureSummaryReason returns the reason line of the failure summary at path, see RenderFailureSummary.
+func failureSummaryReason(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if reason, found := strings.CutPrefix(scanner.Text(), "Reason:"); found {
+			return strings.TrimSpace(reason)
+		}
+	}
+	return ""
+}
+
+// SelectBoot returns the boot ref points to: its number in the list (1 is the newest) or the start of its boot id.
+func SelectBoot(entries []BootHistoryEntry, ref string) (BootHistoryEntry, error) {
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n < 1 || n > len(entries) {
+			return BootHistoryEntry{}, fmt.Errorf("there is no boot %d, the history has %d", n, len(entries))
+		}
+		return entries[n-1], nil
+	}
+	for _, e := range entries {
+		if ref != "" && strings.HasPrefix(e.BootID, ref) {
+			return e, nil
+		}
+	}
+	return BootHistoryEntry{}, fmt.Errorf("no boot with an id starting with %q", ref)
+}
+
+func formatMs(ms float64) string {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Millisecond).String()
+}
+
+// bootMode returns the boot state and the workflow of e in short, e.g. active or active/inram.
+func bootMode(e BootHistoryEntry) string {
+	mode := strings.TrimSuffix(e.BootState, "_boot")
+	if e.Mode != "" && e.Mode != "normal" {
+		mode += "/" + e.Mode
+	}
+	return mode
+}
+
+// RenderBootHistory lists the boots in entries with their mode, outcome, total time, slowest steps and why they
+// failed.
+func RenderBootHistory(entries []BootHistoryEntry) string {
+	if len(entries) == 0 {
+		return "No boots in the history\n"
+	}
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tDATE\tBOOT ID\tMODE\tOUTCOME\tTOTAL\tSLOWEST STEPS")
+	for i, e := range entries {
+		var slowest []string
+		for _, s := range e.Steps[:min(historySlowestSteps, len(e.Steps))] {
+			slowest = append(slowest, fmt.Sprintf("%s %s", s.Name, formatMs(s.DurationMs)))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, e.Time.Local().Format("2006-01-02 15:04:05"),
+			e.BootID[:min(8, len(e.BootID))], bootMode(e), e.Outcome, formatMs(e.DurationMs), strings.Join(slowest, ", "))
+		if e.Outcome == BootOutcomeSuccess {
+			continue
+		}
+		reason := e.Reason
+		if reason == "" {
+			var failed []string
+			for _, f := range e.Failed {
+				failed = append(failed, fmt.Sprintf("%s: %s", f.Name, strings.TrimSpace(f.Err)))
+			}
+			reason = strings.Join(failed, "; ")
+		}
+		fmt.Fprintf(w, "\t└ %s\n", truncateLine(reason, 100))
+	}
+	_ = w.Flush()
+	return b.String()
+}
+
+// RenderBootComparison diffs the step durations of two boots, biggest changes first.
+func RenderBootComparison(before, after BootHistoryEntry) string {
+	durations := func(e BootHistoryEntry) map[string]float64 {
+		d := map[string]float64{}
+		for _, s := range e.Steps {
+			d[s.Name] = s.DurationMs
+		}
+		return d
+	}
+	b, a := durations(before), durations(after)
+	var names []string
+	for n := range b {
+		names = append(names, n)
+	}
+	for n := range a {
+		if _, ok := b[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		di, dj := math.Abs(a[names[i]]-b[names[i]]), math.Abs(a[names[j]]-b[names[j]])
+		if di == dj {
+			return names[i] < names[j]
+		}
+		return di > dj
+	})
+
+	cell := func(m map[string]float64, n string) string {
+		if v, ok := m[n]; ok {
+			return formatMs(v)
+		}
+		return "-"
+	}
+	diff := func(bv, av float64) string {
+		d := formatMs(av - bv)
+		if av >= bv {
+			d = "+" + d
+		}
+		if bv > 0 {
+			d += fmt.Sprintf(" (%+.0f%%)", (av-bv)/bv*100)
+		}
+		return d
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "Comparing %s (%s) with %s (%s)\n",
+		before.BootID[:min(8, len(before.BootID))], before.Time.Local().Format("2006-01-02 15:04:05"),
+		after.BootID[:min(8, len(after.BootID))], after.Time.Local().Format("2006-01-02 15:04:05"))
+	w := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tBEFORE\tAFTER\tDIFF")
+	fmt.Fprintf(w, "total\t%s\t%s\t%s\n", formatMs(before.DurationMs), formatMs(after.DurationMs), diff(before.DurationMs, after.DurationMs))
+	for _, n := range names {
+		_, inB := b[n]
+		_, inA := a[n]
+		d := "-"
+		if inB && inA {
+			d = diff(b[n], a[n])
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", n, cell(b, n), cell(a, n), d)
+	}
+	_ = w.Flush()
+	return out.String()
+}
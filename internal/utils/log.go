@@ -21,5 +21,7 @@ func SetLogger() {
 	}
 	_ = os.MkdirAll(constants.LogDir, os.ModeDir|os.ModePerm)
 
+	LoadRedactedKeys()
 	KLog = logger.NewKairosLoggerWithExtraDirs("immucore", level, false, constants.LogDir)
+	KLog.Logger = redactingLogger(KLog.Logger)
 }
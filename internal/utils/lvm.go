@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/immucore/internal/constants"
+)
+
+// LVMSelection returns the volumes to activate from rd.immucore.lvm.vg= and rd.immucore.lvm.tag=, in lvm
+// volume_list syntax (vg, vg/lv or @tag). An empty selection means every VG.
+// Values carrying quotes are dropped, as they end up inside the --config string of a shell command.
+func LVMSelection() []string {
+	var selection []string
+	add := func(v string) {
+		if strings.ContainsAny(v, `"'\`) {
+			KLog.Logger.Warn().Str("value", v).Msg("Ignoring lvm selection with quotes")
+			return
+		}
+		selection = append(selection, v)
+	}
+	for _, vg := range CleanupSlice(ReadCMDLineArg(constants.CmdlineLVMVG)) {
+		add(vg)
+	}
+	for _, tag := range CleanupSlice(ReadCMDLineArg(constants.CmdlineLVMTag)) {
+		if !strings.HasPrefix(tag, "@") {
+			tag = "@" + tag
+		}
+		add(tag)
+	}
+	return UniqueSlice(selection)
+}
+
+// LVMConfigOverride returns the lvm --config string used for activation.
+// It replaces the initramfs lvm.conf settings that would activate the volumes read-only and, when there is a
+// selection, restricts activation to it through activation/volume_list so other volumes are never touched.
+func LVMConfigOverride(selection []string) string {
+	override := "activation { read_only_volume_list = [] "
+	if len(selection) > 0 {
+		quoted := make([]string, 0, len(selection))
+		for _, v := range selection {
+			quoted = append(quoted, fmt.Sprintf("%q", v))
+		}
+		override += fmt.Sprintf("volume_list = [ %s ] ", strings.Join(quoted, ", "))
+	}
+	return override + "}"
+}
+
+// ActivateLVM activates the selected (by default all) volume groups so the COS_* labels living on them can be found.
+func ActivateLVM() error {
+	selection := LVMSelection()
+	KLog.Logger.Debug().Strs("selection", selection).Msg("Activating lvm volumes")
+
+	// Activate (do NOT refresh) the volume groups in system-init mode.
+	// We only need inactive boot volumes brought up (COS_* partitions on LVM installs);
+	// --activate y is a no-op on already-active LVs. --refresh must be avoided: it suspends and
+	// reloads every active LV, including unrelated data VGs that event-based
+	// autoactivation already brought up (e.g. kubernetes pvc volumes). That reload can
+	// fail mid-operation and leave a device suspended (vgchange exit 5), which then
+	// poisons the strong-dep boot DAG (oem mount + kcrypt depend on this step).
+	// The config override is passed inline instead of removing /etc/lvm/lvm.conf, so the rest of its settings
+	// (filters, devices) still apply.
+	out, err := CommandWithPath(fmt.Sprintf("lvm vgchange --activate y --sysinit --config '%s'", LVMConfigOverride(selection)))
+	KLog.Logger.Debug().Str("out", out).Msg("vgchange")
+	if err != nil {
+		KLog.Logger.Err(err).Msg("vgchange")
+	}
+
+	_, _ = CommandWithPath("udevadm --trigger")
+	return err
+}
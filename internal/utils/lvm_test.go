@@ -0,0 +1,48 @@
+package utils_test
+
+import (
+	"github.com/kairos-io/immucore/internal/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("lvm activation", func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		fs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "",
+		})
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	DescribeTable("LVMSelection",
+		func(cmdline string, expected []string) {
+			Expect(fs.WriteFile("/proc/cmdline", []byte(cmdline), 0o600)).To(Succeed())
+			Expect(utils.LVMSelection()).To(Equal(expected))
+		},
+		Entry("nothing selected", "cos-img/filename=/cOS/active.img", nil),
+		Entry("vgs and lvs", "rd.immucore.lvm.vg=kairos rd.immucore.lvm.vg=data/persistent", []string{"kairos", "data/persistent"}),
+		Entry("tags with and without @", "rd.immucore.lvm.tag=kairos rd.immucore.lvm.tag=@boot", []string{"@kairos", "@boot"}),
+		Entry("duplicates", "rd.immucore.lvm.tag=kairos rd.immucore.lvm.tag=@kairos", []string{"@kairos"}),
+		Entry("quotes are dropped", `rd.immucore.lvm.vg=kai'ros rd.immucore.lvm.vg=kairos`, []string{"kairos"}),
+	)
+
+	Describe("LVMConfigOverride", func() {
+		It("only lifts the read-only activation without a selection", func() {
+			Expect(utils.LVMConfigOverride(nil)).To(Equal("activation { read_only_volume_list = [] }"))
+		})
+		It("restricts activation to the selection", func() {
+			Expect(utils.LVMConfigOverride([]string{"kairos", "@kairos"})).To(Equal(
+				`activation { read_only_volume_list = [] volume_list = [ "kairos", "@kairos" ] }`))
+		})
+	})
+})
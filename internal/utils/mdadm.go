@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/immucore/internal/constants"
+)
+
+// AssembleMD assembles the software RAID arrays on the system so partitions living on them can be found by label.
+// Without rd.md.uuid= every array found by scanning is assembled on a best effort basis: an array that cannot be
+// started is logged but does not fail the boot, as it may be an unrelated data array.
+// With rd.md.uuid= only those arrays are assembled, and all of them must be running afterwards.
+// Arrays with missing members are only started if rd.immucore.md.degraded is set.
+func AssembleMD() error {
+	// Nothing to do if there are no md superblocks at all, or no mdadm in the initramfs
+	out, err := CommandWithPath("mdadm --examine --scan")
+	if err != nil || strings.TrimSpace(out) == "" {
+		KLog.Logger.Debug().Err(err).Str("out", out).Msg("No md arrays found, skipping assembly")
+		return nil
+	}
+
+	degraded := "--no-degraded"
+	if len(ReadCMDLineArg(constants.CmdlineMDDegraded)) > 0 {
+		degraded = "--run"
+	}
+
+	uuids := CleanupSlice(ReadCMDLineArg(constants.CmdlineMDUUID))
+	if len(uuids) == 0 {
+		// mdadm exits non-zero when there was nothing new to assemble, so only log it
+		out, err = CommandWithPath(fmt.Sprintf("mdadm --assemble --scan %s", degraded))
+		KLog.Logger.Debug().Err(err).Str("out", out).Msg("mdadm assemble")
+		out, _ = CommandWithPath("udevadm settle")
+		KLog.Logger.Debug().Str("out", out).Msg("udevadm settle")
+		return nil
+	}
+
+	for _, uuid := range uuids {
+		out, err = CommandWithPath(fmt.Sprintf("mdadm --assemble --scan --uuid=%s %s", uuid, degraded))
+		KLog.Logger.Debug().Err(err).Str("out", out).Str("uuid", uuid).Msg("mdadm assemble")
+	}
+	out, _ = CommandWithPath("udevadm settle")
+	KLog.Logger.Debug().Str("out", out).Msg("udevadm settle")
+
+	out, err = CommandWithPath("mdadm --detail --scan")
+	if err != nil {
+		return fmt.Errorf("listing running md arrays: %w", err)
+	}
+	running := mdArrayUUIDs(out)
+	var missing []string
+	for _, uuid := range uuids {
+		if !running[normalizeMDUUID(uuid)] {
+			missing = append(missing, uuid)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("md arrays %v are not running, set %s to start them with missing members", missing, constants.CmdlineMDDegraded)
+	}
+	return nil
+}
+
+// mdArrayUUIDs returns the normalized UUIDs of the ARRAY lines in mdadm --detail --scan output.
+func mdArrayUUIDs(out string) map[string]bool {
+	uuids := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "ARRAY" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if uuid, ok := strings.CutPrefix(f, "UUID="); ok {
+				uuids[normalizeMDUUID(uuid)] = true
+			}
+		}
+	}
+	return uuids
+}
+
+// normalizeMDUUID drops separators and case, as mdadm prints 4 colon separated groups but people copy them from
+// blkid or lsblk in the usual dashed format.
+func normalizeMDUUID(uuid string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(uuid))
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("md arrays", func() {
+	It("reads the uuids of the running arrays", func() {
+		out := `ARRAY /dev/md/persistent metadata=1.2 name=kairos:persistent UUID=3a7c5e2f:1b4d6a8c:9e0f2b3d:4c5a6e7f
+ARRAY /dev/md127 metadata=1.2 UUID=AAAA1111:bbbb2222:cccc3333:dddd4444
+mdadm: some warning line
+`
+		Expect(mdArrayUUIDs(out)).To(Equal(map[string]bool{
+			"3a7c5e2f1b4d6a8c9e0f2b3d4c5a6e7f": true,
+			"aaaa1111bbbb2222cccc3333dddd4444": true,
+		}))
+	})
+
+	It("matches uuids in the dashed format", func() {
+		Expect(normalizeMDUUID("3a7c5e2f-1b4d-6a8c-9e0f-2b3d4c5a6e7f")).To(Equal(normalizeMDUUID("3A7C5E2F:1B4D6A8C:9E0F2B3D:4C5A6E7F")))
+	})
+})
@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -92,17 +93,15 @@ func DiskFSType(s string) string {
 	return out
 }
 
-// SyncState will rsync source into destination. Useful for Bind mounts.
-func SyncState(src, dst string) error {
-	// This has the --update flag to avoid overwriting newer files in dst.
-	// This also has a weird bug in which if the source is a file and destination is a symlink.
-	// According to docs it should overwrite the symlink as its of a different type but it does not.
-	// Doing it the other way around (symlink source to file destination) does overwrite it so be careful with this.
-	// So we rely in that behaviour but if its fixed in the future we might need to change this.
-	// Reported here:
-	// https://github.com/RsyncProject/rsync/issues/827
-	_, err := CommandWithPath(fmt.Sprintf("rsync -aquAX %s %s", src, dst))
-	return err
+// DiskFSUUID returns the filesystem UUID of device, from /dev/disk/by-uuid, empty when it has none.
+func DiskFSUUID(device string) string {
+	links, _ := filepath.Glob("/dev/disk/by-uuid/*")
+	for _, l := range links {
+		if target, err := filepath.EvalSymlinks(l); err == nil && target == device {
+			return filepath.Base(l)
+		}
+	}
+	return ""
 }
 
 // AppendSlash it's in the name. Appends a slash.
@@ -311,29 +310,6 @@ func GetOemLabel() string {
 	return ""
 }
 
-func ActivateLVM() error {
-	// Remove the /etc/lvm/lvm.conf file
-	// Otherwise, it has a default locking setting which activates the volumes on readonly
-	// This would be the same as passing rd.lvm.conf=0 in cmdline but rather do it here than add an extra option to cmdline
-	_, _ = CommandWithPath("rm /etc/lvm/lvm.conf")
-
-	// Activate (do NOT refresh) all available volume groups in system-init mode.
-	// We only need inactive boot volumes brought up (COS_* partitions on LVM installs);
-	// --activate y is a no-op on already-active LVs. --refresh must be avoided: it suspends and
-	// reloads every active LV, including unrelated data VGs that event-based
-	// autoactivation already brought up (e.g. kubernetes pvc volumes). That reload can
-	// fail mid-operation and leave a device suspended (vgchange exit 5), which then
-	// poisons the strong-dep boot DAG (oem mount + kcrypt depend on this step).
-	out, err := CommandWithPath("lvm vgchange --activate y --sysinit")
-	KLog.Logger.Debug().Str("out", out).Msg("vgchange")
-	if err != nil {
-		KLog.Logger.Err(err).Msg("vgchange")
-	}
-
-	_, _ = CommandWithPath("udevadm --trigger")
-	return err
-}
-
 // Force flushing the data to disk.
 func Sync() {
 	// wrapper isn't necessary, but leaving it here in case
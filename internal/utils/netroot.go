@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/immucore/internal/constants"
+)
+
+// ISCSITarget is an iSCSI target parsed from a dracut style root=iscsi: spec.
+type ISCSITarget struct {
+	Portal string // server[:port] as iscsiadm expects it
+	LUN    string // empty means any LUN of the target
+	Name   string // iqn of the target
+}
+
+// DevicePath returns the /dev/disk/by-path link udev creates for the LUN of the target, or an empty string when
+// the target has no LUN.
+func (t ISCSITarget) DevicePath() string {
+	if t.LUN == "" {
+		return ""
+	}
+	portal := t.Portal
+	if !strings.Contains(portal, ":") {
+		portal = fmt.Sprintf("%s:%s", portal, constants.ISCSIDefaultPort)
+	}
+	return fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%s", portal, t.Name, t.LUN)
+}
+
+// GetRootSpec returns the value of the first root= stanza on the cmdline, or an empty string.
+func GetRootSpec() string {
+	root := CleanupSlice(ReadCMDLineArg("root="))
+	if len(root) == 0 {
+		return ""
+	}
+	return root[0]
+}
+
+// GetNFSStateSpec returns the nfs export from rd.immucore.nfs.state= that holds the persistent state, or an empty
+// string if the state target should stay on local disk.
+func GetNFSStateSpec() string {
+	spec := CleanupSlice(ReadCMDLineArg(constants.CmdlineNFSState))
+	if len(spec) == 0 {
+		return ""
+	}
+	return spec[0]
+}
+
+// RootProviderName returns which provider mounts the root filesystem, see the RootProvider* constants.
+// An explicit rd.immucore.rootprovider= wins, otherwise it is derived from root= and the btrfs stanzas.
+func RootProviderName() string {
+	if provider := CleanupSlice(ReadCMDLineArg(constants.CmdlineRootProvider)); len(provider) > 0 {
+		return provider[0]
+	}
+	root := GetRootSpec()
+	switch {
+	case strings.HasPrefix(root, "nfs:"):
+		return constants.RootProviderNFS
+	case strings.HasPrefix(root, "iscsi:"):
+		return constants.RootProviderISCSI
+	case strings.HasPrefix(root, "http://"), strings.HasPrefix(root, "https://"):
+		return constants.RootProviderHTTP
+	case GetRootSubvolume() != "":
+		return constants.RootProviderSubvolume
+	default:
+		return constants.RootProviderLoop
+	}
+}
+
+// ParseNFSRoot parses a root=nfs:server:/path[:options] spec into the mount source (server:/path)
+// and the extra mount options, if any.
+func ParseNFSRoot(spec string) (string, []string, error) {
+	spec = strings.TrimPrefix(spec, "nfs:")
+	dat := strings.SplitN(spec, ":", 3)
+	if len(dat) < 2 || dat[0] == "" || !strings.HasPrefix(dat[1], "/") {
+		return "", nil, fmt.Errorf("invalid nfs root %q, expected nfs:server:/path[:options]", spec)
+	}
+	var options []string
+	if len(dat) == 3 {
+		options = CleanupSlice(strings.Split(dat[2], ","))
+	}
+	return fmt.Sprintf("%s:%s", dat[0], dat[1]), options, nil
+}
+
+// ParseISCSIRoot parses a dracut style root=iscsi:server:protocol:port:lun:targetname spec.
+// Credentials and the iface/netdev fields are not supported here, configure them in the initramfs iscsid.conf instead.
+// The target name keeps any colons it carries (iqn.2004-04.com.example:disk0).
+func ParseISCSIRoot(spec string) (ISCSITarget, error) {
+	spec = strings.TrimPrefix(spec, "iscsi:")
+	if strings.Contains(spec, "@") {
+		return ISCSITarget{}, errors.New("credentials in root=iscsi: are not supported, set them in iscsid.conf")
+	}
+	dat := strings.SplitN(spec, ":", 5)
+	if len(dat) != 5 || dat[0] == "" || dat[4] == "" {
+		return ISCSITarget{}, fmt.Errorf("invalid iscsi root %q, expected iscsi:server:protocol:port:lun:targetname", spec)
+	}
+	portal := dat[0]
+	if dat[2] != "" {
+		portal = fmt.Sprintf("%s:%s", dat[0], dat[2])
+	}
+	return ISCSITarget{Portal: portal, LUN: dat[3], Name: dat[4]}, nil
+}
+
+// ISCSILogin discovers and logs into the given target, then waits for udev to create the device links
+// so the labels on the LUN can be found by the usual /dev/disk/by-label paths. When the target names a LUN, the
+// login fails if that LUN did not show up.
+func ISCSILogin(t ISCSITarget) error {
+	if out, err := CommandWithPath(fmt.Sprintf("iscsiadm -m discovery -t sendtargets -p %s", t.Portal)); err != nil {
+		KLog.Logger.Debug().Str("out", out).Msg("iscsiadm discovery")
+		return fmt.Errorf("discovering iscsi targets on %s: %w", t.Portal, err)
+	}
+	if out, err := CommandWithPath(fmt.Sprintf("iscsiadm -m node -T %s -p %s --login", t.Name, t.Portal)); err != nil {
+		KLog.Logger.Debug().Str("out", out).Msg("iscsiadm login")
+		return fmt.Errorf("logging into iscsi target %s: %w", t.Name, err)
+	}
+	out, _ := CommandWithPath("udevadm settle")
+	KLog.Logger.Debug().Str("out", out).Str("target", t.Name).Msg("iscsi login done")
+	if dev := t.DevicePath(); dev != "" {
+		if _, err := os.Stat(dev); err != nil {
+			return fmt.Errorf("lun %s of iscsi target %s not found: %w", t.LUN, t.Name, err)
+		}
+	}
+	return nil
+}
+
+// FetchToFile downloads url into dst, replacing whatever was there.
+// The body is written to a temporary file first so an interrupted download never leaves a truncated image behind.
+func FetchToFile(ctx context.Context, url, dst string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: unexpected status %s", url, resp.Status)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp := dst + ".part"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
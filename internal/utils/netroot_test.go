@@ -0,0 +1,126 @@
+package utils_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	"github.com/kairos-io/immucore/internal/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("network roots", func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		fs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "",
+		})
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	DescribeTable("RootProviderName",
+		func(cmdline, expected string) {
+			Expect(fs.WriteFile("/proc/cmdline", []byte(cmdline), 0o600)).To(Succeed())
+			Expect(utils.RootProviderName()).To(Equal(expected))
+		},
+		Entry("defaults to the loop image", "cos-img/filename=/cOS/active.img", constants.RootProviderLoop),
+		Entry("nfs from root=", "root=nfs:10.0.0.1:/exports/kairos", constants.RootProviderNFS),
+		Entry("iscsi from root=", "root=iscsi:10.0.0.1::3260:1:iqn.2004-04.com.example:disk0", constants.RootProviderISCSI),
+		Entry("http from root=", "root=https://example.com/rootfs.img", constants.RootProviderHTTP),
+		Entry("subvolume from the btrfs override", "rd.immucore.subvol=@snapshot-3", constants.RootProviderSubvolume),
+		Entry("explicit provider wins", "root=nfs:10.0.0.1:/exports/kairos rd.immucore.rootprovider=block", constants.RootProviderBlock),
+	)
+
+	Describe("ParseNFSRoot", func() {
+		It("parses server and path", func() {
+			source, options, err := utils.ParseNFSRoot("nfs:10.0.0.1:/exports/kairos")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(source).To(Equal("10.0.0.1:/exports/kairos"))
+			Expect(options).To(BeEmpty())
+		})
+		It("parses extra options", func() {
+			source, options, err := utils.ParseNFSRoot("nfs:server:/exports/kairos:vers=4.2,nolock")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(source).To(Equal("server:/exports/kairos"))
+			Expect(options).To(Equal([]string{"vers=4.2", "nolock"}))
+		})
+		It("fails without a path", func() {
+			_, _, err := utils.ParseNFSRoot("nfs:server")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("GetNFSStateSpec", func() {
+		It("is empty by default", func() {
+			Expect(utils.GetNFSStateSpec()).To(BeEmpty())
+		})
+		It("returns the export from the cmdline", func() {
+			Expect(fs.WriteFile("/proc/cmdline", []byte("root=nfs:10.0.0.1:/exports/kairos rd.immucore.nfs.state=10.0.0.1:/exports/node1:vers=4"), 0o600)).To(Succeed())
+			Expect(utils.GetNFSStateSpec()).To(Equal("10.0.0.1:/exports/node1:vers=4"))
+		})
+	})
+
+	Describe("ParseISCSIRoot", func() {
+		It("parses portal, lun and target name", func() {
+			t, err := utils.ParseISCSIRoot("iscsi:10.0.0.1:6:3260:1:iqn.2004-04.com.example:disk0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.Portal).To(Equal("10.0.0.1:3260"))
+			Expect(t.LUN).To(Equal("1"))
+			Expect(t.Name).To(Equal("iqn.2004-04.com.example:disk0"))
+		})
+		It("uses the default port when empty", func() {
+			t, err := utils.ParseISCSIRoot("iscsi:10.0.0.1:::0:iqn.2004-04.com.example:disk0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.Portal).To(Equal("10.0.0.1"))
+		})
+		It("refuses inline credentials", func() {
+			_, err := utils.ParseISCSIRoot("iscsi:user:pass@10.0.0.1::3260:1:iqn.2004-04.com.example:disk0")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	DescribeTable("ISCSITarget.DevicePath",
+		func(target utils.ISCSITarget, expected string) {
+			Expect(target.DevicePath()).To(Equal(expected))
+		},
+		Entry("with the portal port", utils.ISCSITarget{Portal: "10.0.0.1:3261", LUN: "1", Name: "iqn.2004-04.com.example:disk0"},
+			"/dev/disk/by-path/ip-10.0.0.1:3261-iscsi-iqn.2004-04.com.example:disk0-lun-1"),
+		Entry("with the default port", utils.ISCSITarget{Portal: "10.0.0.1", LUN: "0", Name: "iqn.2004-04.com.example:disk0"},
+			"/dev/disk/by-path/ip-10.0.0.1:3260-iscsi-iqn.2004-04.com.example:disk0-lun-0"),
+		Entry("without a lun", utils.ISCSITarget{Portal: "10.0.0.1", Name: "iqn.2004-04.com.example:disk0"}, ""),
+	)
+
+	Describe("FetchToFile", func() {
+		It("downloads the body into the destination", func() {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("rootfs"))
+			}))
+			defer srv.Close()
+			dst := filepath.Join(GinkgoT().TempDir(), "nested", "root.img")
+
+			Expect(utils.FetchToFile(context.Background(), srv.URL, dst)).To(Succeed())
+			Expect(os.ReadFile(dst)).To(Equal([]byte("rootfs")))
+		})
+		It("fails on a non 200 answer and leaves nothing behind", func() {
+			srv := httptest.NewServer(http.NotFoundHandler())
+			defer srv.Close()
+			dst := filepath.Join(GinkgoT().TempDir(), "root.img")
+
+			Expect(utils.FetchToFile(context.Background(), srv.URL, dst)).ToNot(Succeed())
+			Expect(dst).ToNot(BeAnExistingFile())
+		})
+	})
+})
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/constants"
+)
+
+// progressLineWidth is how much of the status fits on the consoles, the line is cut to keep it on a single row.
+const progressLineWidth = 79
+
+// ProgressOutput is where the boot progress is shown.
+type ProgressOutput interface {
+	// Show replaces the status shown with status.
+	Show(status string)
+	// Clear removes the status shown, if any.
+	Clear()
+}
+
+// ProgressThreshold returns how long a step runs before its progress is shown, from rd.immucore.progress=. 0
+// disables the progress.
+func ProgressThreshold() time.Duration {
+	return CmdlineSeconds(constants.CmdlineProgress, constants.ProgressDefaultThreshold)
+}
+
+// NewProgressOutput returns plymouth when plymouthd is running and the consoles from ConsoleDevices otherwise.
+func NewProgressOutput() ProgressOutput {
+	if exec.Command("plymouth", "--ping").Run() == nil {
+		return &plymouthProgress{}
+	}
+	return NewConsoleProgress(openConsolesForWriting(ConsoleDevices()...)...)
+}
+
+// plymouthProgress shows the status as a plymouth message, under the splash.
+type plymouthProgress struct {
+	mu   sync.Mutex
+	last string
+}
+
+func (p *plymouthProgress) Show(status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last != "" {
+		_ = exec.Command("plymouth", "hide-message", "--text="+p.last).Run()
+	}
+	_ = exec.Command("plymouth", "display-message", "--text="+status).Run()
+	p.last = status
+}
+
+func (p *plymouthProgress) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last != "" {
+		_ = exec.Command("plymouth", "hide-message", "--text="+p.last).Run()
+		p.last = ""
+	}
+}
+
+// ConsoleProgress shows the status on a single line of each console, rewritten in place.
+type ConsoleProgress struct {
+	mu       sync.Mutex
+	consoles []*os.File
+	shown    bool
+}
+
+// NewConsoleProgress returns a ConsoleProgress writing to consoles.
+func NewConsoleProgress(consoles ...*os.File) *ConsoleProgress {
+	return &ConsoleProgress{consoles: consoles}
+}
+
+func (c *ConsoleProgress) Show(status string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.write("\r\033[K" + truncateLine(status, progressLineWidth))
+	c.shown = true
+}
+
+func (c *ConsoleProgress) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shown {
+		c.write("\r\033[K")
+		c.shown = false
+	}
+}
+
+// write writes s to every console, ignoring the ones that fail.
+func (c *ConsoleProgress) write(s string) {
+	for _, f := range c.consoles {
+		_, _ = f.WriteString(s)
+	}
+}
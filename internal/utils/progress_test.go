@@ -0,0 +1,51 @@
+package utils_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("boot progress", func() {
+	It("rewrites a single line on the consoles", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "console")
+		f, err := os.Create(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+
+		c := utils.NewConsoleProgress(f)
+		c.Clear()
+		c.Show("immucore: mount-oem (5s)")
+		c.Show("immucore: " + strings.Repeat("x", 100))
+		c.Clear()
+		c.Clear()
+
+		out, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(out)).To(Equal("\r\033[Kimmucore: mount-oem (5s)" +
+			"\r\033[Kimmucore: " + strings.Repeat("x", 66) + "..." +
+			"\r\033[K"))
+	})
+
+	DescribeTable("ProgressThreshold",
+		func(cmdline string, expected time.Duration) {
+			fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+				"/proc/cmdline": cmdline,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer cleanup()
+			fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+			GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+			Expect(utils.ProgressThreshold()).To(Equal(expected))
+		},
+		Entry("default", "", 5*time.Second),
+		Entry("custom", "rd.immucore.progress=20", 20*time.Second),
+		Entry("disabled", "rd.immucore.progress=0", time.Duration(0)),
+	)
+})
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	"github.com/rs/zerolog"
+)
+
+// redactedValue replaces the value of anything that looks like a secret.
+const redactedValue = "<redacted>"
+
+// redaction holds the keys whose values are redacted and the expression matching them, see SetRedactedKeys.
+var redaction = struct {
+	sync.RWMutex
+	keys     []string
+	keyValue *regexp.Regexp
+}{}
+
+// userInfo matches the credentials of a url, e.g. the user and password of a challenger_server.
+var userInfo = regexp.MustCompile(`(\w+://)[^/\s:@"']+:[^/\s@"']+@`)
+
+func init() {
+	SetRedactedKeys(constants.DefaultRedactedKeys())
+}
+
+// SetRedactedKeys sets the names that make a key look like it names a secret, matched case-insensitively against
+// the whole key or its last part after a '.', '_' or '-': key matches api_key but not keymap nor ssh_authorized_keys.
+func SetRedactedKeys(keys []string) {
+	var alternatives []string
+	for _, k := range UniqueSlice(CleanupSlice(keys)) {
+		alternatives = append(alternatives, regexp.QuoteMeta(strings.ToLower(k)))
+	}
+	redaction.Lock()
+	defer redaction.Unlock()
+	redaction.keys = alternatives
+	redaction.keyValue = nil
+	if len(alternatives) == 0 {
+		return
+	}
+	// key=value on the cmdline, in a query string or a log line, key: value in yaml and "key":"value" in json.
+	// The key starts after anything that cannot be part of it, the value stops at whitespace, a quote or whatever
+	// separates it from the next pair.
+	redaction.keyValue = regexp.MustCompile(fmt.Sprintf(`(?i)(^|[^\w.\-])((?:[\w.\-]*[._\-])?(?:%s))(=|["']?[ \t]*:[ \t]*["']?)([^\s"'&,;}]+)`, strings.Join(alternatives, "|")))
+}
+
+// LoadRedactedKeys sets the redacted keys to DefaultRedactedKeys plus the ones given with rd.immucore.redact=.
+func LoadRedactedKeys() {
+	keys := constants.DefaultRedactedKeys()
+	for _, v := range ReadCMDLineArg(constants.CmdlineRedact) {
+		keys = append(keys, strings.Split(v, ",")...)
+	}
+	SetRedactedKeys(keys)
+}
+
+// isSecretKey reports whether key looks like it names a secret.
+func isSecretKey(key string) bool {
+	redaction.RLock()
+	defer redaction.RUnlock()
+	key = strings.ToLower(key)
+	for _, k := range redaction.keys {
+		if key == k || strings.HasSuffix(key, "."+k) || strings.HasSuffix(key, "_"+k) || strings.HasSuffix(key, "-"+k) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactSecrets returns s with the values of the keys that look like secrets and the credentials in urls replaced,
+// so it can be logged, shown or shared.
+func RedactSecrets(s string) string {
+	redaction.RLock()
+	keyValue := redaction.keyValue
+	redaction.RUnlock()
+	if keyValue != nil {
+		s = keyValue.ReplaceAllString(s, "${1}${2}${3}"+redactedValue)
+	}
+	return userInfo.ReplaceAllString(s, "${1}"+redactedValue+"@")
+}
+
+// redactField redacts a structured value found under key.
+func redactField(key string, v interface{}) interface{} {
+	if isSecretKey(key) {
+		return redactedValue
+	}
+	switch val := v.(type) {
+	case string:
+		return RedactSecrets(val)
+	case map[string]interface{}:
+		for k, inner := range val {
+			val[k] = redactField(k, inner)
+		}
+		return val
+	case []interface{}:
+		for i, inner := range val {
+			val[i] = redactField(key, inner)
+		}
+		return val
+	}
+	return v
+}
+
+// redactingWriter takes the events of a zerolog logger, redacts them and logs them again with out.
+// The kairos logger does not give access to its writers, so this is how every line gets redacted wherever it ends
+// up (console, journal, log files).
+type redactingWriter struct {
+	out zerolog.Logger
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		w.out.Log().Msg(RedactSecrets(strings.TrimSpace(string(p))))
+		return len(p), nil
+	}
+	levelName, _ := fields[zerolog.LevelFieldName].(string)
+	level, err := zerolog.ParseLevel(levelName)
+	if err != nil {
+		level = zerolog.NoLevel
+	}
+	msg, _ := fields[zerolog.MessageFieldName].(string)
+	delete(fields, zerolog.LevelFieldName)
+	delete(fields, zerolog.MessageFieldName)
+	for k, v := range fields {
+		fields[k] = redactField(k, v)
+	}
+	w.out.WithLevel(level).Fields(fields).Msg(RedactSecrets(msg))
+	return len(p), nil
+}
+
+// redactingLogger returns a logger at the level of out that redacts every event before handing it to out.
+func redactingLogger(out zerolog.Logger) zerolog.Logger {
+	return zerolog.New(redactingWriter{out: out}).Level(out.GetLevel())
+}
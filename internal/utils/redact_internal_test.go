@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"bytes"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("redaction", func() {
+	AfterEach(func() {
+		SetRedactedKeys(constants.DefaultRedactedKeys())
+	})
+
+	It("adds the keys from the cmdline to the defaults", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "rd.immucore.redact=pin,otp",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+		LoadRedactedKeys()
+		Expect(RedactSecrets("pin=1234 otp=42 token=abc user=kairos")).To(Equal("pin=<redacted> otp=<redacted> token=<redacted> user=kairos"))
+	})
+
+	DescribeTable("only redacts the keys named after a secret",
+		func(in, expected string) {
+			Expect(RedactSecrets(in)).To(Equal(expected))
+		},
+		Entry("keymap", "rd.vconsole.keymap=de-latin1 vconsole.keymap=us", "rd.vconsole.keymap=de-latin1 vconsole.keymap=us"),
+		Entry("keyboard", "keyboard: pc105", "keyboard: pc105"),
+		Entry("ssh_authorized_keys", "ssh_authorized_keys: github:kairos", "ssh_authorized_keys: github:kairos"),
+		Entry("key inside a word", "monkey=banana hotkey=f1", "monkey=banana hotkey=f1"),
+		Entry("key suffixes", "api_key=abc ssh-key=def kairos.key=ghi apikey=jkl", "api_key=<redacted> ssh-key=<redacted> kairos.key=<redacted> apikey=<redacted>"),
+		Entry("bare key", `{"key":"abc"}`, `{"key":"<redacted>"}`),
+	)
+
+	DescribeTable("isSecretKey",
+		func(key string, expected bool) {
+			Expect(isSecretKey(key)).To(Equal(expected))
+		},
+		Entry("password", "kms_password", true),
+		Entry("upper case", "API_TOKEN", true),
+		Entry("keymap", "keymap", false),
+		Entry("keyboard", "keyboard", false),
+		Entry("ssh_authorized_keys", "ssh_authorized_keys", false),
+		Entry("private key", "private-key", true),
+	)
+
+	It("redacts every log line", func() {
+		var buf bytes.Buffer
+		l := redactingLogger(zerolog.New(&buf).Level(zerolog.InfoLevel))
+		l.Debug().Msg("dropped")
+		l.Info().Str("content", "root=LABEL=COS_ACTIVE kms_password=hunter2").Str("api_token", "abc").Int("n", 3).Msg("cmdline token=abc")
+		Expect(buf.String()).ToNot(ContainSubstring("dropped"))
+		Expect(buf.String()).ToNot(ContainSubstring("hunter2"))
+		Expect(buf.String()).ToNot(ContainSubstring("abc"))
+		Expect(buf.String()).To(ContainSubstring(`"level":"info"`))
+		Expect(buf.String()).To(ContainSubstring(`"message":"cmdline token=<redacted>"`))
+		Expect(buf.String()).To(ContainSubstring(`"api_token":"<redacted>"`))
+		Expect(buf.String()).To(ContainSubstring(`"content":"root=LABEL=COS_ACTIVE kms_password=<redacted>"`))
+		Expect(buf.String()).To(ContainSubstring(`"n":3`))
+	})
+})
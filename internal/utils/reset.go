@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	sdkConstants "github.com/kairos-io/kairos-sdk/constants"
+)
+
+// ResetRequest is the factory reset asked for on the cmdline.
+type ResetRequest struct {
+	Target string   // one of constants.ResetPersistent, ResetOEM or ResetAll
+	Labels []string // filesystem labels of the partitions to reformat
+	Tokens []string // confirmation tokens, the filesystem UUIDs of the partitions, see constants.OpFactoryReset
+}
+
+// ResetPartition is a partition to reformat, with the filesystem it gets back.
+type ResetPartition struct {
+	Label  string
+	Device string
+	FSType string
+	UUID   string // filesystem UUID before the reset
+}
+
+// ResetRequested tells us if the cmdline asks for a factory reset, confirmed or not.
+func ResetRequested() bool {
+	return len(CleanupSlice(ReadCMDLineArg(constants.CmdlineReset))) > 0
+}
+
+// GetResetRequest reads the factory reset from the cmdline. An unknown target or a missing confirmation token are
+// errors, so neither a typo nor a lone rd.immucore.reset= stanza wipes anything. The tokens are only checked against
+// the partitions by CheckResetPartition.
+func GetResetRequest() (ResetRequest, error) {
+	targets := CleanupSlice(ReadCMDLineArg(constants.CmdlineReset))
+	if len(targets) == 0 {
+		return ResetRequest{}, errors.New("no factory reset requested")
+	}
+	r := ResetRequest{Target: targets[0]}
+	oemLabel := GetOemLabel()
+	if oemLabel == "" {
+		oemLabel = sdkConstants.OEMLabel
+	}
+	switch r.Target {
+	case constants.ResetPersistent:
+		r.Labels = []string{sdkConstants.PersistentLabel}
+	case constants.ResetOEM:
+		r.Labels = []string{oemLabel}
+	case constants.ResetAll:
+		r.Labels = []string{oemLabel, sdkConstants.PersistentLabel}
+	default:
+		return ResetRequest{}, fmt.Errorf("unknown factory reset target %q, expected %s, %s or %s",
+			r.Target, constants.ResetPersistent, constants.ResetOEM, constants.ResetAll)
+	}
+	for _, v := range ReadCMDLineArg(constants.CmdlineResetConfirm) {
+		r.Tokens = append(r.Tokens, strings.Split(v, ",")...)
+	}
+	r.Tokens = UniqueSlice(CleanupSlice(r.Tokens))
+	if len(r.Tokens) == 0 {
+		return ResetRequest{}, fmt.Errorf("factory reset of %s not confirmed: add %s<filesystem UUID>[,<filesystem UUID>] of the partitions to the cmdline",
+			r.Target, constants.CmdlineResetConfirm)
+	}
+	return r, nil
+}
+
+// CheckResetPartition returns whether p is to be reformatted: when its filesystem UUID is one of the tokens of r.
+// marker is the token p was last reset with, a partition reset with one of the tokens was reformatted already and
+// has a new UUID, it is left alone. Any other partition is an error, the tokens are not for this disk.
+func (r ResetRequest) CheckResetPartition(p ResetPartition, marker string) (bool, error) {
+	confirmed := func(uuid string) bool {
+		return uuid != "" && slices.ContainsFunc(r.Tokens, func(t string) bool { return strings.EqualFold(t, uuid) })
+	}
+	switch {
+	case confirmed(p.UUID):
+		return true, nil
+	case confirmed(marker):
+		return false, nil
+	default:
+		return false, fmt.Errorf("factory reset of %s not confirmed: %s does not name its filesystem UUID (see blkid %s)",
+			p.Label, constants.CmdlineResetConfirm, p.Device)
+	}
+}
+
+// mkfsCommand returns the command creating an fsType filesystem labeled label on device. Filesystems other than xfs
+// and btrfs, including an unreadable one, get back ext4 as the installer creates them.
+func mkfsCommand(fsType, label, device string) string {
+	switch fsType {
+	case "xfs", "btrfs":
+		return fmt.Sprintf("mkfs.%s -f -L %s %s", fsType, label, device)
+	case "ext2", "ext3":
+		return fmt.Sprintf("mkfs.%s -F -L %s %s", fsType, label, device)
+	default:
+		return fmt.Sprintf("mkfs.ext4 -F -L %s %s", label, device)
+	}
+}
+
+// BuildResetStage renders the yip cloud-init YAML that reformats the given partitions in place, keeping their labels.
+// yip's layout plugin only creates partitions, so unlike BuildEnsurePartitionsStage the stage runs the mkfs commands.
+//
+// The output is the full YAML for a single yip stage document — callers hand it directly to the yip executor with
+// an ad-hoc stage name.
+func BuildResetStage(parts []ResetPartition) string {
+	var steps strings.Builder
+	for _, p := range parts {
+		fmt.Fprintf(&steps, "    - name: \"Reformat %s\"\n      commands:\n        - %s\n",
+			p.Label, mkfsCommand(p.FSType, p.Label, p.Device))
+	}
+	return fmt.Sprintf("stages:\n  %s:\n%s", constants.OpFactoryReset, steps.String())
+}
@@ -0,0 +1,118 @@
+package utils_test
+
+import (
+	"strings"
+
+	"github.com/kairos-io/immucore/internal/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("factory reset helpers", func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		fs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "",
+		})
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+		GinkgoT().Setenv("GHW_CHROOT", GinkgoT().TempDir())
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+
+	Context("GetResetRequest", func() {
+		It("Is not requested when the stanza is absent", func() {
+			Expect(utils.ResetRequested()).To(BeFalse())
+			_, err := utils.GetResetRequest()
+			Expect(err).To(HaveOccurred())
+		})
+		It("Refuses a reset without the confirmation token", func() {
+			Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.reset=persistent\n"), 0o600)).To(Succeed())
+			Expect(utils.ResetRequested()).To(BeTrue())
+			_, err := utils.GetResetRequest()
+			Expect(err).To(MatchError(ContainSubstring("rd.immucore.reset.confirm=")))
+		})
+		It("Refuses unknown targets", func() {
+			Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.reset=persitent rd.immucore.reset.confirm=abc\n"), 0o600)).To(Succeed())
+			_, err := utils.GetResetRequest()
+			Expect(err).To(MatchError(ContainSubstring(`unknown factory reset target "persitent"`)))
+		})
+		It("Selects the partitions of the target", func() {
+			Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.reset=persistent rd.immucore.reset.confirm=abc\n"), 0o600)).To(Succeed())
+			r, err := utils.GetResetRequest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r).To(Equal(utils.ResetRequest{Target: "persistent", Labels: []string{"COS_PERSISTENT"}, Tokens: []string{"abc"}}))
+
+			Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.reset=all rd.immucore.reset.confirm=abc,def rd.immucore.oemlabel=MY_OEM\n"), 0o600)).To(Succeed())
+			r, err = utils.GetResetRequest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Labels).To(Equal([]string{"MY_OEM", "COS_PERSISTENT"}))
+			Expect(r.Tokens).To(Equal([]string{"abc", "def"}))
+		})
+	})
+
+	Context("CheckResetPartition", func() {
+		const oldUUID = "0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0"
+		const newUUID = "9f8e7d6c-5b4a-3928-1706-f5e4d3c2b1a0"
+		part := utils.ResetPartition{Label: "COS_PERSISTENT", Device: "/dev/vda5", FSType: "ext4", UUID: oldUUID}
+		req := func(tokens ...string) utils.ResetRequest {
+			return utils.ResetRequest{Target: "persistent", Labels: []string{"COS_PERSISTENT"}, Tokens: tokens}
+		}
+
+		It("Resets a partition confirmed with its filesystem UUID", func() {
+			reset, err := req(oldUUID).CheckResetPartition(part, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reset).To(BeTrue())
+
+			reset, err = req("other", strings.ToUpper(oldUUID)).CheckResetPartition(part, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reset).To(BeTrue())
+		})
+
+		DescribeTable("Refuses anything else",
+			func(tokens ...string) {
+				reset, err := req(tokens...).CheckResetPartition(part, "")
+				Expect(err).To(MatchError(ContainSubstring("factory reset of COS_PERSISTENT not confirmed")))
+				Expect(reset).To(BeFalse())
+			},
+			Entry("any string", "yes"),
+			Entry("the target", "persistent"),
+			Entry("the label", "COS_PERSISTENT"),
+			Entry("the UUID of another partition", newUUID),
+		)
+
+		It("Refuses a partition without a filesystem UUID", func() {
+			_, err := req("").CheckResetPartition(utils.ResetPartition{Label: "COS_PERSISTENT", Device: "/dev/vda5"}, "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Leaves alone a partition already reset with the token", func() {
+			reset, err := req(oldUUID).CheckResetPartition(utils.ResetPartition{Label: "COS_PERSISTENT", Device: "/dev/vda5", UUID: newUUID}, oldUUID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reset).To(BeFalse())
+
+			_, err = req(oldUUID).CheckResetPartition(utils.ResetPartition{Label: "COS_PERSISTENT", Device: "/dev/vda5", UUID: newUUID}, "another")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("BuildResetStage", func() {
+		It("Reformats every partition keeping its label and filesystem", func() {
+			y := utils.BuildResetStage([]utils.ResetPartition{
+				{Label: "COS_OEM", Device: "/dev/vda2", FSType: "ext4"},
+				{Label: "COS_PERSISTENT", Device: "/dev/vda5", FSType: "xfs"},
+				{Label: "COS_BROKEN", Device: "/dev/vda6"},
+			})
+			Expect(y).To(ContainSubstring("factory-reset:"))
+			Expect(y).To(ContainSubstring("mkfs.ext4 -F -L COS_OEM /dev/vda2"))
+			Expect(y).To(ContainSubstring("mkfs.xfs -f -L COS_PERSISTENT /dev/vda5"))
+			Expect(y).To(ContainSubstring("mkfs.ext4 -F -L COS_BROKEN /dev/vda6"))
+		})
+	})
+})
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/constants"
+)
+
+// CmdlineSeconds returns the number of seconds given to stanza on the cmdline as a duration, or def seconds when it
+// is missing or not a whole number.
+func CmdlineSeconds(stanza string, def int) time.Duration {
+	return time.Duration(cmdlineInt(stanza, def)) * time.Second
+}
+
+func cmdlineInt(stanza string, def int) int {
+	if v := CleanupSlice(ReadCMDLineArg(stanza)); len(v) > 0 {
+		if n, err := strconv.Atoi(v[0]); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// RetryPolicy returns how many times the failed part of the DAG is re-run automatically, how long to wait before
+// each attempt and how long to keep answering `immucore retry` afterwards, from rd.immucore.retry=,
+// rd.immucore.retrydelay= and rd.immucore.retrywait=.
+func RetryPolicy() (attempts int, delay, wait time.Duration) {
+	return cmdlineInt(constants.CmdlineRetry, 0),
+		CmdlineSeconds(constants.CmdlineRetryDelay, constants.RetryDefaultDelay),
+		CmdlineSeconds(constants.CmdlineRetryWait, 0)
+}
+
+// StepTimeout returns the deadline of step, from rd.immucore.steptimeout.<step>=, its default in
+// constants.DefaultStepTimeouts or rd.immucore.steptimeout=. 0 means no deadline.
+func StepTimeout(step string) time.Duration {
+	def, ok := constants.DefaultStepTimeouts()[step]
+	if !ok {
+		def = cmdlineInt(constants.CmdlineStepTimeout, constants.StepDefaultTimeout)
+	}
+	return CmdlineSeconds(constants.CmdlineStepTimeoutPrefix+step+"=", def)
+}
+
+// StepWatchdogInterval returns how often the steps still running are logged, from rd.immucore.stepwatchdog=.
+func StepWatchdogInterval() time.Duration {
+	return CmdlineSeconds(constants.CmdlineStepWatchdog, constants.StepWatchdogDefaultInterval)
+}
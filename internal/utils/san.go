@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/kairos-io/immucore/internal/constants"
+)
+
+// NVMfTarget is a discovery controller parsed from a dracut style rd.nvmf.discover= stanza.
+type NVMfTarget struct {
+	Transport     string // tcp, rdma...
+	Address       string // traddr of the discovery controller
+	HostInterface string // host_traddr, optional
+	Port          string // trsvcid, optional
+}
+
+// SANAttachRequested tells us if the cmdline asks for any iSCSI target or NVMe-oF subsystem to be attached, including
+// the root of the iscsi root provider.
+func SANAttachRequested() bool {
+	return RootProviderName() == constants.RootProviderISCSI ||
+		len(ReadCMDLineArg(constants.CmdlineISCSINetroot)) > 0 ||
+		len(ReadCMDLineArg(constants.CmdlineISCSITargetName)) > 0 ||
+		len(ReadCMDLineArg(constants.CmdlineNVMfDiscover)) > 0
+}
+
+// GetISCSITargets returns every iSCSI target on the cmdline, from root=iscsi:, from netroot=iscsi: stanzas and from
+// the rd.iscsi.target.* set.
+func GetISCSITargets() ([]ISCSITarget, error) {
+	var specs []string
+	if root := GetRootSpec(); strings.HasPrefix(root, "iscsi:") {
+		specs = append(specs, root)
+	}
+	var targets []ISCSITarget
+	for _, spec := range append(specs, CleanupSlice(ReadCMDLineArg(constants.CmdlineISCSINetroot))...) {
+		t, err := ParseISCSIRoot(spec)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+
+	name := CleanupSlice(ReadCMDLineArg(constants.CmdlineISCSITargetName))
+	if len(name) == 0 {
+		return targets, nil
+	}
+	ip := CleanupSlice(ReadCMDLineArg(constants.CmdlineISCSITargetIP))
+	if len(ip) == 0 {
+		return nil, fmt.Errorf("%s needs %s", constants.CmdlineISCSITargetName, constants.CmdlineISCSITargetIP)
+	}
+	t := ISCSITarget{Portal: ip[0], Name: name[0]}
+	if port := CleanupSlice(ReadCMDLineArg(constants.CmdlineISCSITargetPort)); len(port) > 0 {
+		t.Portal = fmt.Sprintf("%s:%s", ip[0], port[0])
+	}
+	if lun := CleanupSlice(ReadCMDLineArg(constants.CmdlineISCSILun)); len(lun) > 0 {
+		t.LUN = lun[0]
+	}
+	return append(targets, t), nil
+}
+
+// ParseNVMfDiscover parses a rd.nvmf.discover=transport,traddr[,host_traddr[,trsvcid]] value.
+func ParseNVMfDiscover(spec string) (NVMfTarget, error) {
+	dat := strings.Split(spec, ",")
+	if len(dat) < 2 || len(dat) > 4 || dat[0] == "" || dat[1] == "" {
+		return NVMfTarget{}, fmt.Errorf("invalid nvmf discover %q, expected transport,traddr[,host_traddr[,trsvcid]]", spec)
+	}
+	t := NVMfTarget{Transport: dat[0], Address: dat[1]}
+	if len(dat) > 2 {
+		t.HostInterface = dat[2]
+	}
+	if len(dat) > 3 {
+		t.Port = dat[3]
+	}
+	return t, nil
+}
+
+// GetNVMfTargets returns every discovery controller from the rd.nvmf.discover= stanzas.
+func GetNVMfTargets() ([]NVMfTarget, error) {
+	var targets []NVMfTarget
+	for _, spec := range CleanupSlice(ReadCMDLineArg(constants.CmdlineNVMfDiscover)) {
+		t, err := ParseNVMfDiscover(spec)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// NVMfConnect connects to every subsystem the discovery controller offers, then waits for udev to create the
+// device links.
+func NVMfConnect(t NVMfTarget) error {
+	cmd := fmt.Sprintf("nvme connect-all -t %s -a %s", t.Transport, t.Address)
+	if t.HostInterface != "" {
+		cmd = fmt.Sprintf("%s -w %s", cmd, t.HostInterface)
+	}
+	if t.Port != "" {
+		cmd = fmt.Sprintf("%s -s %s", cmd, t.Port)
+	}
+	if nqn := CleanupSlice(ReadCMDLineArg(constants.CmdlineNVMfHostNQN)); len(nqn) > 0 {
+		cmd = fmt.Sprintf("%s --hostnqn=%s", cmd, nqn[0])
+	}
+	if id := CleanupSlice(ReadCMDLineArg(constants.CmdlineNVMfHostID)); len(id) > 0 {
+		cmd = fmt.Sprintf("%s --hostid=%s", cmd, id[0])
+	}
+	if out, err := CommandWithPath(cmd); err != nil {
+		KLog.Logger.Debug().Str("out", out).Msg("nvme connect-all")
+		return fmt.Errorf("connecting nvmf subsystems on %s: %w", t.Address, err)
+	}
+	out, _ := CommandWithPath("udevadm settle")
+	KLog.Logger.Debug().Str("out", out).Str("address", t.Address).Msg("nvmf connect done")
+	return nil
+}
+
+// AttachSAN logs into all the iSCSI targets and connects all the NVMe-oF subsystems from the cmdline.
+// Every target is tried even if one fails, so a single dead portal does not hide the volumes of the others.
+func AttachSAN() error {
+	iscsiTargets, err := GetISCSITargets()
+	if err != nil {
+		return err
+	}
+	nvmfTargets, err := GetNVMfTargets()
+	if err != nil {
+		return err
+	}
+
+	if initiator := CleanupSlice(ReadCMDLineArg(constants.CmdlineISCSIInitiator)); len(initiator) > 0 {
+		if err = os.MkdirAll(filepath.Dir(constants.ISCSIInitiatorNameFile), 0755); err != nil {
+			return err
+		}
+		if err = os.WriteFile(constants.ISCSIInitiatorNameFile, []byte(fmt.Sprintf("InitiatorName=%s\n", initiator[0])), 0644); err != nil {
+			return err
+		}
+	}
+
+	var multierr *multierror.Error
+	for _, t := range iscsiTargets {
+		if err := ISCSILogin(t); err != nil {
+			KLog.Logger.Err(err).Str("target", t.Name).Msg("iscsi login")
+			multierr = multierror.Append(multierr, err)
+		}
+	}
+	for _, t := range nvmfTargets {
+		if err := NVMfConnect(t); err != nil {
+			KLog.Logger.Err(err).Str("address", t.Address).Msg("nvmf connect")
+			multierr = multierror.Append(multierr, err)
+		}
+	}
+	return multierr.ErrorOrNil()
+}
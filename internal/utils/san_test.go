@@ -0,0 +1,83 @@
+package utils_test
+
+import (
+	"github.com/kairos-io/immucore/internal/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("san attach", func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		fs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "",
+		})
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	DescribeTable("SANAttachRequested",
+		func(cmdline string, expected bool) {
+			Expect(fs.WriteFile("/proc/cmdline", []byte(cmdline), 0o600)).To(Succeed())
+			Expect(utils.SANAttachRequested()).To(Equal(expected))
+		},
+		Entry("nothing to attach", "cos-img/filename=/cOS/active.img", false),
+		Entry("iscsi root", "root=iscsi:10.0.0.1::3260:1:iqn.2004-04.com.example:disk0", true),
+		Entry("netroot iscsi", "netroot=iscsi:10.0.0.1::3260:1:iqn.2004-04.com.example:disk0", true),
+		Entry("rd.iscsi target", "rd.iscsi.target.ip=10.0.0.1 rd.iscsi.target.name=iqn.2004-04.com.example:disk0", true),
+		Entry("nvmf", "rd.nvmf.discover=tcp,10.0.0.2,,4420", true),
+	)
+
+	Describe("GetISCSITargets", func() {
+		It("merges netroot and rd.iscsi.target stanzas", func() {
+			Expect(fs.WriteFile("/proc/cmdline", []byte("netroot=iscsi:10.0.0.1::3260:1:iqn.2004-04.com.example:disk0 "+
+				"rd.iscsi.target.ip=10.0.0.3 rd.iscsi.target.port=3261 rd.iscsi.target.name=iqn.2004-04.com.example:disk1 rd.iscsi.lun=2"), 0o600)).To(Succeed())
+			targets, err := utils.GetISCSITargets()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(targets).To(Equal([]utils.ISCSITarget{
+				{Portal: "10.0.0.1:3260", LUN: "1", Name: "iqn.2004-04.com.example:disk0"},
+				{Portal: "10.0.0.3:3261", LUN: "2", Name: "iqn.2004-04.com.example:disk1"},
+			}))
+		})
+		It("includes the iscsi root first", func() {
+			Expect(fs.WriteFile("/proc/cmdline", []byte("netroot=iscsi:10.0.0.1::3260:1:iqn.2004-04.com.example:disk0 "+
+				"root=iscsi:10.0.0.2::3260:0:iqn.2004-04.com.example:root"), 0o600)).To(Succeed())
+			targets, err := utils.GetISCSITargets()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(targets).To(Equal([]utils.ISCSITarget{
+				{Portal: "10.0.0.2:3260", LUN: "0", Name: "iqn.2004-04.com.example:root"},
+				{Portal: "10.0.0.1:3260", LUN: "1", Name: "iqn.2004-04.com.example:disk0"},
+			}))
+		})
+		It("needs a portal for rd.iscsi.target.name", func() {
+			Expect(fs.WriteFile("/proc/cmdline", []byte("rd.iscsi.target.name=iqn.2004-04.com.example:disk1"), 0o600)).To(Succeed())
+			_, err := utils.GetISCSITargets()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	DescribeTable("ParseNVMfDiscover",
+		func(spec string, expected utils.NVMfTarget, fails bool) {
+			t, err := utils.ParseNVMfDiscover(spec)
+			if fails {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t).To(Equal(expected))
+		},
+		Entry("transport and address", "tcp,10.0.0.2", utils.NVMfTarget{Transport: "tcp", Address: "10.0.0.2"}, false),
+		Entry("all fields", "tcp,10.0.0.2,10.0.0.10,8009", utils.NVMfTarget{Transport: "tcp", Address: "10.0.0.2", HostInterface: "10.0.0.10", Port: "8009"}, false),
+		Entry("empty host interface", "tcp,10.0.0.2,,4420", utils.NVMfTarget{Transport: "tcp", Address: "10.0.0.2", Port: "4420"}, false),
+		Entry("missing address", "tcp", utils.NVMfTarget{}, true),
+		Entry("too many fields", "tcp,10.0.0.2,,4420,extra", utils.NVMfTarget{}, true),
+	)
+})
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BootTime returns the time since the kernel booted, time spent suspended included (CLOCK_BOOTTIME), so timestamps
+// line up with the kernel log and systemd-analyze.
+func BootTime() time.Duration {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		_ = unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	}
+	return time.Duration(ts.Nano())
+}
+
+// SubSpan is a part of a timed step, e.g. one attempt of a mount that is retried. Start and End are BootTime values.
+type SubSpan struct {
+	Name  string
+	Start time.Duration
+	End   time.Duration
+	Err   error
+}
+
+type subSpanKey struct{}
+
+// WithSubSpans returns a copy of ctx that hands the sub-spans recorded with it to record.
+func WithSubSpans(ctx context.Context, record func(SubSpan)) context.Context {
+	return context.WithValue(ctx, subSpanKey{}, record)
+}
+
+// RecordSubSpan records sp as part of the step ctx belongs to. It does nothing when the step is not timed.
+func RecordSubSpan(ctx context.Context, sp SubSpan) {
+	if record, ok := ctx.Value(subSpanKey{}).(func(SubSpan)); ok {
+		record(sp)
+	}
+}
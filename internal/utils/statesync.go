@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/immucore/internal/constants"
+)
+
+// syncedPrefix marks the files rsync copied in its output, which also has its errors.
+const syncedPrefix = ">synced "
+
+// syncStateCommands returns the rsync commands syncing src into dst with policy, see constants.SyncUpdate.
+// filesFrom is the file listing the files the image wins for with constants.SyncImageWins.
+func syncStateCommands(src, dst, policy, filesFrom string) []string {
+	// -aAX keeps the ownership, permissions, ACLs and xattrs, SELinux labels included.
+	base := fmt.Sprintf("rsync -aAX --out-format='%s%%n'", syncedPrefix)
+	switch policy {
+	case constants.SyncNever:
+		return nil
+	case constants.SyncNewFilesOnly:
+		return []string{fmt.Sprintf("%s --ignore-existing %s %s", base, src, dst)}
+	case constants.SyncImageWins:
+		cmds := []string{fmt.Sprintf("%s --ignore-existing %s %s", base, src, dst)}
+		if filesFrom != "" {
+			cmds = append(cmds, fmt.Sprintf("%s --files-from=%s %s %s", base, filesFrom, src, dst))
+		}
+		return cmds
+	default:
+		// This has the --update flag to avoid overwriting newer files in dst.
+		// This also has a weird bug in which if the source is a file and destination is a symlink.
+		// According to docs it should overwrite the symlink as its of a different type but it does not.
+		// Doing it the other way around (symlink source to file destination) does overwrite it so be careful with this.
+		// So we rely in that behaviour but if its fixed in the future we might need to change this.
+		// Reported here:
+		// https://github.com/RsyncProject/rsync/issues/827
+		return []string{fmt.Sprintf("%s --update %s %s", base, src, dst)}
+	}
+}
+
+// SyncState will rsync source into destination with policy, see constants.SyncUpdate. Useful for Bind mounts.
+// imageWins are the files, relative to src, copied over the ones of dst with constants.SyncImageWins, the ones
+// missing from src are skipped. It returns the files copied.
+func SyncState(src, dst, policy string, imageWins []string) ([]string, error) {
+	var filesFrom string
+	if policy == constants.SyncImageWins {
+		var list []string
+		for _, f := range imageWins {
+			if _, err := os.Lstat(filepath.Join(src, f)); err == nil {
+				list = append(list, f)
+			}
+		}
+		if len(list) > 0 {
+			tmp, err := os.CreateTemp("", "immucore-image-wins")
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(tmp.Name())
+			_, err = tmp.WriteString(strings.Join(list, "\n") + "\n")
+			if err := errors.Join(err, tmp.Close()); err != nil {
+				return nil, err
+			}
+			filesFrom = tmp.Name()
+		}
+	}
+
+	var copied []string
+	for _, c := range syncStateCommands(src, dst, policy, filesFrom) {
+		out, err := CommandWithPath(c)
+		var errLines []string
+		for _, l := range CleanupSlice(strings.Split(out, "\n")) {
+			if f, ok := strings.CutPrefix(l, syncedPrefix); ok {
+				if !strings.HasSuffix(f, "/") {
+					copied = append(copied, f)
+				}
+			} else {
+				errLines = append(errLines, l)
+			}
+		}
+		if err != nil {
+			return copied, fmt.Errorf("%w: %s", err, strings.Join(errLines, " "))
+		}
+	}
+	return copied, nil
+}
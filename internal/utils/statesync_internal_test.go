@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"github.com/kairos-io/immucore/internal/constants"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("state sync", func() {
+	DescribeTable("builds the rsync commands of the policy",
+		func(policy, filesFrom string, expected []string) {
+			Expect(syncStateCommands("/sysroot/etc/ssh/", "/state/etc-ssh.bind/", policy, filesFrom)).To(Equal(expected))
+		},
+		Entry("update by default", "", "", []string{
+			"rsync -aAX --out-format='>synced %n' --update /sysroot/etc/ssh/ /state/etc-ssh.bind/",
+		}),
+		Entry("update", constants.SyncUpdate, "", []string{
+			"rsync -aAX --out-format='>synced %n' --update /sysroot/etc/ssh/ /state/etc-ssh.bind/",
+		}),
+		Entry("copy new files only", constants.SyncNewFilesOnly, "", []string{
+			"rsync -aAX --out-format='>synced %n' --ignore-existing /sysroot/etc/ssh/ /state/etc-ssh.bind/",
+		}),
+		Entry("never sync", constants.SyncNever, "", nil),
+		Entry("image wins", constants.SyncImageWins, "/tmp/list", []string{
+			"rsync -aAX --out-format='>synced %n' --ignore-existing /sysroot/etc/ssh/ /state/etc-ssh.bind/",
+			"rsync -aAX --out-format='>synced %n' --files-from=/tmp/list /sysroot/etc/ssh/ /state/etc-ssh.bind/",
+		}),
+		Entry("image wins without files in the image", constants.SyncImageWins, "", []string{
+			"rsync -aAX --out-format='>synced %n' --ignore-existing /sysroot/etc/ssh/ /state/etc-ssh.bind/",
+		}),
+	)
+})
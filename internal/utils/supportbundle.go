@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	sdkConstants "github.com/kairos-io/kairos-sdk/constants"
+)
+
+// supportBundleFile is a file copied into the support bundle when it exists.
+type supportBundleFile struct {
+	name, path string
+}
+
+// supportBundleCommand is a command whose output, errors included, goes into the support bundle.
+type supportBundleCommand struct {
+	name, command string
+}
+
+var supportBundleFiles = []supportBundleFile{
+	{"proc-mounts", "/proc/mounts"},
+	{"cos-layout/cos-layout.env", "/run/cos/cos-layout.env"},
+	{"cos-layout/extra-layout.env", "/run/cos/extra-layout.env"},
+}
+
+var supportBundleCommands = []supportBundleCommand{
+	{"lsblk", "lsblk -o NAME,SIZE,TYPE,FSTYPE,LABEL,UUID,MOUNTPOINT"},
+	{"blkid", "blkid"},
+	{"dmesg", "dmesg"},
+}
+
+// BuildSupportBundle writes a tar.gz to w with everything needed to debug a failed boot: the content of LogDir
+// (log, boot timeline, dag state, failure summary), /proc/mounts, the block devices, the kernel ring buffer, the
+// cos-layout.env files and the cmdline. Secrets are redacted from all of it.
+func BuildSupportBundle(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name, content string) error {
+		content = RedactSecrets(content)
+		if err := tw.WriteHeader(&tar.Header{Name: filepath.Join("immucore-support", name), Mode: 0600, Size: int64(len(content)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := io.WriteString(tw, content)
+		return err
+	}
+
+	entries, err := os.ReadDir(constants.LogDir)
+	if err != nil && !os.IsNotExist(err) {
+		KLog.Logger.Warn().Err(err).Str("dir", constants.LogDir).Msg("Reading the log dir for the support bundle")
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(constants.LogDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		if err = add(filepath.Join("immucore", e.Name()), string(data)); err != nil {
+			return err
+		}
+	}
+	for _, f := range supportBundleFiles {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			continue
+		}
+		if err = add(f.name, string(data)); err != nil {
+			return err
+		}
+	}
+	for _, c := range supportBundleCommands {
+		out, err := CommandWithPath(c.command)
+		if err != nil {
+			out = fmt.Sprintf("%s\n(%s: %s)\n", out, c.command, err)
+		}
+		if err = add(c.name, out); err != nil {
+			return err
+		}
+	}
+	cmdline, _ := os.ReadFile(GetHostProcCmdline())
+	if err = add("cmdline", string(cmdline)); err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// supportBundleLabels are the filesystems tried, in order, to store the support bundle: the usb stick the
+// failure console also uses, then the OEM partition and the ESP, which are there on every install.
+func supportBundleLabels() []string {
+	return []string{constants.FailureMediaLabel, GetOemLabel(), sdkConstants.EfiLabel}
+}
+
+// WriteSupportBundle stores a support bundle on the first filesystem from supportBundleLabels found, so it survives
+// a reboot, and returns where it ended up.
+func WriteSupportBundle() (string, error) {
+	for _, label := range supportBundleLabels() {
+		dev := filepath.Join("/dev/disk/by-label", label)
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+		name, err := writeSupportBundleTo(dev)
+		if err != nil {
+			KLog.Logger.Warn().Err(err).Str("device", dev).Msg("Writing the support bundle")
+			continue
+		}
+		return fmt.Sprintf("%s:/%s", label, name), nil
+	}
+	return "", errors.New("no filesystem to store the support bundle found")
+}
+
+// writeSupportBundleTo writes a support bundle to SupportBundleDir on dev, dropping the oldest ones past
+// SupportBundleKeep so a reboot loop does not fill the partition. It returns the path of the bundle on dev.
+func writeSupportBundleTo(dev string) (string, error) {
+	if err := os.MkdirAll(constants.FailureMediaMountPoint, 0700); err != nil {
+		return "", err
+	}
+	if out, err := CommandWithPath(fmt.Sprintf("mount %s %s", dev, constants.FailureMediaMountPoint)); err != nil {
+		return "", fmt.Errorf("mounting %s: %s", dev, strings.TrimSpace(out))
+	}
+	defer func() {
+		_, _ = CommandWithPath(fmt.Sprintf("umount %s", constants.FailureMediaMountPoint))
+	}()
+
+	dir := filepath.Join(constants.FailureMediaMountPoint, constants.SupportBundleDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("immucore-support-%s.tar.gz", time.Now().Format("20060102-150405"))
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err = BuildSupportBundle(f); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		return "", err
+	}
+	pruneSupportBundles(dir, constants.SupportBundleKeep)
+	syscall.Sync()
+	return filepath.Join(constants.SupportBundleDir, name), nil
+}
+
+// pruneSupportBundles removes the oldest bundles in dir so only keep are left. Names sort by date.
+func pruneSupportBundles(dir string, keep int) {
+	bundles, _ := filepath.Glob(filepath.Join(dir, "immucore-support-*.tar.gz"))
+	sort.Strings(bundles)
+	for len(bundles) > keep {
+		_ = os.Remove(bundles[0])
+		bundles = bundles[1:]
+	}
+}
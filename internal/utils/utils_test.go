@@ -136,6 +136,13 @@ var _ = Describe("mount utils", func() {
 			// We cant manipulate runtime, so it will return an empty label as it cant identify where are we
 			Expect(label).To(Equal(""))
 		})
+		It("Returns an empty target when booting from a btrfs subvolume", func() {
+			err := fs.WriteFile("/proc/cmdline", []byte("rd.immucore.subvol=@snapshot-3\n"), os.ModePerm)
+			Expect(err).ToNot(HaveOccurred())
+			target, _, err := utils.GetTarget(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal(""))
+		})
 		It("Returns an error if we dont have the target in the cmdline", func() {
 			target, label, err := utils.GetTarget(false)
 			Expect(err).To(HaveOccurred())
@@ -143,6 +150,21 @@ var _ = Describe("mount utils", func() {
 			Expect(label).To(Equal(""))
 		})
 	})
+	Context("GetRootSubvolume", func() {
+		It("Returns empty when btrfs root is not enabled", func() {
+			Expect(utils.GetRootSubvolume()).To(Equal(""))
+		})
+		It("Returns the subvolume given on the cmdline", func() {
+			err := fs.WriteFile("/proc/cmdline", []byte("rd.immucore.btrfs rd.immucore.subvol=@snapshot-3\n"), os.ModePerm)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(utils.GetRootSubvolume()).To(Equal("@snapshot-3"))
+		})
+		It("Ignores an empty override", func() {
+			err := fs.WriteFile("/proc/cmdline", []byte("rd.immucore.subvol=\n"), os.ModePerm)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(utils.GetRootSubvolume()).To(Equal(""))
+		})
+	})
 	Context("DisableImmucore", func() {
 		It("Disables immucore if cmdline contains live:LABEL", func() {
 			err := fs.WriteFile("/proc/cmdline", []byte("root=live:LABEL=COS_LIVE\n"), os.ModePerm)
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/constants"
+	"golang.org/x/sys/unix"
+)
+
+// Watchdog is an armed hardware watchdog. It reboots the machine unless it is petted at least once per Timeout.
+// A nil Watchdog does nothing, so callers do not need to care whether one is armed.
+type Watchdog struct {
+	mu      sync.Mutex
+	f       *os.File
+	timeout time.Duration
+}
+
+// HardwareWatchdog is the watchdog armed by ArmHardwareWatchdog, nil when there is none.
+var HardwareWatchdog *Watchdog
+
+// errWatchdogReleased is returned when petting a watchdog that was already disarmed or handed off.
+var errWatchdogReleased = errors.New("watchdog already released")
+
+// WatchdogTimeout returns the timeout of the hardware watchdog from rd.immucore.watchdog=, 0 when it is disabled.
+func WatchdogTimeout() time.Duration {
+	return CmdlineSeconds(constants.CmdlineWatchdog, 0)
+}
+
+// OpenWatchdog arms the watchdog at dev with timeout. Drivers that cannot change their timeout keep their own, see
+// Timeout.
+func OpenWatchdog(dev string, timeout time.Duration) (*Watchdog, error) {
+	f, err := os.OpenFile(dev, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watchdog{f: f, timeout: timeout}
+	fd := int(f.Fd())
+	if err = unix.IoctlSetPointerInt(fd, unix.WDIOC_SETTIMEOUT, int(timeout/time.Second)); err != nil {
+		KLog.Logger.Warn().Err(err).Str("device", dev).Msg("Could not set the watchdog timeout")
+	}
+	if secs, err := unix.IoctlGetInt(fd, unix.WDIOC_GETTIMEOUT); err == nil && secs > 0 {
+		w.timeout = time.Duration(secs) * time.Second
+	}
+	return w, nil
+}
+
+// Timeout returns how long the watchdog waits for a pet before rebooting the machine.
+func (w *Watchdog) Timeout() time.Duration {
+	if w == nil {
+		return 0
+	}
+	return w.timeout
+}
+
+// Armed returns whether the watchdog is still held, neither disarmed nor handed off.
+func (w *Watchdog) Armed() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f != nil
+}
+
+// Pet resets the countdown of the watchdog.
+func (w *Watchdog) Pet() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return errWatchdogReleased
+	}
+	_, err := w.f.Write([]byte{'\n'})
+	return err
+}
+
+// Disarm stops the watchdog with the magic close. Drivers built with nowayout cannot be stopped and still reboot
+// the machine after Timeout.
+func (w *Watchdog) Disarm() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	_, err := w.f.Write([]byte{'V'})
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// HandOff closes the watchdog leaving it armed, for the next owner to pet it within Timeout. It is what happens
+// anyway when immucore execs or exits, the device being closed without the magic character.
+func (w *Watchdog) HandOff() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	// Pet it one last time so the next owner gets the whole timeout.
+	_, _ = w.f.Write([]byte{'\n'})
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// ArmHardwareWatchdog arms WatchdogDevice when rd.immucore.watchdog= is set, see HardwareWatchdog.
+func ArmHardwareWatchdog() error {
+	timeout := WatchdogTimeout()
+	if timeout == 0 {
+		return nil
+	}
+	w, err := OpenWatchdog(constants.WatchdogDevice, timeout)
+	if err != nil {
+		return err
+	}
+	HardwareWatchdog = w
+	KLog.Logger.Info().Str("device", constants.WatchdogDevice).Str("timeout", w.Timeout().String()).Msg("Armed the hardware watchdog")
+	return nil
+}
+
+// ReleaseHardwareWatchdog hands the hardware watchdog off to the system when rd.immucore.watchdog.handoff is set and
+// disarms it otherwise. Meant to be called before exec-ing init or exiting.
+func ReleaseHardwareWatchdog() {
+	if !HardwareWatchdog.Armed() {
+		return
+	}
+	if len(ReadCMDLineArg(constants.CmdlineWatchdogHandoff)) > 0 {
+		if err := HardwareWatchdog.HandOff(); err != nil {
+			KLog.Logger.Warn().Err(err).Msg("Handing off the hardware watchdog")
+			return
+		}
+		KLog.Logger.Info().Str("timeout", HardwareWatchdog.Timeout().String()).Msg("Handed off the hardware watchdog, it must be petted from now on")
+		return
+	}
+	DisarmHardwareWatchdog("boot done")
+}
+
+// DisarmHardwareWatchdog stops the hardware watchdog, for why.
+func DisarmHardwareWatchdog(why string) {
+	if !HardwareWatchdog.Armed() {
+		return
+	}
+	if err := HardwareWatchdog.Disarm(); err != nil {
+		KLog.Logger.Warn().Err(err).Str("reason", why).Msg("Disarming the hardware watchdog")
+		return
+	}
+	KLog.Logger.Info().Str("reason", why).Msg("Disarmed the hardware watchdog")
+}
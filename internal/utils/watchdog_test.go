@@ -0,0 +1,75 @@
+package utils_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/immucore/internal/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("hardware watchdog", func() {
+	var dev string
+
+	BeforeEach(func() {
+		// A regular file stands in for the device, the timeout ioctls fail on it and are ignored.
+		dev = filepath.Join(GinkgoT().TempDir(), "watchdog")
+		Expect(os.WriteFile(dev, nil, 0600)).To(Succeed())
+	})
+
+	It("pets and disarms with the magic close", func() {
+		w, err := utils.OpenWatchdog(dev, 30*time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Timeout()).To(Equal(30 * time.Second))
+		Expect(w.Armed()).To(BeTrue())
+		Expect(w.Pet()).To(Succeed())
+		Expect(w.Pet()).To(Succeed())
+		Expect(w.Disarm()).To(Succeed())
+		Expect(w.Armed()).To(BeFalse())
+		Expect(w.Pet()).ToNot(Succeed())
+		Expect(w.Disarm()).To(Succeed())
+		Expect(os.ReadFile(dev)).To(Equal([]byte("\n\nV")))
+	})
+
+	It("hands off without the magic close", func() {
+		w, err := utils.OpenWatchdog(dev, 30*time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.HandOff()).To(Succeed())
+		Expect(w.Armed()).To(BeFalse())
+		Expect(w.Disarm()).To(Succeed())
+		Expect(os.ReadFile(dev)).To(Equal([]byte("\n")))
+	})
+
+	It("does nothing when there is no watchdog", func() {
+		var w *utils.Watchdog
+		Expect(w.Armed()).To(BeFalse())
+		Expect(w.Pet()).To(Succeed())
+		Expect(w.Disarm()).To(Succeed())
+		Expect(w.HandOff()).To(Succeed())
+		Expect(w.Timeout()).To(BeZero())
+	})
+
+	It("fails to open a missing device", func() {
+		_, err := utils.OpenWatchdog(filepath.Join(GinkgoT().TempDir(), "missing"), time.Minute)
+		Expect(err).To(HaveOccurred())
+	})
+
+	DescribeTable("WatchdogTimeout",
+		func(cmdline string, expected time.Duration) {
+			fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+				"/proc/cmdline": cmdline,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer cleanup()
+			fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+			GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+			Expect(utils.WatchdogTimeout()).To(Equal(expected))
+		},
+		Entry("disabled by default", "", time.Duration(0)),
+		Entry("armed", "rd.immucore.watchdog=120", 120*time.Second),
+		Entry("handoff alone does not arm it", "rd.immucore.watchdog.handoff", time.Duration(0)),
+	)
+})
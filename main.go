@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/kairos-io/immucore/internal/constants"
 	"github.com/kairos-io/immucore/internal/utils"
@@ -21,8 +24,8 @@ func main() {
 	app.Authors = []*cli.Author{{Name: "Kairos authors"}}
 	app.Copyright = "kairos authors"
 	app.Action = func(c *cli.Context) (err error) {
-		var targetDevice, targetImage string
 		var st *state.State
+		start := time.Now()
 
 		utils.MountBasic()
 		utils.SetLogger()
@@ -32,28 +35,32 @@ func main() {
 
 		cmdline, _ := os.ReadFile(utils.GetHostProcCmdline())
 		utils.KLog.Logger.Debug().Str("content", string(cmdline)).Msg("cmdline")
+
+		// Reboot the machine if the boot stalls, when asked to with rd.immucore.watchdog.
+		if !c.Bool("dry-run") {
+			if err := utils.ArmHardwareWatchdog(); err != nil {
+				utils.KLog.Logger.Warn().Err(err).Msg("Could not arm the hardware watchdog")
+			}
+			petCtx, stopPetting := context.WithCancel(context.Background())
+			defer stopPetting()
+			defer utils.ReleaseHardwareWatchdog()
+			state.PetWatchdog(petCtx, utils.HardwareWatchdog)
+		}
 		g := herd.DAG(herd.EnableInit)
 
 		// Get targets and state
-		targetImage, targetDevice, err = utils.GetTarget(c.Bool("dry-run"))
+		st, err = state.NewState(c.Bool("dry-run"))
 		if err != nil {
 			return err
 		}
 
-		st = &state.State{
-			Rootdir:       utils.GetRootDir(),
-			TargetDevice:  targetDevice,
-			TargetImage:   targetImage,
-			RootMountMode: utils.RootRW(),
-			OverlayBase:   utils.GetOverlayBase(),
-			InRAM:         utils.BootInRAM(),
-		}
-
 		// normalBoot tracks whether we took the full active/passive/recovery mount
 		// pipeline. Only that path should drop to an emergency shell on failure:
 		// live media intentionally disables immucore, and UKI already drops to a
 		// shell from inside its own steps.
 		var normalBoot bool
+		// mode is which of the workflows below runs, kept in the boot history. It also picks the plugin steps.
+		var mode string
 		switch {
 		case st.InRAM && utils.IsUKI():
 			// Trusted boot in-RAM: the UKI is already the whole system in
@@ -61,7 +68,7 @@ func main() {
 			// st.InRAM to add partition provisioning (encrypted with the TPM
 			// policy) and to skip the removable-media unlock/sentinel gates.
 			utils.KLog.Logger.Info().Msg("UKI booting in-RAM (kairos.ram) with OEM+persistent from disk!")
-			err = dag.RegisterUKI(st, g)
+			mode = dag.ModeUKI
 		case st.InRAM:
 			// kairos.ram must win over DisableImmucore below: an in-RAM boot
 			// still has live:LABEL / netboot on the cmdline (that is how the
@@ -70,18 +77,32 @@ func main() {
 			// persistent + apply cloud-init from disk.
 			utils.KLog.Logger.Info().Msg("Booting in-RAM (kairos.ram) with OEM+persistent from disk.")
 			normalBoot = true
-			err = dag.RegisterInRAMBoot(st, g)
+			mode = dag.ModeInRAM
+		case st.RootProvider == constants.RootProviderNFS:
+			// Same as kairos.ram, an nfs root still carries netboot on the
+			// cmdline but we want the full layout (overlays, binds, custom
+			// mounts) on top of the read-only export.
+			utils.KLog.Logger.Info().Msg("Booting from an nfs root.")
+			normalBoot = true
+			mode = dag.ModeNFS
 		case utils.DisableImmucore():
 			utils.KLog.Logger.Info().Msg("Stanza rd.cos.disable/rd.immucore.disable on the cmdline or booting from CDROM/Netboot/Squash recovery. Disabling immucore.")
-			err = dag.RegisterLiveMedia(st, g)
+			mode = dag.ModeLive
 		case utils.IsUKI():
 			utils.KLog.Logger.Info().Msg("UKI booting!")
-			err = dag.RegisterUKI(st, g)
+			mode = dag.ModeUKI
 		default:
 			utils.KLog.Logger.Info().Msg("Booting on active/passive/recovery.")
 			normalBoot = true
-			err = dag.RegisterNormalBoot(st, g)
+			mode = dag.ModeNormal
 		}
+		// UKI execs init from its last step, keep the boot history from there as main never gets it back.
+		if mode == dag.ModeUKI && !c.Bool("dry-run") {
+			st.BeforeInit = func(g *herd.Graph) {
+				persistBootHistory(utils.NewBootRecord(mode, start, nil, st.FailedOps(g)))
+			}
+		}
+		err = dag.Register(mode, st, g)
 
 		if err != nil {
 			return err
@@ -94,8 +115,32 @@ func main() {
 			return nil
 		}
 
-		err = g.Run(context.Background())
-		utils.KLog.Logger.Info().Msg(st.WriteDAG(g))
+		// Log the steps still running every now and then, so a hung boot shows where it hangs.
+		watchCtx, stopWatching := context.WithCancel(context.Background())
+		state.WatchSteps(watchCtx, utils.StepWatchdogInterval())
+		// Tell systemd what is going on when running as immucore.service.
+		stopNotify := state.StartSystemdNotify()
+		defer func() {
+			stopNotify()
+			var reason string
+			if err != nil {
+				reason = st.FailureReason(g)
+			}
+			state.NotifySystemdDone(err, reason)
+		}()
+		// Show the steps that take a while, so a slow boot does not look hung.
+		stopProgress := func() {}
+		if threshold := utils.ProgressThreshold(); threshold > 0 {
+			stopProgress = state.StartProgress(threshold, utils.NewProgressOutput())
+		}
+		retrier := state.NewRetrier(st, g, constants.LogDir)
+		err = retrier.Run(context.Background())
+		stopProgress()
+		if normalBoot && len(retrier.Failed()) > 0 {
+			err = recoverFailedBoot(st, retrier)
+		}
+		stopWatching()
+		g = retrier.Graph()
 		// Emit the boot timeline (slowest-first) to the log and a machine-readable
 		// trace file under constants.LogDir for diagnosing slow/hung boots.
 		utils.KLog.Logger.Info().Msg(state.RenderTimeline())
@@ -114,6 +159,19 @@ func main() {
 			if _, werr := utils.WriteFailureSummary(constants.LogDir, summary); werr != nil {
 				utils.KLog.Logger.Err(werr).Msg("writing failure summary")
 			}
+			// Keep everything needed to debug this boot somewhere that survives the reboot.
+			if path, berr := utils.WriteSupportBundle(); berr != nil {
+				utils.KLog.Logger.Err(berr).Msg("writing support bundle")
+			} else {
+				utils.KLog.Logger.Info().Str("path", path).Msg("Wrote support bundle")
+				fmt.Fprintf(os.Stderr, "Support bundle: %s\n", path)
+			}
+		}
+		// /run is gone after a reboot, keep this boot around so a failure that
+		// made the machine reboot can still be looked at from the next boot.
+		// A UKI boot only gets here when it did not exec init.
+		if normalBoot || mode == dag.ModeUKI {
+			persistBootHistory(utils.NewBootRecord(mode, start, err, retrier.Failed()))
 		}
 		return err
 	}
@@ -123,6 +181,210 @@ func main() {
 		},
 	}
 	app.Commands = []*cli.Command{
+		{
+			Name:  "retry",
+			Usage: "Re-run the failed steps of a running immucore and their dependents",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "status",
+					Usage: "Only show what is failing",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				req := state.RetryRequestRetry
+				if c.Bool("status") {
+					req = state.RetryRequestStatus
+				}
+				resp, err := state.RequestRetry(constants.RetrySocket, req)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Retries: %d\n", resp.Attempts)
+				if len(resp.Failed) == 0 {
+					fmt.Println("All steps succeeded")
+					return nil
+				}
+				for _, f := range resp.Failed {
+					fmt.Printf("Failed: %s: %s\n", f.Name, f.Err)
+				}
+				return fmt.Errorf("%d steps still failing", len(resp.Failed))
+			},
+		},
+		{
+			Name:  "support-bundle",
+			Usage: "Collect logs and system state to debug a failed boot into a tarball",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "Where to write the tarball, - for stdout. By default it is stored on the usb stick, OEM or ESP",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				output := c.String("output")
+				// The logger also writes to stdout, which is where the tarball goes with -.
+				if output != "-" {
+					utils.SetLogger()
+				}
+				switch output {
+				case "":
+					path, err := utils.WriteSupportBundle()
+					if err != nil {
+						return err
+					}
+					fmt.Println(path)
+					return nil
+				case "-":
+					return utils.BuildSupportBundle(os.Stdout)
+				default:
+					f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+					if err != nil {
+						return err
+					}
+					if err = utils.BuildSupportBundle(f); err != nil {
+						_ = f.Close()
+						return err
+					}
+					return f.Close()
+				}
+			},
+		},
+		{
+			Name:      "history",
+			Usage:     "List the last boots kept on persistent storage, or compare the step durations of two of them",
+			ArgsUsage: "[--compare [<before> [<after>]]]",
+			Description: "Boots are referred to by their number in the list (1 is the newest) or the start of their boot id.\n" +
+				"--compare without boots compares the newest boot with the one before it.",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "dir",
+					Usage: "History directory, by default the one on COS_PERSISTENT or COS_OEM",
+				},
+				&cli.IntFlag{
+					Name:  "n",
+					Value: 10,
+					Usage: "How many boots to list",
+				},
+				&cli.BoolFlag{
+					Name:  "compare",
+					Usage: "Compare the step durations of two boots",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Int("n") < 0 {
+					return fmt.Errorf("-n must not be negative, got %d", c.Int("n"))
+				}
+				dir := c.String("dir")
+				if dir == "" {
+					d, cleanup, err := utils.FindBootHistory()
+					if err != nil {
+						return err
+					}
+					defer cleanup()
+					dir = d
+				}
+				entries, err := utils.ReadBootHistory(dir)
+				if err != nil {
+					return err
+				}
+				if !c.Bool("compare") {
+					fmt.Print(utils.RenderBootHistory(entries[:min(c.Int("n"), len(entries))]))
+					return nil
+				}
+				before, after := "2", "1"
+				if c.NArg() > 0 {
+					before = c.Args().Get(0)
+				}
+				if c.NArg() > 1 {
+					after = c.Args().Get(1)
+				}
+				b, err := utils.SelectBoot(entries, before)
+				if err != nil {
+					return err
+				}
+				a, err := utils.SelectBoot(entries, after)
+				if err != nil {
+					return err
+				}
+				fmt.Print(utils.RenderBootComparison(b, a))
+				return nil
+			},
+		},
+		{
+			Name:  "dag",
+			Usage: "Print the graph of steps of a boot mode, to review their ordering",
+			Description: "Dependencies are solid edges, weak dependencies, which do not stop the op when they fail, are dashed.\n" +
+				"Background ops have a double border. After a run the ops are coloured by their outcome: green when they\n" +
+				"succeeded, red when they failed and grey when they did not run.",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "format",
+					Value: dag.FormatDOT,
+					Usage: "Output format: dot, json or mermaid",
+				},
+				&cli.StringFlag{
+					Name:  "mode",
+					Value: dag.ModeNormal,
+					Usage: "Boot mode to build the graph for: normal, uki, inram, live or nfs",
+				},
+				&cli.StringFlag{
+					Name:  "cmdline",
+					Usage: "Kernel cmdline to build the graph from, by default the one of this boot",
+				},
+				&cli.BoolFlag{
+					Name:  "oem-encrypted",
+					Usage: "Build the graph for an encrypted OEM partition instead of probing the disks",
+				},
+				&cli.StringFlag{
+					Name:  "status",
+					Value: filepath.Join(constants.LogDir, constants.DAGStateFile),
+					Usage: "State of a run to colour the ops with, ignored when missing",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.IsSet("cmdline") {
+					f, err := os.CreateTemp("", "immucore-cmdline")
+					if err != nil {
+						return err
+					}
+					defer os.Remove(f.Name())
+					_, err = f.WriteString(c.String("cmdline"))
+					if cerr := f.Close(); err == nil {
+						err = cerr
+					}
+					if err != nil {
+						return err
+					}
+					if err = os.Setenv("HOST_PROC_CMDLINE", f.Name()); err != nil {
+						return err
+					}
+				}
+				if c.IsSet("oem-encrypted") {
+					encrypted := c.Bool("oem-encrypted")
+					dag.OEMEncrypted = func() bool { return encrypted }
+				}
+				st, err := state.NewState(true)
+				if err != nil {
+					return err
+				}
+				g := herd.DAG(herd.EnableInit)
+				if err = dag.Register(c.String("mode"), st, g); err != nil {
+					return err
+				}
+				var outcomes []state.OpOutcome
+				if path := c.String("status"); path != "" {
+					outcomes, err = state.ReadOpOutcomes(path)
+					if err != nil && !errors.Is(err, os.ErrNotExist) {
+						return err
+					}
+				}
+				out, err := dag.Export(g, c.String("format"), outcomes)
+				if err != nil {
+					return err
+				}
+				fmt.Print(out)
+				return nil
+			},
+		},
 		{
 			Name:  "version",
 			Usage: "version",
@@ -141,3 +403,54 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// recoverFailedBoot tries to get the failed steps of a normal boot to succeed without rebooting: first with the
+// automatic retries from the cmdline, then from the failure console while the root is missing, and finally by
+// waiting for `immucore retry`, which works the whole time. It returns the error the boot ends up with.
+func recoverFailedBoot(st *state.State, r *state.Retrier) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := r.Serve(ctx, constants.RetrySocket); err != nil {
+		utils.KLog.Logger.Warn().Err(err).Msg("Could not listen for retry requests")
+	}
+
+	attempts, delay, wait := utils.RetryPolicy()
+	r.AutoRetry(ctx, attempts, delay)
+	if r.Err() != nil {
+		// From here on it waits on whoever is in front of the machine.
+		utils.DisarmHardwareWatchdog("boot failed")
+	}
+	// Give whoever is in front of the machine a chance to fix things (plug
+	// a disk, unlock, grab the logs) and re-run the failed part of the DAG
+	// before giving up.
+	for r.Err() != nil {
+		// The logs can be copied from the console, so they need the summary and the timeline of the failure.
+		writeFailureLogs(st, r.Graph())
+		if utils.RunFailureConsole(r.Failed()) != utils.FailureActionRetry {
+			break
+		}
+		_ = r.Retry(ctx)
+	}
+	r.WaitForRetries(ctx, wait)
+	return r.Err()
+}
+
+// writeFailureLogs writes the failure summary and the timeline trace of g to constants.LogDir.
+func writeFailureLogs(st *state.State, g *herd.Graph) {
+	summary := utils.RenderFailureSummary(st.FailureReason(g), constants.LogDir)
+	if _, err := utils.WriteFailureSummary(constants.LogDir, summary); err != nil {
+		utils.KLog.Logger.Err(err).Msg("writing failure summary")
+	}
+	if _, err := state.WriteTimelineTrace(constants.LogDir); err != nil {
+		utils.KLog.Logger.Warn().Err(err).Msg("Could not write boot timeline trace")
+	}
+}
+
+// persistBootHistory keeps rec and the logs of this boot in the boot history, logging where they ended up.
+func persistBootHistory(rec utils.BootRecord) {
+	if path, err := utils.PersistBootHistory(rec); err != nil {
+		utils.KLog.Logger.Warn().Err(err).Msg("Could not keep the boot history")
+	} else if path != "" {
+		utils.KLog.Logger.Info().Str("path", path).Msg("Kept the boot history")
+	}
+}
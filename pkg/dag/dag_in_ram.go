@@ -15,7 +15,7 @@ import (
 //
 // This mirrors RegisterNormalBoot but drops LVM activation and the whole
 // mount-root / discover-state / mount-state chain (dracut has already handed
-// us /sysroot). It keeps the OEM + kcrypt ordering rules, the rootfs yip
+// us /sysroot). It keeps SAN attach, md assembly, the OEM + kcrypt ordering rules, the rootfs yip
 // stage, cos-layout.env loading, overlay/custom/bind mounts, sysext/confext,
 // fstab writing, and the initramfs stage — so the resulting system is
 // indistinguishable from a real Active install for cloud-init and userland.
@@ -32,20 +32,41 @@ func RegisterInRAMBoot(s *state.State, g *herd.Graph) error {
 	// dracut's rd.live.ram already staged /sysroot for us; just wait for it.
 	s.LogIfError(s.WaitForSysrootDagStep(g), "waiting for sysroot")
 
+	// SAN volumes (iSCSI, NVMe-oF) may carry COS_OEM or COS_PERSISTENT, so
+	// attach them before anything looks for the labels.
+	var attachDeps []herd.OpOption
+	if internalUtils.SANAttachRequested() {
+		s.LogIfError(s.SANAttachDagStep(g), "san attach")
+		attachDeps = append(attachDeps, herd.WithDeps(cnst.OpSANAttach))
+	}
+
+	// Assemble md arrays first, otherwise labels living on md would look
+	// missing and ensure-partitions could try to create them again.
+	s.LogIfError(s.MdadmAssembleDagStep(g, attachDeps...), "mdadm assemble")
+
 	// First-boot partition provisioning. Idempotent: no-op when both
 	// COS_OEM and COS_PERSISTENT already exist. When either is missing this
 	// either creates them (if kairos.ram.create_partitions is set) or
 	// halts the boot with an actionable message. Must run BEFORE every
 	// downstream step that expects those labels to exist (kcrypt, mount-oem,
 	// custom-mounts).
-	s.LogIfError(s.EnsurePartitionsDagStep(g, cnst.OpWaitForSysroot), "ensure partitions")
+	s.LogIfError(s.EnsurePartitionsDagStep(g, cnst.OpWaitForSysroot, cnst.OpMdadmAssemble), "ensure partitions")
+
+	// Factory reset the partitions selected on the cmdline once they exist,
+	// before anything unlocks or mounts them. A failed reset leaves them as
+	// they were, so the boot goes on.
+	var resetDeps []herd.OpOption
+	if internalUtils.ResetRequested() {
+		s.LogIfError(s.FactoryResetDagStep(g, herd.WithDeps(cnst.OpEnsurePartitions)), "factory reset")
+		resetDeps = append(resetDeps, herd.WithWeakDeps(cnst.OpFactoryReset))
+	}
 
 	// Upgrade kcrypt partitions to kcrypt 0.6.0 if any. Runs after we know
 	// the partitions actually exist.
-	s.LogIfError(s.RunKcryptUpgrade(g, herd.WithDeps(cnst.OpEnsurePartitions)), "upgrade kcrypt partitions")
+	s.LogIfError(s.RunKcryptUpgrade(g, append(resetDeps, herd.WithDeps(cnst.OpEnsurePartitions))...), "upgrade kcrypt partitions")
 
 	var kcryptDeps, oemMountDeps herd.OpOption
-	isOemEncrypted := oemEncrypted()
+	isOemEncrypted := OEMEncrypted()
 	internalUtils.KLog.Logger.Info().Bool("oem_encrypted", isOemEncrypted).Msg("Checking OEM encryption status")
 	if isOemEncrypted {
 		internalUtils.KLog.Logger.Info().Msg("OEM is encrypted: kcrypt unlock will run before OEM mount")
@@ -57,8 +78,10 @@ func RegisterInRAMBoot(s *state.State, g *herd.Graph) error {
 		oemMountDeps = herd.WithDeps(cnst.OpEnsurePartitions)
 	}
 
-	s.LogIfError(s.RunKcrypt(g, kcryptDeps), "kcrypt unlock")
-	s.LogIfError(s.MountOemDagStep(g, oemMountDeps), "oem mount")
+	// Run yip stage immucore.pre-unlock once everything unlocking needs is there
+	s.LogIfError(s.StageDagStep(g, cnst.OpPreUnlockHook, cnst.StagePreUnlock, kcryptDeps), "running pre-unlock stage")
+	s.LogIfError(s.RunKcrypt(g, kcryptDeps, herd.WithDeps(cnst.OpPreUnlockHook)), "kcrypt unlock")
+	s.LogIfError(s.MountOemDagStep(g, append(resetDeps, oemMountDeps)...), "oem mount")
 
 	// Run yip stage rootfs. Requires sysroot+oem+sentinel to be ready.
 	s.LogIfError(s.RootfsStageDagStep(g, herd.WithDeps(cnst.OpWaitForSysroot, cnst.OpMountOEM, cnst.OpSentinel)), "running rootfs stage")
@@ -81,10 +104,18 @@ func RegisterInRAMBoot(s *state.State, g *herd.Graph) error {
 
 	s.LogIfError(s.EnableSysAndConfExtensions(g, herd.WithWeakDeps(cnst.OpMountBind)), "enable sysext and confexts")
 
+	// Run yip stages immucore.post-mount once everything is mounted, even if some mounts failed, then immucore.pre-fstab
+	s.LogIfError(s.StageDagStep(g, cnst.OpPostMountHook, cnst.StagePostMount,
+		herd.WithDeps(cnst.OpWaitForSysroot, cnst.OpLoadConfig),
+		herd.WithWeakDeps(cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpCustomMounts, cnst.OpMountBind, cnst.OpOverlayMount)), "running post-mount stage")
+	s.LogIfError(s.StageDagStep(g, cnst.OpPreFstabHook, cnst.StagePreFstab,
+		herd.WithDeps(cnst.OpWaitForSysroot, cnst.OpLoadConfig),
+		herd.WithWeakDeps(cnst.OpPostMountHook)), "running pre-fstab stage")
+
 	// Write fstab. Same deps as normal boot minus the mount-root chain.
 	s.LogIfError(s.WriteFstabDagStep(g,
 		herd.WithDeps(cnst.OpWaitForSysroot, cnst.OpLoadConfig),
-		herd.WithWeakDeps(cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpCustomMounts, cnst.OpMountBind, cnst.OpOverlayMount)), "write fstab")
+		herd.WithWeakDeps(cnst.OpMountTmpfs, cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpCustomMounts, cnst.OpMountBind, cnst.OpOverlayMount, cnst.OpPreFstabHook)), "write fstab")
 
 	s.LogIfError(s.InitramfsStageDagStep(g,
 		herd.WithDeps(cnst.OpWaitForSysroot, cnst.OpLoadConfig, cnst.OpWriteFstab),
@@ -13,6 +13,10 @@ import (
 	"github.com/spectrocloud-labs/herd"
 )
 
+// OEMEncrypted reports whether the OEM partition is encrypted, which makes kcrypt unlock run before the OEM mount.
+// It probes the disks, immucore dag replaces it to render either branch without them.
+var OEMEncrypted = oemEncrypted
+
 // oemEncrypted checks if the OEM partition is encrypted (LUKS).
 // It uses kairos-sdk's lightweight ghw to find the partition and blkid to check if it's LUKS encrypted.
 func oemEncrypted() bool {
@@ -79,7 +83,16 @@ func oemEncrypted() bool {
 func RegisterNormalBoot(s *state.State, g *herd.Graph) error {
 	var err error
 
-	s.LogIfError(s.LVMActivation(g), "lvm activation")
+	// SAN volumes (iSCSI, NVMe-oF) may carry any of the COS_* labels, so attach them before anything looks for one
+	var attachDeps []herd.OpOption
+	if internalUtils.SANAttachRequested() {
+		s.LogIfError(s.SANAttachDagStep(g), "san attach")
+		attachDeps = append(attachDeps, herd.WithDeps(cnst.OpSANAttach))
+	}
+
+	// Assemble md arrays before LVM, as both kcrypt and OEM wait for LVM they also wait for the arrays
+	s.LogIfError(s.MdadmAssembleDagStep(g, attachDeps...), "mdadm assemble")
+	s.LogIfError(s.LVMActivation(g, herd.WithDeps(cnst.OpMdadmAssemble)), "lvm activation")
 
 	// Maybe LogIfErrorAndPanic ? If no sentinel, a lot of config files are not going to run
 	if err = s.LogIfErrorAndReturn(s.WriteSentinelDagStep(g), "write sentinel"); err != nil {
@@ -88,15 +101,24 @@ func RegisterNormalBoot(s *state.State, g *herd.Graph) error {
 
 	s.LogIfError(s.MountTmpfsDagStep(g), "tmpfs mount")
 
-	// Mount Root (COS_STATE or COS_RECOVERY and then the image active/passive/recovery under s.Rootdir)
-	s.LogIfError(s.MountRootDagStep(g), "running mount root stage")
+	// Mount Root under s.Rootdir. The default provider mounts COS_STATE or COS_RECOVERY and then the image
+	// active/passive/recovery, other providers only guarantee that they end in cnst.OpMountRoot
+	s.LogIfError(s.MountRootDagStep(g, herd.WithDeps(cnst.OpMdadmAssemble)), "running mount root stage")
+
+	// Factory reset the partitions selected on the cmdline before anything unlocks or mounts them. A failed reset
+	// leaves them as they were, so the boot goes on
+	var resetDeps []herd.OpOption
+	if internalUtils.ResetRequested() {
+		s.LogIfError(s.FactoryResetDagStep(g, herd.WithDeps(cnst.OpLvmActivate)), "factory reset")
+		resetDeps = append(resetDeps, herd.WithWeakDeps(cnst.OpFactoryReset))
+	}
 
 	// Upgrade kcrypt partitions to kcrypt 0.6.0 if any
 	// Depend on LVM in case the LVM is encrypted somehow? Not sure if possible.
-	s.LogIfError(s.RunKcryptUpgrade(g, herd.WithDeps(cnst.OpLvmActivate)), "upgrade kcrypt partitions")
+	s.LogIfError(s.RunKcryptUpgrade(g, append(resetDeps, herd.WithDeps(cnst.OpLvmActivate))...), "upgrade kcrypt partitions")
 
 	var kcryptDeps, oemMountDeps herd.OpOption
-	isOemEncrypted := oemEncrypted()
+	isOemEncrypted := OEMEncrypted()
 	internalUtils.KLog.Logger.Info().Bool("oem_encrypted", isOemEncrypted).Msg("Checking OEM encryption status")
 	if isOemEncrypted {
 		// We need to run partition unlocking before we mount OEM
@@ -111,8 +133,10 @@ func RegisterNormalBoot(s *state.State, g *herd.Graph) error {
 		oemMountDeps = herd.WithDeps(cnst.OpMountRoot, cnst.OpLvmActivate)
 	}
 
-	s.LogIfError(s.RunKcrypt(g, kcryptDeps), "kcrypt unlock")
-	s.LogIfError(s.MountOemDagStep(g, oemMountDeps), "oem mount")
+	// Run yip stage immucore.pre-unlock once everything unlocking needs is there
+	s.LogIfError(s.StageDagStep(g, cnst.OpPreUnlockHook, cnst.StagePreUnlock, kcryptDeps), "running pre-unlock stage")
+	s.LogIfError(s.RunKcrypt(g, kcryptDeps, herd.WithDeps(cnst.OpPreUnlockHook)), "kcrypt unlock")
+	s.LogIfError(s.MountOemDagStep(g, append(resetDeps, oemMountDeps)...), "oem mount")
 
 	// Run yip stage rootfs. Requires root+oem+sentinel to be mounted
 	s.LogIfError(s.RootfsStageDagStep(g, herd.WithDeps(cnst.OpMountRoot, cnst.OpMountOEM, cnst.OpSentinel)), "running rootfs stage")
@@ -129,22 +153,37 @@ func RegisterNormalBoot(s *state.State, g *herd.Graph) error {
 
 	s.LogIfError(s.MountCustomMountsDagStep(g), "custom mounts mount")
 
+	// Diskless nodes can keep the persistent state on a per-host nfs export instead of COS_PERSISTENT
+	var bindOpts []herd.OpOption
+	if internalUtils.GetNFSStateSpec() != "" {
+		s.LogIfError(s.MountNFSStateDagStep(g), "nfs state mount")
+		bindOpts = append(bindOpts, herd.WithDeps(cnst.OpMountNFSState))
+	}
+
 	// Mount custom binds loaded from the /run/cos/cos-layout.env file
 	// Depends on mount binds as that usually mounts COS_PERSISTENT
-	s.LogIfError(s.MountCustomBindsDagStep(g), "custom binds mount")
+	s.LogIfError(s.MountCustomBindsDagStep(g, bindOpts...), "custom binds mount")
 
 	//
 	s.LogIfError(s.EnableSysAndConfExtensions(g, herd.WithWeakDeps(cnst.OpMountBind)), "enable sysext and confexts")
 
+	// Run yip stages immucore.post-mount once everything is mounted, even if some mounts failed, then immucore.pre-fstab
+	s.LogIfError(s.StageDagStep(g, cnst.OpPostMountHook, cnst.StagePostMount,
+		herd.WithDeps(cnst.OpMountRoot, cnst.OpLoadConfig),
+		herd.WithWeakDeps(cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpCustomMounts, cnst.OpMountBind, cnst.OpOverlayMount)), "running post-mount stage")
+	s.LogIfError(s.StageDagStep(g, cnst.OpPreFstabHook, cnst.StagePreFstab,
+		herd.WithDeps(cnst.OpMountRoot, cnst.OpLoadConfig),
+		herd.WithWeakDeps(cnst.OpPostMountHook)), "running pre-fstab stage")
+
 	// Write fstab file
 	s.LogIfError(s.WriteFstabDagStep(g,
-		herd.WithDeps(cnst.OpMountRoot, cnst.OpDiscoverState, cnst.OpLoadConfig),
-		herd.WithWeakDeps(cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpCustomMounts, cnst.OpMountBind, cnst.OpOverlayMount)), "write fstab")
+		herd.WithDeps(cnst.OpMountRoot, cnst.OpLoadConfig),
+		herd.WithWeakDeps(cnst.OpMountTmpfs, cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpCustomMounts, cnst.OpMountBind, cnst.OpOverlayMount, cnst.OpPreFstabHook)), "write fstab")
 
 	// do it after fstab is created
 	s.LogIfError(s.InitramfsStageDagStep(g,
-		herd.WithDeps(cnst.OpMountRoot, cnst.OpDiscoverState, cnst.OpLoadConfig, cnst.OpWriteFstab),
-		herd.WithWeakDeps(cnst.OpMountBaseOverlay, cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpMountBind, cnst.OpMountBind, cnst.OpCustomMounts, cnst.OpOverlayMount),
+		herd.WithDeps(cnst.OpMountRoot, cnst.OpLoadConfig, cnst.OpWriteFstab),
+		herd.WithWeakDeps(cnst.OpMountBaseOverlay, cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpMountBind, cnst.OpCustomMounts, cnst.OpOverlayMount),
 	), "initramfs stage")
 	return err
 }
@@ -58,7 +58,9 @@ func RegisterUKI(s *state.State, g *herd.Graph) error {
 	// TODO: Make it depend on network setup for remote KMS access, as soon as we
 	// fix the OpUkiNetwork step.
 	//s.LogIfError(s.UKIUnlock(g, herd.WithDeps(cnst.OpSentinel, cnst.OpUkiUdev, cnst.OpUkiNetwork)), "uki unlock")
-	s.LogIfError(s.UKIUnlock(g, herd.WithDeps(ukiUnlockDeps...)), "uki unlock")
+	// Run yip stage immucore.pre-unlock once everything unlocking needs is there
+	s.LogIfError(s.StageDagStep(g, cnst.OpPreUnlockHook, cnst.StagePreUnlock, herd.WithDeps(ukiUnlockDeps...)), "pre-unlock stage")
+	s.LogIfError(s.UKIUnlock(g, herd.WithDeps(append(ukiUnlockDeps, cnst.OpPreUnlockHook)...)), "uki unlock")
 
 	s.LogIfError(s.MountOemDagStep(g, herd.WithDeps(cnst.OpUkiKcrypt), herd.WeakDeps), "oem mount")
 
@@ -91,8 +93,14 @@ func RegisterUKI(s *state.State, g *herd.Graph) error {
 	// run initramfs stage
 	s.LogIfError(s.InitramfsStageDagStep(g, herd.WeakDeps, herd.WithDeps(cnst.OpMountBind, cnst.OpUkiCopySysExtensions)), "uki initramfs")
 
+	// Run yip stages immucore.post-mount once everything is mounted, even if some mounts failed, then immucore.pre-fstab
+	s.LogIfError(s.StageDagStep(g, cnst.OpPostMountHook, cnst.StagePostMount,
+		herd.WithWeakDeps(cnst.OpLoadConfig, cnst.OpMountOEM, cnst.OpCustomMounts, cnst.OpMountBind, cnst.OpOverlayMount, cnst.OpUkiMountESP)), "post-mount stage")
+	s.LogIfError(s.StageDagStep(g, cnst.OpPreFstabHook, cnst.StagePreFstab, herd.WithWeakDeps(cnst.OpPostMountHook)), "pre-fstab stage")
+
 	s.LogIfError(s.WriteFstabDagStep(g,
 		herd.WithDeps(cnst.OpLoadConfig, cnst.OpCustomMounts, cnst.OpMountBind, cnst.OpOverlayMount),
+		herd.WithWeakDeps(cnst.OpUkiMountESP, cnst.OpPreFstabHook),
 	), "fstab")
 
 	// Handover to /sbin/init
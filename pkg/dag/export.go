@@ -0,0 +1,220 @@
+package dag
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	"github.com/kairos-io/immucore/pkg/state"
+	"github.com/spectrocloud-labs/herd"
+)
+
+// Boot modes a graph can be built for with Register.
+const (
+	ModeNormal = "normal"
+	ModeUKI    = "uki"
+	ModeInRAM  = "inram"
+	ModeLive   = "live"
+	// ModeNFS is the normal graph for an nfs root, which has netboot on the cmdline but is not live media.
+	ModeNFS = cnst.RootProviderNFS
+)
+
+// PluginStepsDir is where Register looks for the plugin steps, see state.LoadPluginSteps.
+var PluginStepsDir = cnst.PluginStepsDir
+
+// Formats Export renders a graph in.
+const (
+	FormatDOT     = "dot"
+	FormatJSON    = "json"
+	FormatMermaid = "mermaid"
+)
+
+// Status of an op after a run, from its outcome.
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// statusColours are the fill colours of the ops per status, the ones without a status are left white.
+var statusColours = map[string]string{
+	StatusOK:      "#b7e1a1",
+	StatusFailed:  "#f4a6a6",
+	StatusSkipped: "#dddddd",
+}
+
+// Register registers the dag of the given boot mode, the same one immucore runs when booting in that mode, with the
+// plugin steps for the mode. The plugin steps that cannot be added are logged and left out.
+func Register(mode string, s *state.State, g *herd.Graph) error {
+	var err error
+	switch mode {
+	case ModeNormal, ModeNFS:
+		err = RegisterNormalBoot(s, g)
+	case ModeUKI:
+		err = RegisterUKI(s, g)
+	case ModeInRAM:
+		err = RegisterInRAMBoot(s, g)
+	case ModeLive:
+		err = RegisterLiveMedia(s, g)
+	default:
+		return fmt.Errorf("unknown mode %q, expected one of %s", mode, strings.Join([]string{ModeNormal, ModeUKI, ModeInRAM, ModeLive, ModeNFS}, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	steps, err := state.LoadPluginSteps(PluginStepsDir)
+	s.LogIfError(err, "loading plugin steps")
+	s.LogIfError(s.AddPluginSteps(g, mode, steps), "adding plugin steps")
+	return nil
+}
+
+// Node is an op of the graph as exported.
+type Node struct {
+	Name  string `json:"name"`
+	Layer int    `json:"layer"`
+	// Deps are the ops that have to succeed before this one runs.
+	Deps []string `json:"deps,omitempty"`
+	// WeakDeps are the ops that run before this one, which runs even if they fail.
+	WeakDeps   []string `json:"weak_deps,omitempty"`
+	Background bool     `json:"background,omitempty"`
+	Status     string   `json:"status,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Nodes returns the ops of g in execution order, by name within a layer so the same graph always exports the same,
+// with their status from outcomes when given.
+func Nodes(g *herd.Graph, outcomes []state.OpOutcome) []Node {
+	byName := map[string]state.OpOutcome{}
+	for _, o := range outcomes {
+		byName[o.Name] = o
+	}
+	var nodes []Node
+	for i, layer := range g.Analyze() {
+		layer = slices.Clone(layer)
+		slices.SortFunc(layer, func(a, b herd.GraphEntry) int { return strings.Compare(a.Name, b.Name) })
+		for _, op := range layer {
+			// Skips init, which only anchors the ops without dependencies.
+			if !op.WithCallback {
+				continue
+			}
+			n := Node{Name: op.Name, Layer: i + 1, Background: op.Background}
+			for _, d := range op.Dependencies {
+				if op.WeakDeps || slices.Contains(op.WeakDependencies, d) {
+					if !slices.Contains(n.WeakDeps, d) {
+						n.WeakDeps = append(n.WeakDeps, d)
+					}
+				} else if !slices.Contains(n.Deps, d) {
+					n.Deps = append(n.Deps, d)
+				}
+			}
+			if o, ok := byName[op.Name]; ok {
+				n.Error = o.Error
+				switch {
+				case o.Error != "":
+					n.Status = StatusFailed
+				case o.Executed:
+					n.Status = StatusOK
+				default:
+					n.Status = StatusSkipped
+				}
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// Export renders g in format, with strong dependencies as solid edges and weak ones as dashed edges, and the ops
+// coloured by their status from outcomes when given.
+func Export(g *herd.Graph, format string, outcomes []state.OpOutcome) (string, error) {
+	nodes := Nodes(g, outcomes)
+	switch format {
+	case FormatDOT:
+		return exportDOT(nodes), nil
+	case FormatJSON:
+		data, err := json.MarshalIndent(struct {
+			Ops []Node `json:"ops"`
+		}{nodes}, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	case FormatMermaid:
+		return exportMermaid(nodes), nil
+	default:
+		return "", fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join([]string{FormatDOT, FormatJSON, FormatMermaid}, ", "))
+	}
+}
+
+func exportDOT(nodes []Node) string {
+	var b strings.Builder
+	b.WriteString("digraph immucore {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=\"rounded,filled\", fillcolor=\"#ffffff\"];\n")
+	for _, n := range nodes {
+		var attrs []string
+		if c, ok := statusColours[n.Status]; ok {
+			attrs = append(attrs, fmt.Sprintf("fillcolor=%q", c))
+		}
+		if n.Background {
+			attrs = append(attrs, "peripheries=2")
+		}
+		if n.Error != "" {
+			attrs = append(attrs, fmt.Sprintf("tooltip=%q", n.Error))
+		}
+		if len(attrs) == 0 {
+			fmt.Fprintf(&b, "  %q;\n", n.Name)
+		} else {
+			fmt.Fprintf(&b, "  %q [%s];\n", n.Name, strings.Join(attrs, ", "))
+		}
+	}
+	for _, n := range nodes {
+		for _, d := range n.Deps {
+			fmt.Fprintf(&b, "  %q -> %q;\n", d, n.Name)
+		}
+		for _, d := range n.WeakDeps {
+			fmt.Fprintf(&b, "  %q -> %q [style=dashed];\n", d, n.Name)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func exportMermaid(nodes []Node) string {
+	// Op names have dashes, which mermaid ids cannot have, so the ids are their position.
+	ids := map[string]string{}
+	for i, n := range nodes {
+		ids[n.Name] = fmt.Sprintf("n%d", i)
+	}
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	byStatus := map[string][]string{}
+	for _, n := range nodes {
+		if n.Background {
+			fmt.Fprintf(&b, "  %s([\"%s\"])\n", ids[n.Name], n.Name)
+		} else {
+			fmt.Fprintf(&b, "  %s[\"%s\"]\n", ids[n.Name], n.Name)
+		}
+		if n.Status != "" {
+			byStatus[n.Status] = append(byStatus[n.Status], ids[n.Name])
+		}
+	}
+	for _, n := range nodes {
+		for _, d := range n.Deps {
+			fmt.Fprintf(&b, "  %s --> %s\n", ids[d], ids[n.Name])
+		}
+		for _, d := range n.WeakDeps {
+			fmt.Fprintf(&b, "  %s -.-> %s\n", ids[d], ids[n.Name])
+		}
+	}
+	for _, status := range []string{StatusOK, StatusFailed, StatusSkipped} {
+		if len(byStatus[status]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "  classDef %s fill:%s\n", status, statusColours[status])
+		fmt.Fprintf(&b, "  class %s %s\n", strings.Join(byStatus[status], ","), status)
+	}
+	return b.String()
+}
@@ -0,0 +1,166 @@
+package dag_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	"github.com/kairos-io/immucore/pkg/dag"
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud-labs/herd"
+)
+
+var _ = Describe("Export", func() {
+	var g *herd.Graph
+	noop := herd.WithCallback(func(_ context.Context) error { return nil })
+
+	BeforeEach(func() {
+		g = herd.DAG(herd.EnableInit)
+		Expect(g.Add("root", noop)).To(Succeed())
+		Expect(g.Add("oem", noop, herd.WithDeps("root"))).To(Succeed())
+		Expect(g.Add("fstab", noop, herd.WithDeps("root"), herd.WithWeakDeps("oem", "oem"))).To(Succeed())
+		Expect(g.Add("hook", noop, herd.WeakDeps, herd.Background, herd.WithDeps("oem"))).To(Succeed())
+	})
+
+	It("tells strong and weak dependencies apart", func() {
+		nodes := dag.Nodes(g, nil)
+		Expect(nodes).To(HaveLen(4))
+		Expect(nodes[0]).To(Equal(dag.Node{Name: "root", Layer: 2}))
+		byName := map[string]dag.Node{}
+		for _, n := range nodes {
+			byName[n.Name] = n
+		}
+		Expect(byName["oem"].Deps).To(Equal([]string{"root"}))
+		Expect(byName["fstab"].Deps).To(Equal([]string{"root"}))
+		Expect(byName["fstab"].WeakDeps).To(Equal([]string{"oem"}))
+		Expect(byName["hook"].Deps).To(BeEmpty())
+		Expect(byName["hook"].WeakDeps).To(Equal([]string{"oem"}))
+		Expect(byName["hook"].Background).To(BeTrue())
+	})
+
+	It("renders dot with dashed weak edges", func() {
+		out, err := dag.Export(g, dag.FormatDOT, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(HavePrefix("digraph immucore {\n"))
+		Expect(out).To(ContainSubstring(`"root" -> "oem";`))
+		Expect(out).To(ContainSubstring(`"oem" -> "fstab" [style=dashed];`))
+		Expect(out).To(ContainSubstring(`"hook" [peripheries=2];`))
+		Expect(out).ToNot(ContainSubstring("init"))
+		Expect(out).ToNot(ContainSubstring("fillcolor=\"#b7e1a1\""))
+	})
+
+	It("renders mermaid with dotted weak edges", func() {
+		out, err := dag.Export(g, dag.FormatMermaid, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(HavePrefix("flowchart LR\n"))
+		Expect(out).To(ContainSubstring(`n0["root"]`))
+		Expect(out).To(ContainSubstring(`n3(["hook"])`))
+		Expect(out).To(ContainSubstring("n0 --> n1"))
+		Expect(out).To(ContainSubstring("n1 -.-> n2"))
+	})
+
+	It("colours the ops with their outcome", func() {
+		outcomes := []state.OpOutcome{
+			{Name: "root", Executed: true, Runs: 1},
+			{Name: "oem", Executed: true, Error: "no oem", Runs: 1},
+			{Name: "fstab"},
+		}
+		out, err := dag.Export(g, dag.FormatDOT, outcomes)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(ContainSubstring(`"root" [fillcolor="#b7e1a1"];`))
+		Expect(out).To(ContainSubstring(`"oem" [fillcolor="#f4a6a6", tooltip="no oem"];`))
+		Expect(out).To(ContainSubstring(`"fstab" [fillcolor="#dddddd"];`))
+		Expect(out).To(ContainSubstring(`"hook" [peripheries=2];`))
+
+		out, err = dag.Export(g, dag.FormatMermaid, outcomes)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(ContainSubstring("class n0 ok"))
+		Expect(out).To(ContainSubstring("class n1 failed"))
+
+		out, err = dag.Export(g, dag.FormatJSON, outcomes)
+		Expect(err).ToNot(HaveOccurred())
+		var exported struct {
+			Ops []dag.Node `json:"ops"`
+		}
+		Expect(json.Unmarshal([]byte(out), &exported)).To(Succeed())
+		Expect(exported.Ops[1].Status).To(Equal(dag.StatusFailed))
+		Expect(exported.Ops[1].Error).To(Equal("no oem"))
+	})
+
+	It("rejects unknown formats", func() {
+		_, err := dag.Export(g, "png", nil)
+		Expect(err).To(MatchError(ContainSubstring(`unknown format "png"`)))
+	})
+})
+
+var _ = Describe("Register", func() {
+	BeforeEach(func() {
+		cmdline := filepath.Join(GinkgoT().TempDir(), "cmdline")
+		Expect(os.WriteFile(cmdline, []byte("cos-img/filename=/cOS/active.img"), 0644)).To(Succeed())
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", cmdline)
+		DeferCleanup(func(orig func() bool) { dag.OEMEncrypted = orig }, dag.OEMEncrypted)
+		DeferCleanup(func(orig string) { dag.PluginStepsDir = orig }, dag.PluginStepsDir)
+		dag.PluginStepsDir = GinkgoT().TempDir()
+	})
+
+	deps := func(g *herd.Graph, op string) []string {
+		for _, n := range dag.Nodes(g, nil) {
+			if n.Name == op {
+				return n.Deps
+			}
+		}
+		Fail("no op " + op)
+		return nil
+	}
+
+	It("unlocks before mounting an encrypted OEM", func() {
+		dag.OEMEncrypted = func() bool { return true }
+		g := herd.DAG(herd.EnableInit)
+		Expect(dag.Register(dag.ModeNormal, &state.State{Rootdir: "/"}, g)).To(Succeed())
+		Expect(deps(g, cnst.OpMountOEM)).To(ContainElement(cnst.OpKcryptUnlock))
+		Expect(deps(g, cnst.OpKcryptUnlock)).ToNot(ContainElement(cnst.OpMountOEM))
+	})
+
+	It("mounts a plain OEM before unlocking", func() {
+		dag.OEMEncrypted = func() bool { return false }
+		g := herd.DAG(herd.EnableInit)
+		Expect(dag.Register(dag.ModeNormal, &state.State{Rootdir: "/"}, g)).To(Succeed())
+		Expect(deps(g, cnst.OpKcryptUnlock)).To(ContainElement(cnst.OpMountOEM))
+		Expect(deps(g, cnst.OpMountOEM)).ToNot(ContainElement(cnst.OpKcryptUnlock))
+	})
+
+	It("adds the plugin steps of the mode", func() {
+		Expect(os.WriteFile(filepath.Join(dag.PluginStepsDir, "dongle.yaml"), []byte(`
+steps:
+- name: mount-dongle
+  command: mount LABEL=DONGLE /sysroot/opt/dongle
+  modes: [normal]
+  deps: [mount-root]
+- name: check-dongle
+  command: "true"
+  modes: [normal]
+  deps: [mount-dongle]
+  before: [mount-oem]
+- name: uki-dongle
+  command: "true"
+  modes: [uki]
+`), 0644)).To(Succeed())
+		dag.OEMEncrypted = func() bool { return false }
+		g := herd.DAG(herd.EnableInit)
+		Expect(dag.Register(dag.ModeNormal, &state.State{Rootdir: "/"}, g)).To(Succeed())
+		Expect(deps(g, "mount-dongle")).To(Equal([]string{cnst.OpMountRoot}))
+		Expect(g.DependsOn(cnst.OpMountOEM, "check-dongle")).To(BeTrue())
+		Expect(dag.Validate(g, false)).To(Succeed())
+		for _, n := range dag.Nodes(g, nil) {
+			Expect(n.Name).ToNot(Equal("uki-dongle"))
+		}
+	})
+
+	It("rejects unknown modes", func() {
+		Expect(dag.Register("cdrom", &state.State{}, herd.DAG())).To(MatchError(ContainSubstring(`unknown mode "cdrom"`)))
+	})
+})
@@ -0,0 +1,156 @@
+package dag
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	"github.com/spectrocloud-labs/herd"
+)
+
+// rootdirReady are the ops after which State.Rootdir is there to mount into: the root mounted by immucore, the
+// sysroot mounted by dracut, or the UKI moved into the sysroot.
+var rootdirReady = []string{cnst.OpMountRoot, cnst.OpWaitForSysroot, cnst.OpUkiPivotToSysroot}
+
+// rootdirMounts are the ops mounting something under State.Rootdir.
+var rootdirMounts = []string{
+	cnst.OpMountOEM,
+	cnst.OpCustomMounts,
+	cnst.OpOverlayMount,
+	cnst.OpMountBind,
+	cnst.OpMountNFSState,
+	cnst.OpUkiMountESP,
+}
+
+// fstabMounts are the ops adding entries to the fstab written by OpWriteFstab.
+var fstabMounts = []string{
+	cnst.OpMountTmpfs,
+	cnst.OpMountState,
+	cnst.OpMountRoot,
+	cnst.OpMountNFSState,
+	cnst.OpMountOEM,
+	cnst.OpMountBaseOverlay,
+	cnst.OpCustomMounts,
+	cnst.OpOverlayMount,
+	cnst.OpMountBind,
+	cnst.OpUkiMountESP,
+}
+
+// unlockOps are the ops unlocking the encrypted partitions.
+var unlockOps = []string{cnst.OpKcryptUnlock, cnst.OpUkiKcrypt}
+
+// resetPartitionOps are the ops using the partitions OpFactoryReset reformats.
+var resetPartitionOps = []string{cnst.OpKcryptUpgrade, cnst.OpKcryptUnlock, cnst.OpMountOEM, cnst.OpCustomMounts}
+
+// Validate checks the ordering of a registered graph without running it: every dependency is an op of the graph and
+// is only given once, the mounts into the Rootdir happen once it is there, the OEM partition is mounted after the
+// unlock when oemEncrypted, the factory reset runs before the partitions are used, and the fstab is written after
+// every mount that adds to it. Ordering counts weak dependencies, they only let an op run after a failure. It returns
+// every broken rule.
+func Validate(g *herd.Graph, oemEncrypted bool) error {
+	var errs []error
+	var ops []string
+	for _, layer := range g.TopoSortedLayers() {
+		for _, name := range layer {
+			if isOp(g, name) {
+				ops = append(ops, name)
+			} else {
+				errs = append(errs, fmt.Errorf("%s is a dependency of %v but not an op", name, dependents(g, name)))
+			}
+		}
+	}
+	// Analyze and State do not work on graphs with dangling dependencies.
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, name := range ops {
+		op := g.State(name)
+		if d := duplicates(op.Dependencies); len(d) > 0 {
+			errs = append(errs, fmt.Errorf("%s depends on %v more than once", name, d))
+		}
+		if d := duplicates(op.WeakDependencies); len(d) > 0 {
+			errs = append(errs, fmt.Errorf("%s weakly depends on %v more than once", name, d))
+		}
+	}
+
+	ready := present(ops, rootdirReady)
+	for _, name := range present(ops, rootdirMounts) {
+		if !slices.ContainsFunc(ready, func(r string) bool { return g.DependsOn(name, r) }) {
+			errs = append(errs, fmt.Errorf("%s mounts into the rootdir but does not run after any of %v", name, rootdirReady))
+		}
+	}
+
+	if oemEncrypted && slices.Contains(ops, cnst.OpMountOEM) {
+		unlock := present(ops, unlockOps)
+		if !slices.ContainsFunc(unlock, func(u string) bool { return g.DependsOn(cnst.OpMountOEM, u) }) {
+			errs = append(errs, fmt.Errorf("%s runs before the encrypted partitions are unlocked by any of %v", cnst.OpMountOEM, unlockOps))
+		}
+	}
+
+	if slices.Contains(ops, cnst.OpFactoryReset) {
+		for _, name := range present(ops, resetPartitionOps) {
+			if !g.DependsOn(name, cnst.OpFactoryReset) {
+				errs = append(errs, fmt.Errorf("%s may use the partitions before %s reformats them", name, cnst.OpFactoryReset))
+			}
+		}
+	}
+
+	if slices.Contains(ops, cnst.OpWriteFstab) {
+		for _, name := range present(ops, fstabMounts) {
+			if !g.DependsOn(cnst.OpWriteFstab, name) {
+				errs = append(errs, fmt.Errorf("%s may run before %s, whose mounts would be missing from the fstab", cnst.OpWriteFstab, name))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isOp returns whether name was added to g. herd has no lookup for it and panics on the names only used as a
+// dependency.
+func isOp(g *herd.Graph, name string) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	g.State(name)
+	return true
+}
+
+// dependents returns the ops depending on name directly, sorted.
+func dependents(g *herd.Graph, name string) []string {
+	var out []string
+	for d := range g.Dependents(name) {
+		if isOp(g, d) && slices.Contains(g.State(d).Dependencies, name) {
+			out = append(out, d)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// present returns the names in want that are ops of the graph.
+func present(ops, want []string) []string {
+	var out []string
+	for _, w := range want {
+		if slices.Contains(ops, w) {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// duplicates returns the names given more than once in names.
+func duplicates(names []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, n := range names {
+		if seen[n] && !slices.Contains(out, n) {
+			out = append(out, n)
+		}
+		seen[n] = true
+	}
+	return out
+}
@@ -0,0 +1,172 @@
+package dag_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	"github.com/kairos-io/immucore/pkg/dag"
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud-labs/herd"
+)
+
+var _ = Describe("Validate", func() {
+	Context("the registered graphs", func() {
+		BeforeEach(func() {
+			DeferCleanup(func(orig func() bool) { dag.OEMEncrypted = orig }, dag.OEMEncrypted)
+			DeferCleanup(func(orig string) { dag.PluginStepsDir = orig }, dag.PluginStepsDir)
+			dag.PluginStepsDir = GinkgoT().TempDir()
+		})
+
+		DescribeTable("keep their ordering invariants",
+			func(mode, cmdline string, oemEncrypted bool) {
+				file := filepath.Join(GinkgoT().TempDir(), "cmdline")
+				Expect(os.WriteFile(file, []byte(cmdline), 0644)).To(Succeed())
+				GinkgoT().Setenv("HOST_PROC_CMDLINE", file)
+				dag.OEMEncrypted = func() bool { return oemEncrypted }
+
+				s, err := state.NewState(true)
+				Expect(err).ToNot(HaveOccurred())
+				g := herd.DAG(herd.EnableInit)
+				Expect(dag.Register(mode, s, g)).To(Succeed())
+				Expect(dag.Validate(g, oemEncrypted)).To(Succeed())
+			},
+			Entry("active image", dag.ModeNormal, "cos-img/filename=/cOS/active.img", false),
+			Entry("active image with an encrypted OEM", dag.ModeNormal, "cos-img/filename=/cOS/active.img", true),
+			Entry("recovery", dag.ModeNormal, "cos-img/filename=/cOS/recovery.img root=LABEL=COS_RECOVERY", false),
+			Entry("btrfs subvolume", dag.ModeNormal, "rd.immucore.btrfs rd.immucore.subvol=@active", false),
+			Entry("block root", dag.ModeNormal, "rd.immucore.rootprovider=block root=LABEL=COS_ACTIVE", false),
+			Entry("nfs root", dag.ModeNFS, "root=nfs:10.0.0.1:/exports/kairos netboot", false),
+			Entry("nfs root and state", dag.ModeNFS, "root=nfs:10.0.0.1:/exports/kairos rd.immucore.nfs.state=10.0.0.1:/exports/state", false),
+			Entry("iscsi root", dag.ModeNormal, "root=iscsi:10.0.0.1::3260:1:iqn.2024-01.io.kairos:root cos-img/filename=/cOS/active.img", false),
+			Entry("http root", dag.ModeNormal, "root=https://10.0.0.1/active.img", false),
+			Entry("raid and lvm", dag.ModeNormal, "cos-img/filename=/cOS/active.img rd.md.uuid=0c7b4c2a:1d5e7f3b:9a1b2c3d:4e5f6a7b rd.lvm.lv=vg/root", true),
+			Entry("factory reset", dag.ModeNormal, "cos-img/filename=/cOS/active.img rd.immucore.reset=all rd.immucore.reset.confirm=0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0", false),
+			Entry("factory reset with an encrypted OEM", dag.ModeNormal, "cos-img/filename=/cOS/active.img rd.immucore.reset=persistent", true),
+			Entry("in-RAM", dag.ModeInRAM, "kairos.ram", false),
+			Entry("in-RAM factory reset", dag.ModeInRAM, "kairos.ram rd.immucore.reset=oem", true),
+			Entry("in-RAM with an encrypted OEM", dag.ModeInRAM, "kairos.ram", true),
+			Entry("in-RAM with SAN volumes", dag.ModeInRAM, "kairos.ram netroot=iscsi:10.0.0.1::3260:1:iqn.2024-01.io.kairos:oem rd.nvmf.discover=tcp,10.0.0.2", false),
+			Entry("live media", dag.ModeLive, "root=live:CDLABEL=COS_LIVE rd.immucore.disable", false),
+			Entry("netboot", dag.ModeLive, "netboot", false),
+			Entry("UKI", dag.ModeUKI, "rd.immucore.uki", true),
+			Entry("UKI in-RAM", dag.ModeUKI, "rd.immucore.uki kairos.ram", true),
+		)
+	})
+
+	Context("the immucore stages", func() {
+		BeforeEach(func() {
+			DeferCleanup(func(orig func() bool) { dag.OEMEncrypted = orig }, dag.OEMEncrypted)
+			DeferCleanup(func(orig string) { dag.PluginStepsDir = orig }, dag.PluginStepsDir)
+			dag.PluginStepsDir = GinkgoT().TempDir()
+			dag.OEMEncrypted = func() bool { return false }
+		})
+
+		DescribeTable("run at their point of the graph",
+			func(mode, cmdline, unlock string, afterOEM bool) {
+				file := filepath.Join(GinkgoT().TempDir(), "cmdline")
+				Expect(os.WriteFile(file, []byte(cmdline), 0644)).To(Succeed())
+				GinkgoT().Setenv("HOST_PROC_CMDLINE", file)
+				s, err := state.NewState(true)
+				Expect(err).ToNot(HaveOccurred())
+				g := herd.DAG(herd.EnableInit)
+				Expect(dag.Register(mode, s, g)).To(Succeed())
+
+				Expect(g.DependsOn(unlock, cnst.OpPreUnlockHook)).To(BeTrue())
+				Expect(g.DependsOn(cnst.OpPreUnlockHook, cnst.OpMountOEM)).To(Equal(afterOEM))
+				for _, mount := range []string{cnst.OpCustomMounts, cnst.OpOverlayMount, cnst.OpMountBind} {
+					Expect(g.DependsOn(cnst.OpPostMountHook, mount)).To(BeTrue(), mount)
+				}
+				Expect(g.DependsOn(cnst.OpPreFstabHook, cnst.OpPostMountHook)).To(BeTrue())
+				Expect(g.DependsOn(cnst.OpWriteFstab, cnst.OpPreFstabHook)).To(BeTrue())
+			},
+			Entry("normal boot", dag.ModeNormal, "cos-img/filename=/cOS/active.img", cnst.OpKcryptUnlock, true),
+			Entry("in-RAM", dag.ModeInRAM, "kairos.ram", cnst.OpKcryptUnlock, true),
+			Entry("UKI", dag.ModeUKI, "rd.immucore.uki", cnst.OpUkiKcrypt, false),
+		)
+	})
+
+	Context("the SAN volumes", func() {
+		BeforeEach(func() {
+			DeferCleanup(func(orig func() bool) { dag.OEMEncrypted = orig }, dag.OEMEncrypted)
+			DeferCleanup(func(orig string) { dag.PluginStepsDir = orig }, dag.PluginStepsDir)
+			dag.PluginStepsDir = GinkgoT().TempDir()
+			dag.OEMEncrypted = func() bool { return false }
+		})
+
+		DescribeTable("are attached before the partitions are looked for",
+			func(mode, cmdline string, partitionOps ...string) {
+				file := filepath.Join(GinkgoT().TempDir(), "cmdline")
+				Expect(os.WriteFile(file, []byte(cmdline), 0644)).To(Succeed())
+				GinkgoT().Setenv("HOST_PROC_CMDLINE", file)
+				s, err := state.NewState(true)
+				Expect(err).ToNot(HaveOccurred())
+				g := herd.DAG(herd.EnableInit)
+				Expect(dag.Register(mode, s, g)).To(Succeed())
+
+				for _, o := range partitionOps {
+					Expect(g.DependsOn(o, cnst.OpSANAttach)).To(BeTrue(), o)
+				}
+			},
+			Entry("normal boot", dag.ModeNormal, "cos-img/filename=/cOS/active.img netroot=iscsi:10.0.0.1::3260:1:iqn.2024-01.io.kairos:oem",
+				cnst.OpMdadmAssemble, cnst.OpMountState, cnst.OpMountOEM),
+			Entry("iscsi root", dag.ModeNormal, "root=iscsi:10.0.0.1::3260:1:iqn.2024-01.io.kairos:root cos-img/filename=/cOS/active.img",
+				cnst.OpMdadmAssemble, cnst.OpMountState, cnst.OpMountRoot),
+			Entry("in-RAM", dag.ModeInRAM, "kairos.ram rd.nvmf.discover=tcp,10.0.0.2",
+				cnst.OpMdadmAssemble, cnst.OpEnsurePartitions, cnst.OpMountOEM),
+		)
+	})
+
+	Context("broken graphs", func() {
+		var g *herd.Graph
+		noop := herd.WithCallback(func(_ context.Context) error { return nil })
+
+		BeforeEach(func() {
+			g = herd.DAG(herd.EnableInit)
+			Expect(g.Add("mount-root", noop)).To(Succeed())
+		})
+
+		It("reports dangling dependencies", func() {
+			Expect(g.Add("mount-oem", noop, herd.WithDeps("mount-root", "unlock-everything"))).To(Succeed())
+			Expect(dag.Validate(g, false)).To(MatchError(ContainSubstring("unlock-everything is a dependency of [mount-oem] but not an op")))
+		})
+
+		It("reports dependencies given twice", func() {
+			Expect(g.Add("mount-bind", noop, herd.WithDeps("mount-root"))).To(Succeed())
+			Expect(g.Add("initramfs-hook", noop, herd.WithWeakDeps("mount-bind", "mount-bind"))).To(Succeed())
+			err := dag.Validate(g, false)
+			Expect(err).To(MatchError(ContainSubstring("initramfs-hook weakly depends on [mount-bind] more than once")))
+			Expect(err).To(MatchError(ContainSubstring("initramfs-hook depends on [mount-bind] more than once")))
+		})
+
+		It("reports mounts into the rootdir before it is there", func() {
+			Expect(g.Add("custom-mount", noop)).To(Succeed())
+			Expect(dag.Validate(g, false)).To(MatchError(ContainSubstring("custom-mount mounts into the rootdir")))
+		})
+
+		It("reports an encrypted OEM mounted before the unlock", func() {
+			Expect(g.Add("unlock-all", noop, herd.WithDeps("mount-root"))).To(Succeed())
+			Expect(g.Add("mount-oem", noop, herd.WithDeps("mount-root"))).To(Succeed())
+			Expect(dag.Validate(g, false)).To(Succeed())
+			Expect(dag.Validate(g, true)).To(MatchError(ContainSubstring("mount-oem runs before the encrypted partitions are unlocked")))
+		})
+
+		It("reports partitions used before the factory reset", func() {
+			Expect(g.Add("factory-reset", noop)).To(Succeed())
+			Expect(g.Add("mount-oem", noop, herd.WithDeps("mount-root"), herd.WithWeakDeps("factory-reset"))).To(Succeed())
+			Expect(g.Add("unlock-all", noop, herd.WithDeps("mount-oem"))).To(Succeed())
+			Expect(dag.Validate(g, false)).To(Succeed())
+			Expect(g.Add("custom-mount", noop, herd.WithDeps("mount-root"))).To(Succeed())
+			Expect(dag.Validate(g, false)).To(MatchError(ContainSubstring("custom-mount may use the partitions before factory-reset reformats them")))
+		})
+
+		It("reports mounts that may miss the fstab", func() {
+			Expect(g.Add("mount-oem", noop, herd.WithDeps("mount-root"))).To(Succeed())
+			Expect(g.Add("write-fstab", noop, herd.WithDeps("mount-root"))).To(Succeed())
+			Expect(dag.Validate(g, false)).To(MatchError(ContainSubstring("write-fstab may run before mount-oem")))
+		})
+	})
+})
@@ -67,13 +67,35 @@ func BaseOverlay(overlay schema.Overlay) (MountOperation, error) {
 	}
 }
 
+// BindStateDir returns the dir MountBind keeps the state of mountpoint in.
+func BindStateDir(mountpoint, root, stateTarget string) string {
+	mountpoint = strings.TrimLeft(mountpoint, "/")
+	return filepath.Join(root, stateTarget, fmt.Sprintf("%s.bind", strings.ReplaceAll(mountpoint, "/", "-")))
+}
+
+// ArchiveBindState moves the state MountBind keeps for mountpoint into archive, so the next MountBind seeds it again
+// with the contents of the image. It returns where the state was moved to, empty when there was none.
+func ArchiveBindState(mountpoint, root, stateTarget, archive string) (string, error) {
+	stateDir := BindStateDir(mountpoint, root, stateTarget)
+	if _, err := os.Stat(stateDir); os.IsNotExist(err) {
+		return "", nil
+	}
+	if err := os.MkdirAll(archive, 0700); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(archive, filepath.Base(stateDir))
+	if err := os.Rename(stateDir, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
 // https://github.com/kairos-io/packages/blob/94aa3bef3d1330cb6c6905ae164f5004b6a58b8c/packages/system/dracut/immutable-rootfs/30cos-immutable-rootfs/cos-mount-layout.sh#L183
-func MountBind(mountpoint, root, stateTarget string) MountOperation {
+// The state is seeded with the contents of the image according to sync, see constants.SyncUpdate.
+func MountBind(mountpoint, root, stateTarget string, sync schema.StateSync) MountOperation {
 	mountpoint = strings.TrimLeft(mountpoint, "/") // normalize, remove / upfront as we are going to re-use it in subdirs
 	rootMount := filepath.Join(root, mountpoint)
-	bindMountPath := strings.ReplaceAll(mountpoint, "/", "-")
-
-	stateDir := filepath.Join(root, stateTarget, fmt.Sprintf("%s.bind", bindMountPath))
+	stateDir := BindStateDir(mountpoint, root, stateTarget)
 
 	tmpMount := mount.Mount{
 		Type:   "overlay",
@@ -95,10 +117,32 @@ func MountBind(mountpoint, root, stateTarget string) MountOperation {
 				return err
 			}
 
+			// A path that never syncs still starts from the image the first time, its state is empty otherwise.
+			policy := sync.Policy
+			if _, err := os.Stat(stateDir); os.IsNotExist(err) && policy == constants.SyncNever {
+				policy = constants.SyncNewFilesOnly
+			}
 			if err := internalUtils.CreateIfNotExists(stateDir); err != nil {
 				return err
 			}
-			return internalUtils.SyncState(internalUtils.AppendSlash(rootMount), internalUtils.AppendSlash(stateDir))
+			var imageWins []string
+			if sync.Policy == constants.SyncImageWins && sync.ImageWinsList != "" {
+				data, err := os.ReadFile(filepath.Join(root, sync.ImageWinsList))
+				if err != nil {
+					internalUtils.KLog.Logger.Warn().Err(err).Str("list", sync.ImageWinsList).Msg("Reading the files the image wins for")
+				}
+				for _, l := range strings.Split(string(data), "\n") {
+					if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+						imageWins = append(imageWins, l)
+					}
+				}
+			}
+			copied, err := internalUtils.SyncState(internalUtils.AppendSlash(rootMount), internalUtils.AppendSlash(stateDir), policy, imageWins)
+			if len(copied) > 0 {
+				internalUtils.KLog.Logger.Info().Str("path", "/"+mountpoint).Str("policy", policy).Int("files", len(copied)).Msg("Copied files from the image into the persistent state")
+				internalUtils.KLog.Logger.Debug().Str("path", "/"+mountpoint).Strs("files", copied).Msg("Files copied from the image into the persistent state")
+			}
+			return err
 		},
 	}
 }
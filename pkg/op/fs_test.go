@@ -3,10 +3,12 @@ package op_test
 import (
 	"errors"
 	"os"
+	"os/exec"
 	"path/filepath"
 
 	"github.com/kairos-io/immucore/internal/constants"
 	"github.com/kairos-io/immucore/pkg/op"
+	"github.com/kairos-io/immucore/pkg/schema"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -43,3 +45,61 @@ var _ = Describe("MountWithBaseOverlay", func() {
 		Expect(err.Error()).To(ContainSubstring(filepath.Join(readOnly, "mnt")))
 	})
 })
+
+var _ = Describe("MountBind", func() {
+	var root string
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+		Expect(os.MkdirAll(filepath.Join(root, "var/lib/rancher"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(root, "var/lib/rancher", "config"), []byte("image"), 0644)).To(Succeed())
+	})
+
+	It("leaves the existing state of a never-sync path alone", func() {
+		stateDir := op.BindStateDir("/var/lib/rancher", root, "/usr/local/.state")
+		Expect(os.MkdirAll(stateDir, 0755)).To(Succeed())
+		operation := op.MountBind("/var/lib/rancher", root, "/usr/local/.state", schema.StateSync{Policy: constants.SyncNever})
+		Expect(operation.PrepareCallback()).To(Succeed())
+		Expect(filepath.Join(stateDir, "config")).ToNot(BeAnExistingFile())
+	})
+
+	It("seeds a never-sync path from the image when its state is created", func() {
+		if _, err := exec.LookPath("rsync"); err != nil {
+			Skip("needs rsync")
+		}
+		operation := op.MountBind("/var/lib/rancher", root, "/usr/local/.state", schema.StateSync{Policy: constants.SyncNever})
+		Expect(operation.PrepareCallback()).To(Succeed())
+		data, err := os.ReadFile(filepath.Join(op.BindStateDir("/var/lib/rancher", root, "/usr/local/.state"), "config"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("image"))
+	})
+})
+
+var _ = Describe("ArchiveBindState", func() {
+	var root string
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+	})
+
+	It("moves the state of the bind mount into the archive", func() {
+		stateDir := op.BindStateDir("/etc/ssh", root, "/usr/local/.state")
+		Expect(stateDir).To(Equal(filepath.Join(root, "usr/local/.state/etc-ssh.bind")))
+		Expect(os.MkdirAll(stateDir, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(stateDir, "sshd_config"), []byte("x"), 0644)).To(Succeed())
+
+		archive := filepath.Join(root, "usr/local/.state/.reset/now")
+		dst, err := op.ArchiveBindState("/etc/ssh", root, "/usr/local/.state", archive)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst).To(Equal(filepath.Join(archive, "etc-ssh.bind")))
+		Expect(filepath.Join(dst, "sshd_config")).To(BeARegularFile())
+		Expect(stateDir).ToNot(BeADirectory())
+	})
+
+	It("does nothing when the bind mount has no state yet", func() {
+		dst, err := op.ArchiveBindState("/etc/ssh", root, "/usr/local/.state", filepath.Join(root, "archive"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst).To(BeEmpty())
+		Expect(filepath.Join(root, "archive")).ToNot(BeADirectory())
+	})
+})
@@ -4,24 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/containerd/containerd/mount"
 	"github.com/kairos-io/immucore/internal/constants"
 	internalUtils "github.com/kairos-io/immucore/internal/utils"
 	"github.com/kairos-io/immucore/pkg/schema"
+	"github.com/moby/sys/mountinfo"
 )
 
-// MountOPWithFstab creates and executes a mount operation.
+// MountOPWithFstab creates and executes a mount operation, retrying until timeout or ctx is done.
+// Each attempt is recorded as a sub-span of the step ctx belongs to.
 // returns the fstab entries created and an error if any.
-func MountOPWithFstab(what, where, t string, options []string, timeout time.Duration) (schema.FsTabs, error) {
+func MountOPWithFstab(ctx context.Context, what, where, t string, options []string, timeout time.Duration) (schema.FsTabs, error) {
 	var fstab schema.FsTabs
 	l := internalUtils.KLog.With().Str("what", what).Str("where", where).Str("type", t).Strs("options", options).Logger().Level(internalUtils.KLog.GetLevel())
-	c := context.Background()
 	cc := time.After(timeout)
-	for {
+	for attempt := 1; ; attempt++ {
 		select {
 		default:
+			attemptStart := internalUtils.BootTime()
 			// check fs type just-in-time before running the OP
 			if t != "tmpfs" {
 				fsType := internalUtils.DiskFSType(what)
@@ -55,6 +58,12 @@ func MountOPWithFstab(what, where, t string, options []string, timeout time.Dura
 			}
 
 			err = op.Run()
+			internalUtils.RecordSubSpan(ctx, internalUtils.SubSpan{
+				Name:  fmt.Sprintf("mount attempt %d", attempt),
+				Start: attemptStart,
+				End:   internalUtils.BootTime(),
+				Err:   err,
+			})
 
 			// If no error on mounting or error is already mounted, as that affects the sysroot
 			// for some reason it reports that its already mounted (systemd is mounting it behind our back!).
@@ -71,7 +80,7 @@ func MountOPWithFstab(what, where, t string, options []string, timeout time.Dura
 			}
 			l.Info().Msg("mount done")
 			return fstab, nil
-		case <-c.Done():
+		case <-ctx.Done():
 			e := fmt.Errorf("context canceled")
 			l.Err(e).Msg("mount canceled")
 			return fstab, e
@@ -82,3 +91,41 @@ func MountOPWithFstab(what, where, t string, options []string, timeout time.Dura
 		}
 	}
 }
+
+// MountCommandWithFstab mounts what on where through mount(8) instead of the mount syscall, for filesystems like
+// nfs that need a userspace helper (mount.nfs) to resolve the server and negotiate options.
+// Retries until timeout and returns the fstab entries created and an error if any.
+func MountCommandWithFstab(what, where, t string, options []string, timeout time.Duration) (schema.FsTabs, error) {
+	l := internalUtils.KLog.With().Str("what", what).Str("where", where).Str("type", t).Strs("options", options).Logger().Level(internalUtils.KLog.GetLevel())
+	tmpFstab := internalUtils.MountToFstab(mount.Mount{Type: t, Source: what, Options: options})
+	tmpFstab.File = internalUtils.CleanSysrootForFstab(where)
+
+	cmd := fmt.Sprintf("mount -t %s %s %s", t, what, where)
+	if len(options) > 0 {
+		cmd = fmt.Sprintf("mount -t %s -o %s %s %s", t, strings.Join(options, ","), what, where)
+	}
+
+	cc := time.After(timeout)
+	for {
+		if err := internalUtils.CreateIfNotExists(where); err != nil {
+			l.Err(err).Msg("Creating dir")
+		} else if mounted, _ := mountinfo.Mounted(where); mounted {
+			l.Debug().Msg("Already mounted")
+			return schema.FsTabs{tmpFstab}, nil
+		} else {
+			out, err := internalUtils.CommandWithPath(cmd)
+			if err == nil {
+				l.Info().Msg("mount done")
+				return schema.FsTabs{tmpFstab}, nil
+			}
+			l.Warn().Err(err).Str("out", out).Send()
+		}
+		select {
+		case <-time.After(1 * time.Second):
+		case <-cc:
+			e := fmt.Errorf("timeout exhausted")
+			l.Err(e).Msg("Mount timeout")
+			return nil, e
+		}
+	}
+}
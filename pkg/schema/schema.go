@@ -28,3 +28,33 @@ type LsblkOutput struct {
 }
 
 type FsTabs []*fstab.Mount
+
+// StateSync is how a bind mount seeds its state with the contents of the image.
+type StateSync struct {
+	// Policy is constants.SyncUpdate, SyncNewFilesOnly, SyncNever or SyncImageWins, empty is SyncUpdate.
+	Policy string
+	// ImageWinsList is the file of the image listing the files the image wins for with SyncImageWins.
+	ImageWinsList string
+}
+
+// PluginSteps is a file of constants.PluginStepsDir.
+type PluginSteps struct {
+	Steps []PluginStep `yaml:"steps"`
+}
+
+// PluginStep is an extra op inserted into the DAG, which runs either Command or the yip Stage.
+type PluginStep struct {
+	Name string `yaml:"name"`
+	// Modes are the boot modes whose graph gets the op, all of them when empty.
+	Modes    []string `yaml:"modes,omitempty"`
+	Command  string   `yaml:"command,omitempty"`
+	Stage    string   `yaml:"stage,omitempty"`
+	Deps     []string `yaml:"deps,omitempty"`
+	WeakDeps []string `yaml:"weak_deps,omitempty"`
+	// Before are the ops that run after the step, even when it fails.
+	Before []string `yaml:"before,omitempty"`
+	// Timeout is the deadline in seconds, 0 for none. Unset it gets the one of the other steps.
+	Timeout *int `yaml:"timeout,omitempty"`
+	// OnFailure is constants.PluginStepFail, PluginStepIgnore or PluginStepFatal.
+	OnFailure string `yaml:"on_failure,omitempty"`
+}
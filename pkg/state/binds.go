@@ -0,0 +1,266 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/kairos-io/immucore/pkg/op"
+	"github.com/kairos-io/immucore/pkg/schema"
+)
+
+// parseBindSync parses PERSISTENT_STATE_SYNC, a space separated list of <path>:<policy>[:<list>], see
+// cnst.SyncUpdate. The entries with an unknown policy are logged and left out, so the path gets the default.
+func parseBindSync(value string) map[string]schema.StateSync {
+	policies := map[string]schema.StateSync{}
+	for _, entry := range internalUtils.CleanupSlice(strings.Split(value, " ")) {
+		fields := strings.SplitN(entry, ":", 3)
+		if len(fields) < 2 {
+			internalUtils.KLog.Logger.Warn().Str("entry", entry).Msg("PERSISTENT_STATE_SYNC entry without a policy, ignoring it")
+			continue
+		}
+		sync := schema.StateSync{Policy: fields[1]}
+		switch sync.Policy {
+		case cnst.SyncUpdate, cnst.SyncNewFilesOnly, cnst.SyncNever:
+		case cnst.SyncImageWins:
+			if len(fields) == 3 {
+				sync.ImageWinsList = fields[2]
+			}
+		default:
+			internalUtils.KLog.Logger.Warn().Str("entry", entry).Msg("Unknown PERSISTENT_STATE_SYNC policy, ignoring it")
+			continue
+		}
+		policies[filepath.Join("/", fields[0])] = sync
+	}
+	return policies
+}
+
+// resetBindStanza returns the paths of rd.immucore.reset.bind=, as they are recorded in cnst.ResetBindsDoneFile.
+func resetBindStanza() string {
+	var paths []string
+	for _, v := range internalUtils.ReadCMDLineArg(cnst.CmdlineResetBind) {
+		paths = append(paths, strings.Split(v, ",")...)
+	}
+	return strings.Join(internalUtils.CleanupSlice(paths), ",")
+}
+
+// bindResets returns the bind mounts to reset, from rd.immucore.reset.bind= unless it was done already, and from the
+// cnst.ResetBindsFile of the state dir. The paths that are not bind mounted are logged and left out.
+func (s *State) bindResets() []string {
+	var asked []string
+	if stanza := resetBindStanza(); stanza != "" {
+		done, _ := os.ReadFile(s.path(s.StateDir, cnst.ResetBindsDoneFile))
+		if strings.TrimSpace(string(done)) == stanza {
+			internalUtils.KLog.Logger.Info().Str("paths", stanza).Msg("Persistent state paths already reset, remove " + cnst.CmdlineResetBind + " from the cmdline")
+		} else {
+			asked = append(asked, strings.Split(stanza, ",")...)
+		}
+	}
+	if data, err := os.ReadFile(s.path(s.StateDir, cnst.ResetBindsFile)); err == nil {
+		asked = append(asked, strings.Fields(string(data))...)
+	}
+
+	var resets []string
+	for _, p := range internalUtils.CleanupSlice(asked) {
+		p = filepath.Join("/", p)
+		if !slices.ContainsFunc(s.BindMounts, func(b string) bool { return filepath.Join("/", b) == p }) {
+			internalUtils.KLog.Logger.Warn().Str("path", p).Msg("Not a persistent state path, not resetting it")
+			continue
+		}
+		if !slices.Contains(resets, p) {
+			resets = append(resets, p)
+		}
+	}
+	return resets
+}
+
+// ResetBindStates resets the bind mounts asked for to the contents of the image, see cnst.CmdlineResetBind. Their
+// state is moved under cnst.ResetArchiveDir/<timestamp> in the state dir, from where it can be restored, and the
+// next bind mount seeds it again. It has to run before the bind mounts. Once every path has been reset the
+// cnst.ResetBindsFile is removed and the cmdline stanza recorded in cnst.ResetBindsDoneFile, so it resets only once.
+func (s *State) ResetBindStates() error {
+	resets := s.bindResets()
+	var errs []error
+	if len(resets) > 0 {
+		base := s.path(s.StateDir, cnst.ResetArchiveDir, time.Now().UTC().Format("20060102T150405Z"))
+		archive := base
+		// Keeps the archive of another reset within the same second.
+		for i := 1; ; i++ {
+			if _, err := os.Stat(archive); os.IsNotExist(err) {
+				break
+			}
+			archive = fmt.Sprintf("%s.%d", base, i)
+		}
+		for _, p := range resets {
+			dst, err := op.ArchiveBindState(p, s.Rootdir, s.StateDir, archive)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("resetting %s: %w", p, err))
+				continue
+			}
+			internalUtils.KLog.Logger.Info().Str("path", p).Str("archive", dst).Msg("Reset persistent state path to the image contents")
+		}
+	}
+	if len(errs) == 0 {
+		if err := os.Remove(s.path(s.StateDir, cnst.ResetBindsFile)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		// Forgetting the stanza once it is gone lets the same paths be reset again later.
+		done := s.path(s.StateDir, cnst.ResetBindsDoneFile)
+		if stanza := resetBindStanza(); stanza == "" {
+			if err := os.Remove(done); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		} else if err := internalUtils.CreateIfNotExists(s.path(s.StateDir)); err != nil {
+			errs = append(errs, err)
+		} else if err := os.WriteFile(done, []byte(stanza+"\n"), 0600); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BindMigration is what changed in the bind mounts since the last boot, see cnst.BindsManifest.
+type BindMigration struct {
+	Paths []string `json:"paths"`
+	// Added and Removed are the paths added to and removed from the manifest. Removed also has the state dirs left
+	// by paths the manifest does not know about.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Archived and Restored map the state dirs moved to and back from cnst.BindArchiveDir to where they went.
+	Archived map[string]string `json:"archived,omitempty"`
+	Restored map[string]string `json:"restored,omitempty"`
+	// Conflicts are the bind mounts shadowing each other.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// bindsManifest is the json in cnst.BindsManifest.
+type bindsManifest struct {
+	Paths []string `json:"paths"`
+}
+
+// bindConflicts returns the bind mounts of paths that shadow each other: a path bind mounted inside another one, which
+// leaves a stale copy in the state of the other, and paths sharing a state dir.
+func bindConflicts(paths []string, stateDir func(string) string) []string {
+	var conflicts []string
+	for i, a := range paths {
+		for _, b := range paths[i+1:] {
+			switch {
+			case stateDir(a) == stateDir(b):
+				conflicts = append(conflicts, fmt.Sprintf("%s and %s share the state dir %s", a, b, stateDir(a)))
+			case strings.HasPrefix(b, a+"/"):
+				conflicts = append(conflicts, fmt.Sprintf("%s is bind mounted over the state of %s", b, a))
+			case strings.HasPrefix(a, b+"/"):
+				conflicts = append(conflicts, fmt.Sprintf("%s is bind mounted over the state of %s", a, b))
+			}
+		}
+	}
+	return conflicts
+}
+
+// MigrateBindStates brings the state dir in line with the bind mounts of this boot, before they are mounted. The
+// state dirs of the paths no longer bind mounted are moved to cnst.BindArchiveDir, the ones of paths coming back are
+// moved back from there, then the manifest is updated. What changed is returned and written to
+// cnst.BindMigrationFile under runDir.
+func (s *State) MigrateBindStates(runDir string) (BindMigration, error) {
+	stateDir := func(p string) string { return op.BindStateDir(p, s.Rootdir, s.StateDir) }
+	m := BindMigration{Archived: map[string]string{}, Restored: map[string]string{}}
+	for _, p := range s.BindMounts {
+		m.Paths = append(m.Paths, filepath.Join("/", p))
+	}
+	slices.Sort(m.Paths)
+	m.Paths = slices.Compact(m.Paths)
+	m.Conflicts = bindConflicts(m.Paths, stateDir)
+	for _, c := range m.Conflicts {
+		internalUtils.KLog.Logger.Warn().Msg("Persistent state paths conflict: " + c)
+	}
+
+	manifest := s.path(s.StateDir, cnst.BindsManifest)
+	var previous bindsManifest
+	data, err := os.ReadFile(manifest)
+	known := err == nil && json.Unmarshal(data, &previous) == nil
+	if known {
+		for _, p := range m.Paths {
+			if !slices.Contains(previous.Paths, p) {
+				m.Added = append(m.Added, p)
+			}
+		}
+		for _, p := range previous.Paths {
+			if !slices.Contains(m.Paths, p) {
+				m.Removed = append(m.Removed, p)
+			}
+		}
+	}
+
+	var errs []error
+	archive := s.path(s.StateDir, cnst.BindArchiveDir)
+	current := map[string]bool{}
+	for _, p := range m.Paths {
+		dir := stateDir(p)
+		current[dir] = true
+		archived := filepath.Join(archive, filepath.Base(dir))
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Stat(archived); err != nil {
+			continue
+		}
+		if err := os.Rename(archived, dir); err != nil {
+			errs = append(errs, fmt.Errorf("restoring the state of %s: %w", p, err))
+			continue
+		}
+		m.Restored[archived] = dir
+	}
+
+	dirs, _ := filepath.Glob(s.path(s.StateDir, "*.bind"))
+	for _, dir := range dirs {
+		if current[dir] {
+			continue
+		}
+		if !slices.ContainsFunc(m.Removed, func(p string) bool { return stateDir(p) == dir }) {
+			m.Removed = append(m.Removed, filepath.Base(dir))
+		}
+		dst := filepath.Join(archive, filepath.Base(dir))
+		if err := os.MkdirAll(archive, 0700); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		// Keeps the state archived by an earlier removal of the same path.
+		if _, err := os.Stat(dst); err == nil {
+			if err := os.Rename(dst, fmt.Sprintf("%s.%s", dst, time.Now().UTC().Format("20060102T150405Z"))); err != nil {
+				errs = append(errs, fmt.Errorf("archiving %s: %w", dir, err))
+				continue
+			}
+		}
+		if err := os.Rename(dir, dst); err != nil {
+			errs = append(errs, fmt.Errorf("archiving %s: %w", dir, err))
+			continue
+		}
+		m.Archived[dir] = dst
+	}
+	if len(m.Added)+len(m.Removed)+len(m.Archived)+len(m.Restored) > 0 {
+		internalUtils.KLog.Logger.Info().Interface("migration", m).Msg("Persistent state paths changed")
+	}
+
+	if data, err := json.MarshalIndent(bindsManifest{Paths: m.Paths}, "", "  "); err == nil {
+		if err := internalUtils.CreateIfNotExists(s.path(s.StateDir)); err != nil {
+			errs = append(errs, err)
+		} else if err := os.WriteFile(manifest, data, 0600); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if data, err := json.MarshalIndent(m, "", "  "); err == nil {
+		if err := os.MkdirAll(runDir, 0755); err != nil {
+			errs = append(errs, err)
+		} else if err := os.WriteFile(filepath.Join(runDir, cnst.BindMigrationFile), data, 0644); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return m, errors.Join(errs...)
+}
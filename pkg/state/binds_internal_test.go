@@ -0,0 +1,23 @@
+package state
+
+import (
+	"github.com/kairos-io/immucore/pkg/schema"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PERSISTENT_STATE_SYNC", func() {
+	It("parses the policy of every path", func() {
+		Expect(parseBindSync("/etc/ssh:copy-new-files-only  var/lib/rancher:never-sync /etc/systemd:image-wins:/etc/immucore/systemd.list /opt:update")).To(Equal(map[string]schema.StateSync{
+			"/etc/ssh":         {Policy: "copy-new-files-only"},
+			"/var/lib/rancher": {Policy: "never-sync"},
+			"/etc/systemd":     {Policy: "image-wins", ImageWinsList: "/etc/immucore/systemd.list"},
+			"/opt":             {Policy: "update"},
+		}))
+	})
+
+	It("leaves out the entries it does not understand", func() {
+		Expect(parseBindSync("/etc/ssh /etc/systemd:merge")).To(BeEmpty())
+		Expect(parseBindSync("")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,179 @@
+package state_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("ResetBindStates", func() {
+	var s *state.State
+	var stateDir string
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		fs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "",
+		})
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+
+		s = &state.State{
+			Rootdir:    GinkgoT().TempDir(),
+			StateDir:   "/usr/local/.state",
+			BindMounts: []string{"/etc/systemd", "/var/lib/rancher", "/etc/ssh"},
+		}
+		stateDir = filepath.Join(s.Rootdir, s.StateDir)
+		for _, d := range []string{"etc-systemd.bind", "var-lib-rancher.bind", "etc-ssh.bind"} {
+			Expect(os.MkdirAll(filepath.Join(stateDir, d), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(stateDir, d, "config"), []byte(d), 0644)).To(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	archived := func() []string {
+		matches, _ := filepath.Glob(filepath.Join(stateDir, ".reset", "*", "*.bind"))
+		var out []string
+		for _, m := range matches {
+			out = append(out, filepath.Base(m))
+		}
+		return out
+	}
+
+	It("does nothing when no reset is asked for", func() {
+		Expect(s.ResetBindStates()).To(Succeed())
+		Expect(filepath.Join(stateDir, ".reset")).ToNot(BeADirectory())
+	})
+
+	It("archives the paths from the cmdline", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.reset.bind=/etc/systemd,var/lib/rancher/"), 0o600)).To(Succeed())
+		Expect(s.ResetBindStates()).To(Succeed())
+		Expect(archived()).To(ConsistOf("etc-systemd.bind", "var-lib-rancher.bind"))
+		Expect(filepath.Join(stateDir, "etc-systemd.bind")).ToNot(BeADirectory())
+		Expect(filepath.Join(stateDir, "etc-ssh.bind", "config")).To(BeARegularFile())
+	})
+
+	It("resets the paths from the cmdline only once", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.reset.bind=/etc/systemd"), 0o600)).To(Succeed())
+		Expect(s.ResetBindStates()).To(Succeed())
+		Expect(archived()).To(ConsistOf("etc-systemd.bind"))
+
+		// The bind mount seeds it again, the next boots with the stanza still on the cmdline leave it alone.
+		Expect(os.MkdirAll(filepath.Join(stateDir, "etc-systemd.bind"), 0755)).To(Succeed())
+		Expect(s.ResetBindStates()).To(Succeed())
+		Expect(archived()).To(ConsistOf("etc-systemd.bind"))
+		Expect(filepath.Join(stateDir, "etc-systemd.bind")).To(BeADirectory())
+
+		// A boot without it forgets it.
+		Expect(fs.WriteFile("/proc/cmdline", []byte(""), 0o600)).To(Succeed())
+		Expect(s.ResetBindStates()).To(Succeed())
+		Expect(filepath.Join(stateDir, ".reset-binds.done")).ToNot(BeAnExistingFile())
+	})
+
+	It("resets again when the paths on the cmdline change", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.reset.bind=/etc/systemd"), 0o600)).To(Succeed())
+		Expect(s.ResetBindStates()).To(Succeed())
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.reset.bind=/etc/systemd,/etc/ssh"), 0o600)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(stateDir, "etc-systemd.bind"), 0755)).To(Succeed())
+		Expect(s.ResetBindStates()).To(Succeed())
+		Expect(filepath.Join(stateDir, "etc-ssh.bind")).ToNot(BeADirectory())
+		Expect(filepath.Join(stateDir, "etc-systemd.bind")).ToNot(BeADirectory())
+	})
+
+	It("archives the paths from the marker file and removes it", func() {
+		marker := filepath.Join(stateDir, ".reset-binds")
+		Expect(os.WriteFile(marker, []byte("/etc/ssh\n/not/a/bind\n"), 0644)).To(Succeed())
+		Expect(s.ResetBindStates()).To(Succeed())
+		Expect(archived()).To(ConsistOf("etc-ssh.bind"))
+		Expect(marker).ToNot(BeAnExistingFile())
+		matches, _ := filepath.Glob(filepath.Join(stateDir, ".reset", "*", "etc-ssh.bind", "config"))
+		Expect(matches).To(HaveLen(1))
+		data, err := os.ReadFile(matches[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("etc-ssh.bind"))
+	})
+})
+
+var _ = Describe("MigrateBindStates", func() {
+	var s *state.State
+	var stateDir, runDir string
+
+	BeforeEach(func() {
+		s = &state.State{
+			Rootdir:    GinkgoT().TempDir(),
+			StateDir:   "/usr/local/.state",
+			BindMounts: []string{"/etc/ssh", "/var/lib/rancher"},
+		}
+		stateDir = filepath.Join(s.Rootdir, s.StateDir)
+		runDir = GinkgoT().TempDir()
+	})
+
+	readMigration := func() state.BindMigration {
+		data, err := os.ReadFile(filepath.Join(runDir, "bind-migration.json"))
+		Expect(err).ToNot(HaveOccurred())
+		var m state.BindMigration
+		Expect(json.Unmarshal(data, &m)).To(Succeed())
+		return m
+	}
+
+	It("writes the manifest on the first boot", func() {
+		m, err := s.MigrateBindStates(runDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Paths).To(Equal([]string{"/etc/ssh", "/var/lib/rancher"}))
+		Expect(m.Added).To(BeEmpty())
+		Expect(m.Removed).To(BeEmpty())
+		Expect(filepath.Join(stateDir, ".binds.json")).To(BeARegularFile())
+		Expect(readMigration().Paths).To(Equal(m.Paths))
+	})
+
+	It("archives the state of removed paths and restores it when they come back", func() {
+		_, err := s.MigrateBindStates(runDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(stateDir, "var-lib-rancher.bind"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(stateDir, "var-lib-rancher.bind", "token"), []byte("x"), 0644)).To(Succeed())
+
+		s.BindMounts = []string{"/etc/ssh", "/etc/systemd"}
+		m, err := s.MigrateBindStates(runDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Added).To(Equal([]string{"/etc/systemd"}))
+		Expect(m.Removed).To(Equal([]string{"/var/lib/rancher"}))
+		Expect(m.Archived).To(HaveKeyWithValue(filepath.Join(stateDir, "var-lib-rancher.bind"), filepath.Join(stateDir, ".removed", "var-lib-rancher.bind")))
+		Expect(filepath.Join(stateDir, ".removed", "var-lib-rancher.bind", "token")).To(BeARegularFile())
+		Expect(readMigration().Removed).To(Equal([]string{"/var/lib/rancher"}))
+
+		s.BindMounts = []string{"/etc/ssh", "/var/lib/rancher"}
+		m, err = s.MigrateBindStates(runDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Added).To(Equal([]string{"/var/lib/rancher"}))
+		Expect(m.Restored).To(HaveLen(1))
+		Expect(filepath.Join(stateDir, "var-lib-rancher.bind", "token")).To(BeARegularFile())
+	})
+
+	It("archives the state dirs the manifest does not know about", func() {
+		Expect(os.MkdirAll(filepath.Join(stateDir, "opt-old.bind"), 0755)).To(Succeed())
+		m, err := s.MigrateBindStates(runDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Removed).To(Equal([]string{"opt-old.bind"}))
+		Expect(filepath.Join(stateDir, ".removed", "opt-old.bind")).To(BeADirectory())
+	})
+
+	It("reports the paths shadowing each other", func() {
+		s.BindMounts = []string{"/etc", "/etc/ssh", "/var/lib", "/var-lib"}
+		m, err := s.MigrateBindStates(runDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Conflicts).To(ConsistOf(
+			"/etc/ssh is bind mounted over the state of /etc",
+			ContainSubstring("/var-lib and /var/lib share the state dir"),
+		))
+	})
+})
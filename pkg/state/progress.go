@@ -0,0 +1,156 @@
+package state
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+)
+
+// stepDescriptions are what the progress shows for the steps known to take a while, the others show their name.
+var stepDescriptions = map[string]string{
+	cnst.OpEnsurePartitions: "creating partitions",
+	cnst.OpFactoryReset:     "reformatting partitions for the factory reset",
+	cnst.OpKcryptUnlock:     "unlocking encrypted partitions",
+	cnst.OpUkiKcrypt:        "unlocking encrypted partitions",
+	cnst.OpLvmActivate:      "activating LVM volumes",
+	cnst.OpMdadmAssemble:    "assembling RAID arrays",
+	cnst.OpSANAttach:        "attaching iSCSI and NVMe-oF volumes",
+	cnst.OpFetchRootImage:   "downloading the root image",
+	cnst.OpMountState:       "checking and mounting the state partition",
+	cnst.OpMountRoot:        "mounting the root",
+	cnst.OpMountOEM:         "checking and mounting the OEM partition",
+	cnst.OpCustomMounts:     "checking and mounting the persistent partitions",
+	cnst.OpWaitForSysroot:   "waiting for the sysroot",
+}
+
+// promptingSteps may prompt for a passphrase on the consoles, the progress is not written there while they run.
+var promptingSteps = []string{cnst.OpKcryptUnlock, cnst.OpUkiKcrypt}
+
+// progressReporter shows the steps running for longer than threshold on out, and nothing while steps are quick.
+// Only its own goroutine writes to out, the steps only tell it what changed.
+type progressReporter struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	out       internalUtils.ProgressOutput
+	// console is set when out writes to the consoles.
+	console bool
+	// running are the steps running, with when they started since the kernel booted.
+	running map[string]time.Duration
+	changed chan struct{}
+	shown   string
+}
+
+// StartProgress shows on out the steps that have been running for longer than threshold, fed by the steps starting
+// and finishing, until stop is called. A threshold of 0 disables it.
+func StartProgress(threshold time.Duration, out internalUtils.ProgressOutput) (stop func()) {
+	if threshold == 0 {
+		return func() {}
+	}
+	_, console := out.(*internalUtils.ConsoleProgress)
+	p := &progressReporter{threshold: threshold, out: out, console: console, running: map[string]time.Duration{}, changed: make(chan struct{}, 1)}
+	for _, r := range Running() {
+		p.running[r.Name] = r.Start
+	}
+	unsubscribe := OnStep(p.onStep)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		// Steps cross the threshold while running, not only when something starts or finishes.
+		tick := time.NewTicker(min(threshold/2, time.Second))
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-p.changed:
+			case <-tick.C:
+			}
+			p.refresh()
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+			close(done)
+			<-finished
+			p.out.Clear()
+			p.shown = ""
+		})
+	}
+}
+
+// onStep records the step that started or finished and wakes up the reporter, without waiting for out.
+func (p *progressReporter) onStep(ev StepEvent) {
+	p.mu.Lock()
+	if ev.Done {
+		delete(p.running, ev.Step.Name)
+	} else {
+		p.running[ev.Step.Name] = ev.Step.Start
+	}
+	p.mu.Unlock()
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// refresh shows the slow steps, oldest first, or clears the status once there are none. On the consoles it also
+// clears it while a step may prompt for a passphrase there, rewriting the line would erase the prompt.
+func (p *progressReporter) refresh() {
+	status := p.status()
+	if status == p.shown {
+		return
+	}
+	if status == "" {
+		p.out.Clear()
+	} else {
+		p.out.Show(status)
+	}
+	p.shown = status
+}
+
+// status returns what to show, "" for nothing.
+func (p *progressReporter) status() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := internalUtils.BootTime()
+	type slowStep struct {
+		name    string
+		elapsed time.Duration
+	}
+	var slow []slowStep
+	for name, start := range p.running {
+		if p.console && slices.Contains(promptingSteps, name) {
+			return ""
+		}
+		if elapsed := now - start; elapsed >= p.threshold {
+			slow = append(slow, slowStep{name, elapsed})
+		}
+	}
+	if len(slow) == 0 {
+		return ""
+	}
+	sort.Slice(slow, func(i, j int) bool {
+		if slow[i].elapsed == slow[j].elapsed {
+			return slow[i].name < slow[j].name
+		}
+		return slow[i].elapsed > slow[j].elapsed
+	})
+	parts := make([]string, 0, len(slow))
+	for _, s := range slow {
+		desc, ok := stepDescriptions[s.name]
+		if !ok {
+			desc = s.name
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", desc, s.elapsed.Truncate(time.Second)))
+	}
+	return "immucore: " + strings.Join(parts, ", ")
+}
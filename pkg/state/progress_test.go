@@ -0,0 +1,139 @@
+package state_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeProgress records what would be shown, "" standing for a clear.
+type fakeProgress struct {
+	mu    sync.Mutex
+	shown []string
+}
+
+func (f *fakeProgress) Show(status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shown = append(f.shown, status)
+}
+
+func (f *fakeProgress) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shown = append(f.shown, "")
+}
+
+func (f *fakeProgress) Shown() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.shown...)
+}
+
+var _ = Describe("StartProgress", func() {
+	BeforeEach(func() {
+		state.ResetTimeline()
+	})
+
+	It("stays quiet while steps are quick", func() {
+		out := &fakeProgress{}
+		stop := state.StartProgress(200*time.Millisecond, out)
+		for i := 0; i < 5; i++ {
+			state.RunTimed("quick", func() error { time.Sleep(20 * time.Millisecond); return nil })
+		}
+		time.Sleep(300 * time.Millisecond)
+		Expect(out.Shown()).To(BeEmpty())
+		stop()
+		Expect(out.Shown()).To(Equal([]string{""}))
+	})
+
+	It("shows the steps slower than the threshold and clears them once done", func() {
+		out := &fakeProgress{}
+		stop := state.StartProgress(100*time.Millisecond, out)
+		defer stop()
+		release := make(chan struct{})
+		go state.RunTimed(cnst.OpMountOEM, func() error { <-release; return nil })
+
+		Eventually(out.Shown).Should(ContainElement(HavePrefix("immucore: checking and mounting the OEM partition (")))
+		close(release)
+		Eventually(func() string {
+			shown := out.Shown()
+			return shown[len(shown)-1]
+		}).Should(BeEmpty())
+	})
+
+	It("does nothing when disabled", func() {
+		out := &fakeProgress{}
+		stop := state.StartProgress(0, out)
+		state.RunTimed("slow", func() error { time.Sleep(50 * time.Millisecond); return nil })
+		stop()
+		Expect(out.Shown()).To(BeEmpty())
+	})
+
+	It("does not write to the consoles while a step may prompt for a passphrase", func() {
+		console, err := os.Create(filepath.Join(GinkgoT().TempDir(), "console"))
+		Expect(err).ToNot(HaveOccurred())
+		defer console.Close()
+		written := func() (string, error) {
+			data, err := os.ReadFile(console.Name())
+			return string(data), err
+		}
+		stop := state.StartProgress(100*time.Millisecond, internalUtils.NewConsoleProgress(console))
+		defer stop()
+
+		releaseOEM := make(chan struct{})
+		defer close(releaseOEM)
+		go state.RunTimed(cnst.OpMountOEM, func() error { <-releaseOEM; return nil })
+		Eventually(written).Should(ContainSubstring("checking and mounting the OEM partition"))
+
+		releaseUnlock := make(chan struct{})
+		defer close(releaseUnlock)
+		go state.RunTimed(cnst.OpKcryptUnlock, func() error { <-releaseUnlock; return nil })
+		Eventually(written).Should(HaveSuffix("\r\033[K"))
+		before, err := written()
+		Expect(err).ToNot(HaveOccurred())
+		Consistently(written, 1500*time.Millisecond).Should(Equal(before))
+	})
+
+	It("does not hold up the steps while the output is slow", func() {
+		out := &slowProgress{release: make(chan struct{})}
+		defer close(out.release)
+		stop := state.StartProgress(10*time.Millisecond, out)
+		defer func() {
+			go stop()
+		}()
+		go state.RunTimed("slow", func() error { time.Sleep(100 * time.Millisecond); return nil })
+		Eventually(out.Showing).Should(BeTrue())
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			state.RunTimed("quick", func() error { return nil })
+		}
+		Expect(time.Since(start)).To(BeNumerically("<", 50*time.Millisecond))
+	})
+})
+
+// slowProgress blocks showing a status until release is closed, like plymouth not answering.
+type slowProgress struct {
+	release chan struct{}
+	showing atomic.Bool
+}
+
+func (s *slowProgress) Show(string) {
+	s.showing.Store(true)
+	<-s.release
+}
+
+func (s *slowProgress) Clear() {}
+
+func (s *slowProgress) Showing() bool {
+	return s.showing.Load()
+}
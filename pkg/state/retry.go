@@ -0,0 +1,309 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/spectrocloud-labs/herd"
+)
+
+// ErrRootFailed is returned by Retrier.Err when the op mounting the root errored. No op is fatal so herd does not
+// fail the run for it, but nothing can boot without a root.
+var ErrRootFailed = errors.New("mounting the root failed")
+
+// FailedOps returns the ops of g that errored, in execution order.
+func (s *State) FailedOps(g *herd.Graph) []internalUtils.FailedOp {
+	var failed []internalUtils.FailedOp
+	for _, layer := range g.Analyze() {
+		for _, op := range layer {
+			if op.Error != nil {
+				failed = append(failed, internalUtils.FailedOp{Name: op.Name, Err: op.Error.Error()})
+			}
+		}
+	}
+	return failed
+}
+
+// rerunOnRetry are the ops that are safe to run twice and that a retry runs again even when they succeeded, as they
+// use what the retried ops provide: the fstab is rewritten from the entries of every mount.
+var rerunOnRetry = []string{cnst.OpWriteFstab}
+
+// RetryGraph returns a new graph with the ops of g that failed and the ops depending on them, directly or not, that
+// failed too or were skipped. herd has no way to reset the state of an op, so the ops are added again with the same
+// callbacks and options. Dependencies on ops that are not retried already succeeded and are dropped.
+// Dependents that succeeded are done and not run again, as most steps are not idempotent: mounts would be stacked
+// and yip stages run twice. Only the ops in rerunOnRetry are.
+func (s *State) RetryGraph(g *herd.Graph) *herd.Graph {
+	entries := map[string]herd.GraphEntry{}
+	dependents := map[string][]string{}
+	var order []string
+	for _, layer := range g.Analyze() {
+		for _, op := range layer {
+			entries[op.Name] = op
+			order = append(order, op.Name)
+			for _, d := range op.Dependencies {
+				dependents[d] = append(dependents[d], op.Name)
+			}
+		}
+	}
+
+	retry := map[string]bool{}
+	var mark func(name string)
+	mark = func(name string) {
+		if retry[name] {
+			return
+		}
+		retry[name] = true
+		for _, d := range dependents[name] {
+			op := entries[d]
+			if op.Error != nil || !op.Executed || slices.Contains(rerunOnRetry, d) {
+				mark(d)
+			}
+		}
+	}
+	for _, name := range order {
+		if entries[name].Error != nil {
+			mark(name)
+		}
+	}
+
+	rg := herd.DAG(herd.EnableInit)
+	for _, name := range order {
+		op := entries[name]
+		if !retry[name] || op.Ignored || !op.WithCallback {
+			continue
+		}
+		opts := []herd.OpOption{herd.WithCallback(op.Callback...)}
+		var deps, weak []string
+		for _, d := range internalUtils.UniqueSlice(op.Dependencies) {
+			if !retry[d] {
+				continue
+			}
+			if slices.Contains(op.WeakDependencies, d) {
+				weak = append(weak, d)
+			} else {
+				deps = append(deps, d)
+			}
+		}
+		if len(deps) > 0 {
+			opts = append(opts, herd.WithDeps(deps...))
+		}
+		if len(weak) > 0 {
+			opts = append(opts, herd.WithWeakDeps(weak...))
+		}
+		if op.WeakDeps {
+			opts = append(opts, herd.WeakDeps)
+		}
+		if op.Background {
+			opts = append(opts, herd.Background)
+		}
+		if op.Fatal {
+			opts = append(opts, herd.FatalOp)
+		}
+		if err := rg.Add(name, opts...); err != nil {
+			internalUtils.KLog.Logger.Err(err).Str("op", name).Msg("Adding op to the retry graph")
+		}
+	}
+	return rg
+}
+
+// OpOutcome is the latest outcome of an op across the runs of a Retrier.
+type OpOutcome struct {
+	Name     string `json:"name"`
+	Executed bool   `json:"executed"`
+	Error    string `json:"error,omitempty"`
+	Runs     int    `json:"runs"`
+}
+
+// dagState is the json written to DAGStateFile.
+type dagState struct {
+	Attempts int         `json:"attempts"`
+	Ops      []OpOutcome `json:"ops"`
+}
+
+// ReadOpOutcomes reads the outcome of the ops from the DAGStateFile a Retrier wrote at path.
+func ReadOpOutcomes(path string) ([]OpOutcome, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st dagState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return st.Ops, nil
+}
+
+// Retrier runs a graph and then re-runs the part of it that failed, with the same State, as many times as asked.
+// It keeps the outcome of every op across attempts and writes it, with the timeline, under dir after each run.
+// Runs are serialized so it can be driven from the failure console and the retry socket at the same time.
+type Retrier struct {
+	mu       sync.Mutex
+	s        *State
+	g        *herd.Graph
+	dir      string
+	err      error
+	attempts int
+	ops      map[string]*OpOutcome
+	order    []string
+}
+
+// NewRetrier returns a Retrier for g, which has not been run yet.
+func NewRetrier(s *State, g *herd.Graph, dir string) *Retrier {
+	return &Retrier{s: s, g: g, dir: dir, ops: map[string]*OpOutcome{}}
+}
+
+// Run runs the graph given to NewRetrier.
+func (r *Retrier) Run(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.run(ctx)
+}
+
+// Retry re-runs the failed ops and their dependents. It does nothing when nothing failed.
+func (r *Retrier) Retry(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failed()) == 0 {
+		return nil
+	}
+	r.attempts++
+	internalUtils.KLog.Logger.Info().Int("attempt", r.attempts).Msg("Retrying the failed steps")
+	r.g = r.s.RetryGraph(r.g)
+	return r.run(ctx)
+}
+
+// AutoRetry retries up to attempts times, waiting delay before each attempt, until nothing fails.
+func (r *Retrier) AutoRetry(ctx context.Context, attempts int, delay time.Duration) {
+	for i := 0; i < attempts && len(r.Failed()) > 0; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		_ = r.Retry(ctx)
+	}
+}
+
+// WaitForRetries waits up to wait for the failures to be fixed by retries coming from elsewhere.
+func (r *Retrier) WaitForRetries(ctx context.Context, wait time.Duration) {
+	if wait == 0 || len(r.Failed()) == 0 {
+		return
+	}
+	internalUtils.KLog.Logger.Info().Str("wait", wait.String()).Str("socket", cnst.RetrySocket).Msg("Waiting for a retry request")
+	deadline := time.After(wait)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for len(r.Failed()) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Graph returns the graph of the last run, the retry graph after a retry.
+func (r *Retrier) Graph() *herd.Graph {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.g
+}
+
+// Attempts returns how many retries were run.
+func (r *Retrier) Attempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts
+}
+
+// Failed returns the ops whose latest run errored, in execution order.
+func (r *Retrier) Failed() []internalUtils.FailedOp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed()
+}
+
+// Err returns the error of the last run, ErrRootFailed when the root is still not mounted.
+func (r *Retrier) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if o, ok := r.ops[cnst.OpMountRoot]; ok && o.Error != "" {
+		return ErrRootFailed
+	}
+	return nil
+}
+
+func (r *Retrier) failed() []internalUtils.FailedOp {
+	var failed []internalUtils.FailedOp
+	for _, name := range r.order {
+		if o := r.ops[name]; o.Error != "" {
+			failed = append(failed, internalUtils.FailedOp{Name: name, Err: o.Error})
+		}
+	}
+	return failed
+}
+
+func (r *Retrier) run(ctx context.Context) error {
+	r.err = r.g.Run(ctx)
+	internalUtils.KLog.Logger.Info().Msg(r.s.WriteDAG(r.g))
+	for _, layer := range r.g.Analyze() {
+		for _, op := range layer {
+			if !op.WithCallback || op.Ignored {
+				continue
+			}
+			o, ok := r.ops[op.Name]
+			if !ok {
+				o = &OpOutcome{Name: op.Name}
+				r.ops[op.Name] = o
+				r.order = append(r.order, op.Name)
+			}
+			o.Executed = op.Executed
+			o.Error = ""
+			if op.Error != nil {
+				o.Error = op.Error.Error()
+			}
+			if op.Executed {
+				o.Runs++
+			}
+		}
+	}
+	if err := r.writeState(); err != nil {
+		internalUtils.KLog.Logger.Warn().Err(err).Str("dir", r.dir).Msg("Could not write the dag state")
+	}
+	if _, err := WriteTimelineTrace(r.dir); err != nil {
+		internalUtils.KLog.Logger.Warn().Err(err).Str("dir", r.dir).Msg("Could not write boot timeline trace")
+	}
+	return r.err
+}
+
+func (r *Retrier) writeState() error {
+	st := dagState{Attempts: r.attempts, Ops: make([]OpOutcome, 0, len(r.order))}
+	for _, name := range r.order {
+		o := *r.ops[name]
+		o.Error = internalUtils.RedactSecrets(o.Error)
+		st.Ops = append(st.Ops, o)
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(r.dir, cnst.DAGStateFile), data, 0644)
+}
@@ -0,0 +1,70 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deniswernert/go-fstab"
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud-labs/herd"
+)
+
+var _ = Describe("retrying a failed mount", func() {
+	It("does not mount the binds again nor duplicate the fstab lines", func() {
+		s := &State{Rootdir: GinkgoT().TempDir()}
+		Expect(os.MkdirAll(filepath.Join(s.Rootdir, "etc"), 0755)).To(Succeed())
+		oemFails := true
+		binds := 0
+
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add(cnst.OpMountRoot, herd.WithCallback(func(_ context.Context) error {
+			s.AddToFstab(&fstab.Mount{Spec: "/dev/loop0", File: "/", VfsType: "ext4"})
+			return nil
+		}))).To(Succeed())
+		Expect(g.Add(cnst.OpMountOEM, herd.WithDeps(cnst.OpMountRoot), herd.WithCallback(func(_ context.Context) error {
+			if oemFails {
+				return errors.New("COS_OEM not found")
+			}
+			s.AddToFstab(&fstab.Mount{Spec: "/dev/disk/by-label/COS_OEM", File: "/oem", VfsType: "ext4"})
+			return nil
+		}))).To(Succeed())
+		Expect(g.Add(cnst.OpMountBind, herd.WithDeps(cnst.OpMountRoot), herd.WithWeakDeps(cnst.OpMountOEM), herd.WithCallback(func(_ context.Context) error {
+			binds++
+			s.AddToFstab(&fstab.Mount{Spec: "/usr/local/.state/etc-ssh.bind", File: "/etc/ssh", VfsType: "none", MntOps: map[string]string{"bind": ""}})
+			return nil
+		}))).To(Succeed())
+		Expect(s.WriteFstabDagStep(g, herd.WithDeps(cnst.OpMountRoot), herd.WithWeakDeps(cnst.OpMountOEM, cnst.OpMountBind))).To(Succeed())
+
+		r := NewRetrier(s, g, GinkgoT().TempDir())
+		Expect(r.Run(context.Background())).To(Succeed())
+		Expect(r.Failed()).To(HaveLen(1))
+		Expect(binds).To(Equal(1))
+
+		oemFails = false
+		Expect(r.Retry(context.Background())).To(Succeed())
+		Expect(r.Failed()).To(BeEmpty())
+		Expect(binds).To(Equal(1))
+
+		data, err := os.ReadFile(filepath.Join(s.Rootdir, "etc", "fstab"))
+		Expect(err).ToNot(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		Expect(lines).To(HaveLen(3))
+		Expect(lines).To(ContainElement(ContainSubstring("/oem")))
+		Expect(lines).To(ContainElement(ContainSubstring("/etc/ssh")))
+	})
+
+	It("replaces the fstab entry of a mountpoint mounted again", func() {
+		s := &State{}
+		s.AddToFstab(&fstab.Mount{Spec: "tmpfs", File: "/tmp", VfsType: "tmpfs"})
+		s.AddToFstab(&fstab.Mount{Spec: "overlay", File: "/var", VfsType: "overlay"})
+		s.AddToFstab(&fstab.Mount{Spec: "overlay", File: "/etc", VfsType: "overlay"}, &fstab.Mount{Spec: "tmpfs", File: "/tmp", VfsType: "tmpfs", MntOps: map[string]string{"rw": ""}})
+		entries := s.fstabEntries()
+		Expect(entries).To(HaveLen(3))
+		Expect(entries[0].MntOps).To(HaveKey("rw"))
+	})
+})
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+)
+
+// Requests understood on the retry socket, one per connection, newline terminated.
+const (
+	RetryRequestRetry  = "retry"
+	RetryRequestStatus = "status"
+)
+
+// RetryResponse is what the retry socket answers, as json.
+type RetryResponse struct {
+	Attempts int                      `json:"attempts"`
+	Failed   []internalUtils.FailedOp `json:"failed,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// Serve answers retry and status requests on the unix socket at path until ctx is done.
+// The socket is only reachable by root, it triggers mounts.
+func (r *Retrier) Serve(ctx context.Context, path string) error {
+	_ = os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		_ = l.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+		_ = os.Remove(path)
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.handle(ctx, conn)
+		}
+	}()
+	return nil
+}
+
+func (r *Retrier) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	req, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	var resp RetryResponse
+	switch strings.TrimSpace(req) {
+	case RetryRequestRetry:
+		internalUtils.KLog.Logger.Info().Msg("Retry requested over the socket")
+		_ = r.Retry(ctx)
+	case RetryRequestStatus:
+	default:
+		resp.Error = fmt.Sprintf("unknown request %q", strings.TrimSpace(req))
+	}
+	resp.Attempts = r.Attempts()
+	for _, f := range r.Failed() {
+		resp.Failed = append(resp.Failed, internalUtils.FailedOp{Name: f.Name, Err: internalUtils.RedactSecrets(f.Err)})
+	}
+	if err := r.Err(); err != nil && resp.Error == "" {
+		resp.Error = err.Error()
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// RequestRetry sends req to the retry socket at path and returns the answer, once the retry is done for
+// RetryRequestRetry.
+func RequestRetry(path, req string) (RetryResponse, error) {
+	var resp RetryResponse
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return resp, fmt.Errorf("immucore is not waiting for retries (no %s)", path)
+		}
+		return resp, err
+	}
+	defer conn.Close()
+	if _, err = fmt.Fprintf(conn, "%s\n", req); err != nil {
+		return resp, err
+	}
+	err = json.NewDecoder(conn).Decode(&resp)
+	return resp, err
+}
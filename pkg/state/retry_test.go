@@ -0,0 +1,122 @@
+package state_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/immucore/internal/constants"
+
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud-labs/herd"
+)
+
+var _ = Describe("State.RetryGraph", func() {
+	It("re-runs the failed ops and their failed or skipped dependents only", func() {
+		runs := map[string]int{}
+		fail := true
+		cb := func(name string) func(context.Context) error {
+			return func(_ context.Context) error {
+				runs[name]++
+				if name == "flaky" && fail {
+					return errors.New("not yet")
+				}
+				return nil
+			}
+		}
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("ok", herd.WithCallback(cb("ok")))).To(Succeed())
+		Expect(g.Add("flaky", herd.WithDeps("ok"), herd.WithCallback(cb("flaky")))).To(Succeed())
+		Expect(g.Add("child", herd.WithDeps("flaky"), herd.WithCallback(cb("child")))).To(Succeed())
+		Expect(g.Add("weak", herd.WithDeps("child"), herd.WeakDeps, herd.WithCallback(cb("weak")))).To(Succeed())
+		Expect(g.Run(context.Background())).To(Succeed())
+
+		s := &state.State{}
+		Expect(s.FailedOps(g)).To(HaveLen(2))
+		Expect(runs).To(Equal(map[string]int{"ok": 1, "flaky": 1, "weak": 1}))
+
+		fail = false
+		rg := s.RetryGraph(g)
+		Expect(rg.Run(context.Background())).To(Succeed())
+		Expect(s.FailedOps(rg)).To(BeEmpty())
+		Expect(runs).To(Equal(map[string]int{"ok": 1, "flaky": 2, "child": 1, "weak": 1}))
+	})
+
+})
+
+var _ = Describe("Retrier", func() {
+	var dir string
+	var fail bool
+	var g *herd.Graph
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		fail = true
+		g = herd.DAG(herd.EnableInit)
+		Expect(g.Add("mount-root", herd.WithCallback(func(_ context.Context) error {
+			if fail {
+				return errors.New("no image")
+			}
+			return nil
+		}))).To(Succeed())
+		Expect(g.Add("write-fstab", herd.WithDeps("mount-root"), herd.WeakDeps, herd.WithCallback(func(_ context.Context) error {
+			return nil
+		}))).To(Succeed())
+	})
+
+	It("keeps the outcome of every op across retries", func() {
+		r := state.NewRetrier(&state.State{}, g, dir)
+		Expect(r.Run(context.Background())).To(Succeed())
+		Expect(r.Err()).To(MatchError(state.ErrRootFailed))
+		Expect(r.Failed()).To(HaveLen(1))
+		Expect(r.Failed()[0].Name).To(Equal("mount-root"))
+		Expect(r.Failed()[0].Err).To(ContainSubstring("no image"))
+
+		r.AutoRetry(context.Background(), 2, 0)
+		Expect(r.Attempts()).To(Equal(2))
+		Expect(r.Err()).To(MatchError(state.ErrRootFailed))
+
+		fail = false
+		Expect(r.Retry(context.Background())).To(Succeed())
+		Expect(r.Err()).ToNot(HaveOccurred())
+		Expect(r.Failed()).To(BeEmpty())
+
+		data, err := os.ReadFile(filepath.Join(dir, constants.DAGStateFile))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"attempts": 3`))
+		Expect(string(data)).To(ContainSubstring(`"runs": 4`))
+		Expect(string(data)).ToNot(ContainSubstring(`"error"`))
+
+		outcomes, err := state.ReadOpOutcomes(filepath.Join(dir, constants.DAGStateFile))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(outcomes).ToNot(BeEmpty())
+		for _, o := range outcomes {
+			Expect(o.Executed).To(BeTrue())
+			Expect(o.Error).To(BeEmpty())
+		}
+	})
+
+	It("retries on request over the socket", func() {
+		r := state.NewRetrier(&state.State{}, g, dir)
+		Expect(r.Run(context.Background())).To(Succeed())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sock := filepath.Join(dir, "immucore.sock")
+		Expect(r.Serve(ctx, sock)).To(Succeed())
+
+		resp, err := state.RequestRetry(sock, state.RetryRequestStatus)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Attempts).To(Equal(0))
+		Expect(resp.Failed).To(HaveLen(1))
+
+		fail = false
+		resp, err = state.RequestRetry(sock, state.RetryRequestRetry)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Attempts).To(Equal(1))
+		Expect(resp.Failed).To(BeEmpty())
+		Expect(resp.Error).To(BeEmpty())
+	})
+})
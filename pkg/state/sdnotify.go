@@ -0,0 +1,110 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+)
+
+// underSystemd returns whether immucore runs as a service that can be notified, see sd_notify(3).
+func underSystemd() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+func sdNotify(state ...string) {
+	if _, err := daemon.SdNotify(false, strings.Join(state, "\n")); err != nil {
+		internalUtils.KLog.Logger.Debug().Err(err).Msg("Notifying systemd")
+	}
+}
+
+// StartSystemdNotify keeps systemd posted when immucore runs as a service: the steps running as its STATUS, and,
+// until stop is called, EXTEND_TIMEOUT_USEC so its start timeout does not kill immucore in the middle of a long step
+// (fsck, creating partitions...) nor while a failed boot waits in the failure console or for a retry. Steps that hang
+// are stopped by the deadline they are given, see StepTimeout. It does nothing outside systemd.
+func StartSystemdNotify() (stop func()) {
+	return startSystemdNotify(cnst.SystemdExtendInterval * time.Second)
+}
+
+// startSystemdNotify is StartSystemdNotify extending the timeout every interval.
+func startSystemdNotify(interval time.Duration) (stop func()) {
+	if !underSystemd() {
+		return func() {}
+	}
+	var mu sync.Mutex
+	running := map[string]bool{}
+	for _, r := range Running() {
+		running[r.Name] = true
+	}
+	unsubscribe := OnStep(func(ev StepEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ev.Done {
+			delete(running, ev.Step.Name)
+		} else {
+			running[ev.Step.Name] = true
+		}
+		if len(running) > 0 {
+			sdNotify("STATUS=Running " + strings.Join(slices.Sorted(maps.Keys(running)), ", "))
+		} else {
+			sdNotify("STATUS=Waiting")
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+			sdNotify(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", (cnst.SystemdExtendTimeout * time.Second).Microseconds()))
+		}
+	}()
+	return func() {
+		unsubscribe()
+		cancel()
+	}
+}
+
+// NotifySystemdDone tells systemd immucore is done: READY=1 when err is nil, otherwise ERRNO with the errno of err
+// (EIO when it has none) and the reason as STATUS.
+func NotifySystemdDone(err error, reason string) {
+	if !underSystemd() {
+		return
+	}
+	if err == nil {
+		sdNotify(daemon.SdNotifyReady, "STATUS=Done")
+		return
+	}
+	if reason == "" {
+		reason = err.Error()
+	}
+	sdNotify("STATUS=Failed: "+internalUtils.RedactSecrets(strings.ReplaceAll(reason, "\n", " ")), fmt.Sprintf("ERRNO=%d", errnoOf(err)))
+}
+
+// errnoOf returns the errno for err: its own when it wraps one, ETIMEDOUT for step timeouts, EIO otherwise.
+func errnoOf(err error) int {
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+		return int(errno)
+	case errors.Is(err, context.DeadlineExceeded):
+		return int(syscall.ETIMEDOUT)
+	default:
+		return int(syscall.EIO)
+	}
+}
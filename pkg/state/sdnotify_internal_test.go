@@ -0,0 +1,51 @@
+package state
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("extending the systemd start timeout", func() {
+	It("keeps extending it with no step running until stopped", func() {
+		ResetTimeline()
+		socket := filepath.Join(GinkgoT().TempDir(), "notify")
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(os.Setenv("NOTIFY_SOCKET", socket)).To(Succeed())
+		defer os.Unsetenv("NOTIFY_SOCKET")
+
+		// Like a failed boot waiting in the failure console.
+		stop := startSystemdNotify(50 * time.Millisecond)
+		buf := make([]byte, 4096)
+		for extended := 0; extended < 3; {
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			n, err := conn.Read(buf)
+			Expect(err).ToNot(HaveOccurred())
+			// Steps left running by other specs may still update the status.
+			if strings.HasPrefix(string(buf[:n]), "STATUS=") {
+				continue
+			}
+			Expect(string(buf[:n])).To(Equal("EXTEND_TIMEOUT_USEC=30000000"))
+			extended++
+		}
+
+		stop()
+		// Drain what was sent while stopping.
+		time.Sleep(100 * time.Millisecond)
+		for conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)) == nil {
+			if _, err := conn.Read(buf); err != nil {
+				break
+			}
+		}
+		Expect(conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))).To(Succeed())
+		_, err = conn.Read(buf)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,75 @@
+package state_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("systemd notifications", func() {
+	var conn *net.UnixConn
+
+	// next returns the next notification sent to the socket.
+	next := func() string {
+		buf := make([]byte, 4096)
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		n, err := conn.Read(buf)
+		Expect(err).ToNot(HaveOccurred())
+		return string(buf[:n])
+	}
+
+	BeforeEach(func() {
+		state.ResetTimeline()
+		socket := filepath.Join(GinkgoT().TempDir(), "notify")
+		var err error
+		conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.Setenv("NOTIFY_SOCKET", socket)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		_ = os.Unsetenv("NOTIFY_SOCKET")
+		_ = conn.Close()
+	})
+
+	It("names the steps running in the status", func() {
+		stop := state.StartSystemdNotify()
+		defer stop()
+		state.RunTimed("mount-oem", func() error { return nil })
+		Expect(next()).To(Equal("STATUS=Running mount-oem"))
+	})
+
+	It("reports readiness once done", func() {
+		state.NotifySystemdDone(nil, "")
+		Expect(next()).To(Equal("READY=1\nSTATUS=Done"))
+	})
+
+	DescribeTable("reports failures with an errno",
+		func(err error, expected string) {
+			state.NotifySystemdDone(err, "failed operations: mount-root: no\ndisk password=hunter2")
+			Expect(next()).To(Equal("STATUS=Failed: failed operations: mount-root: no disk password=<redacted>\n" + expected))
+		},
+		Entry("from the error", fmt.Errorf("mounting: %w", syscall.ENOENT), "ERRNO=2"),
+		Entry("for timeouts", &state.StepTimeoutError{Step: "mount-root", Timeout: time.Second}, "ERRNO=110"),
+		Entry("EIO by default", errors.New("no root"), "ERRNO=5"),
+	)
+
+	It("does nothing outside systemd", func() {
+		Expect(os.Unsetenv("NOTIFY_SOCKET")).To(Succeed())
+		stop := state.StartSystemdNotify()
+		state.RunTimed("mount-oem", func() error { return nil })
+		stop()
+		state.NotifySystemdDone(nil, "")
+		Expect(conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+		_, err := conn.Read(make([]byte, 10))
+		Expect(err).To(HaveOccurred())
+	})
+})
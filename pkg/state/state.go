@@ -2,14 +2,18 @@ package state
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/deniswernert/go-fstab"
 	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/kairos-io/immucore/pkg/schema"
 	"github.com/spectrocloud-labs/herd"
 )
 
@@ -17,16 +21,43 @@ type State struct {
 	Rootdir       string // where to mount the root partition e.g. /sysroot inside initrd with pivot, / with nopivot
 	TargetImage   string // image from the state partition to mount as loop device e.g. /cOS/active.img
 	TargetDevice  string // e.g. /dev/disk/by-label/COS_ACTIVE
+	RootProvider  string // which RootProvider mounts Rootdir e.g. loop, nfs. Empty means loop
+	RootSubvolume string // btrfs subvolume of the state partition to mount as root instead of TargetImage e.g. @active
 	RootMountMode string // How to mount the root partition e.g. ro or rw
 	InRAM         bool   // running the kairos.ram workflow: rootfs is a tmpfs staged by dracut's rd.live.ram, OEM+persistent still on disk
 
 	// /run/cos-layout.env (different!)
-	OverlayDirs  []string          // e.g. /var
-	BindMounts   []string          // e.g. /etc/kubernetes
-	CustomMounts map[string]string // e.g. diskid : mountpoint
-	OverlayBase  string            // Overlay config, defaults to tmpfs:20%
-	StateDir     string            // e.g. "/usr/local/.state"
-	fstabs       []*fstab.Mount
+	OverlayDirs  []string                    // e.g. /var
+	BindMounts   []string                    // e.g. /etc/kubernetes
+	BindSync     map[string]schema.StateSync // e.g. /etc/ssh : copy-new-files-only
+	CustomMounts map[string]string           // e.g. diskid : mountpoint
+	OverlayBase  string                      // Overlay config, defaults to tmpfs:20%
+	StateDir     string                      // e.g. "/usr/local/.state"
+
+	// BeforeInit runs in the UKI boot right before init is executed, with the graph being run, as nothing after the
+	// run of the graph gets to run there.
+	BeforeInit func(g *herd.Graph)
+
+	fstabs   []*fstab.Mount
+	fstabsMu sync.Mutex
+}
+
+// NewState returns the State of this boot from the cmdline. With dryRun it does not look for the target image.
+func NewState(dryRun bool) (*State, error) {
+	targetImage, targetDevice, err := internalUtils.GetTarget(dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &State{
+		Rootdir:       internalUtils.GetRootDir(),
+		TargetDevice:  targetDevice,
+		TargetImage:   targetImage,
+		RootProvider:  internalUtils.RootProviderName(),
+		RootSubvolume: internalUtils.GetRootSubvolume(),
+		RootMountMode: internalUtils.RootRW(),
+		OverlayBase:   internalUtils.GetOverlayBase(),
+		InRAM:         internalUtils.BootInRAM(),
+	}, nil
 }
 
 // SortedBindMounts returns the nodes with less depth first and in alphabetical order.
@@ -58,7 +89,7 @@ func (s *State) WriteFstab() func(context.Context) error {
 			return err
 		}
 		_ = f.Close()
-		for _, fst := range s.fstabs {
+		for _, fst := range s.fstabEntries() {
 			internalUtils.KLog.Logger.Debug().Str("what", fst.String()).Msg("Adding line to fstab")
 			select {
 			case <-ctx.Done():
@@ -102,7 +133,12 @@ func (s *State) FailureReason(g *herd.Graph) string {
 	var failed []string
 	for _, layer := range g.Analyze() {
 		for _, op := range layer {
-			if op.Error != nil {
+			var timeout *StepTimeoutError
+			switch {
+			case errors.As(op.Error, &timeout):
+				// herd wraps the error in a multierror, a timeout reads better on its own.
+				failed = append(failed, fmt.Sprintf("%s: %s", op.Name, timeout.Error()))
+			case op.Error != nil:
 				failed = append(failed, fmt.Sprintf("%s: %s", op.Name, op.Error.Error()))
 			}
 		}
@@ -141,17 +177,25 @@ func (s *State) LogIfErrorAndPanic(e error, msgContext string) {
 	}
 }
 
-// AddToFstab will try to add an entry to the fstab list
-// Will check if the entry exists before adding it to avoid duplicates.
-func (s *State) AddToFstab(tmpFstab *fstab.Mount) {
-	found := false
-	for _, f := range s.fstabs {
-		if f.Spec == tmpFstab.Spec {
-			internalUtils.KLog.Logger.Debug().Interface("existing", f).Interface("duplicated", tmpFstab).Msg("Duplicated fstab entry found, not adding")
-			found = true
+// AddToFstab adds entries to the fstab list. An entry for a mountpoint already in the list replaces the existing one
+// in place, so a step run again by a retry does not duplicate its lines.
+func (s *State) AddToFstab(entries ...*fstab.Mount) {
+	s.fstabsMu.Lock()
+	defer s.fstabsMu.Unlock()
+	for _, e := range entries {
+		i := slices.IndexFunc(s.fstabs, func(f *fstab.Mount) bool { return f.File == e.File })
+		if i == -1 {
+			s.fstabs = append(s.fstabs, e)
+			continue
 		}
+		internalUtils.KLog.Logger.Debug().Interface("existing", s.fstabs[i]).Interface("new", e).Msg("Replacing fstab entry for the same mountpoint")
+		s.fstabs[i] = e
 	}
-	if !found {
-		s.fstabs = append(s.fstabs, tmpFstab)
-	}
+}
+
+// fstabEntries returns a copy of the fstab list.
+func (s *State) fstabEntries() []*fstab.Mount {
+	s.fstabsMu.Lock()
+	defer s.fstabsMu.Unlock()
+	return slices.Clone(s.fstabs)
 }
@@ -1,6 +1,8 @@
 package state_test
 
 import (
+	"context"
+
 	"github.com/kairos-io/immucore/pkg/op"
 	"github.com/kairos-io/immucore/pkg/state"
 	"time"
@@ -115,7 +117,7 @@ var _ = Describe("mounting immutable setup", func() {
 		})
 
 		It("Mountop timeouts", func() {
-			_, err := op.MountOPWithFstab("/dev/doesntexist", "/tmp/jojobizarreadventure", "", []string{}, 500*time.Millisecond)
+			_, err := op.MountOPWithFstab(context.Background(), "/dev/doesntexist", "/tmp/jojobizarreadventure", "", []string{}, 500*time.Millisecond)
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("exhausted"))
 		})
@@ -208,7 +210,8 @@ func checkDag(dag [][]herd.GraphEntry, actualDag string) {
 // It mirrors the normal-boot DAG minus LVM activation, mount-state,
 // discover-state, and mount-root — dracut's rd.live.ram provides /sysroot for
 // us, so we skip straight to waiting for it. Every other step (kcrypt, oem,
-// rootfs, load-config, mounts, overlays, binds, fstab, initramfs) is reused
+// rootfs, load-config, mounts, overlays, binds, the immucore stages, fstab,
+// initramfs) is reused
 // verbatim from the shared step set. ensure-partitions is inserted between
 // wait-for-sysroot and every step that expects Kairos partition labels to
 // exist, so first-boot workstations get their COS_OEM/COS_PERSISTENT created
@@ -218,15 +221,17 @@ func checkInRAMDag(dag [][]herd.GraphEntry, actualDag string) {
 	// guaranteed, so we assert as a set.
 	expected := [][]string{
 		{"init"},
-		{cnst.OpSentinel, cnst.OpWaitForSysroot, cnst.OpMountTmpfs},
+		{cnst.OpSentinel, cnst.OpWaitForSysroot, cnst.OpMountTmpfs, cnst.OpMdadmAssemble},
 		{cnst.OpEnsurePartitions},
 		{cnst.OpKcryptUpgrade, cnst.OpMountOEM},
-		{cnst.OpKcryptUnlock, cnst.OpRootfsHook},
-		{cnst.OpLoadConfig},
+		{cnst.OpPreUnlockHook, cnst.OpRootfsHook},
+		{cnst.OpKcryptUnlock, cnst.OpLoadConfig},
 		{cnst.OpMountBaseOverlay, cnst.OpCustomMounts},
 		{cnst.OpOverlayMount},
 		{cnst.OpMountBind},
-		{cnst.OpWriteFstab, cnst.OpUkiCopySysExtensions},
+		{cnst.OpPostMountHook, cnst.OpUkiCopySysExtensions},
+		{cnst.OpPreFstabHook},
+		{cnst.OpWriteFstab},
 		{cnst.OpInitramfsHook},
 	}
 	Expect(len(dag)).To(Equal(len(expected)), actualDag)
@@ -18,41 +18,24 @@ import (
 // MountTmpfsDagStep adds the step to mount /tmp .
 func (s *State) MountTmpfsDagStep(g *herd.Graph) error {
 	return g.Add(cnst.OpMountTmpfs, TimedCallback(cnst.OpMountTmpfs,
-		func(_ context.Context) error {
-			fstab, err := op.MountOPWithFstab("tmpfs", "/tmp", "tmpfs", []string{"rw"}, 10*time.Second)
-			for _, f := range fstab {
-				s.fstabs = append(s.fstabs, f)
-			}
+		func(ctx context.Context) error {
+			fstab, err := op.MountOPWithFstab(ctx, "tmpfs", "/tmp", "tmpfs", []string{"rw"}, 10*time.Second)
+			s.AddToFstab(fstab...)
 			return err
 		},
 	))
 }
 
-// MountRootDagStep will add the step to mount the Rootdir for the system
+// MountLoopRootDagStep will add the steps to mount the Rootdir for the system from an image
 // 1 - mount the state partition to find the images (active/passive/recovery)
 // 2 - mount the image as a loop device
-// 3 - Mount the labels as /sysroot .
-func (s *State) MountRootDagStep(g *herd.Graph) error {
+// 3 - Mount the labels as /sysroot
+// opts are applied to the state partition mount, so callers can order it after whatever attaches the disk.
+func (s *State) MountLoopRootDagStep(g *herd.Graph, opts ...herd.OpOption) error {
 	var err error
 
 	// 1 - mount the state partition to find the images (active/passive/recovery)
-	err = g.Add(cnst.OpMountState,
-		TimedCallback(cnst.OpMountState,
-			func(_ context.Context) error {
-				fstab, err := op.MountOPWithFstab(
-					internalUtils.GetState(),
-					s.path("/run/initramfs/cos-state"),
-					internalUtils.DiskFSType(internalUtils.GetState()),
-					[]string{
-						s.RootMountMode,
-					}, 60*time.Second)
-				for _, f := range fstab {
-					s.fstabs = append(s.fstabs, f)
-				}
-				return err
-			},
-		),
-	)
+	err = s.mountStateDagStep(g, []string{s.RootMountMode}, opts...)
 	if err != nil {
 		internalUtils.KLog.Logger.Err(err).Send()
 	}
@@ -89,8 +72,9 @@ func (s *State) MountRootDagStep(g *herd.Graph) error {
 	err = g.Add(cnst.OpMountRoot,
 		herd.WithDeps(cnst.OpDiscoverState),
 		TimedCallback(cnst.OpMountRoot,
-			func(_ context.Context) error {
+			func(ctx context.Context) error {
 				fstab, err := op.MountOPWithFstab(
+					ctx,
 					s.TargetDevice,
 					s.Rootdir,
 					"ext4", // TODO: Get this just in time? Currently if using DiskFSType is run immediately which is bad because its not mounted
@@ -101,9 +85,68 @@ func (s *State) MountRootDagStep(g *herd.Graph) error {
 						"exec",
 						"async",
 					}, 10*time.Second)
-				for _, f := range fstab {
-					s.fstabs = append(s.fstabs, f)
+				s.AddToFstab(fstab...)
+				return err
+			},
+		),
+	)
+	if err != nil {
+		internalUtils.KLog.Logger.Err(err).Send()
+	}
+	return err
+}
+
+// MountRootSubvolumeDagStep is the btrfs flavour of MountLoopRootDagStep, where active/passive are subvolumes
+// of a single COS_STATE partition instead of image files in it
+// 1 - mount the top level of the state partition
+// 2 - check the subvolume is there so a typo on the cmdline fails with a clear error instead of a mount timeout
+// 3 - mount the subvolume as Rootdir. The subvol= option ends up in fstab so the booted system knows its snapshot.
+// opts are applied to the state partition mount, like in MountLoopRootDagStep.
+func (s *State) MountRootSubvolumeDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	var err error
+
+	// 1 - mount the top level subvolume explicitly, the default one could be any snapshot
+	err = s.mountStateDagStep(g, []string{s.RootMountMode, "subvolid=5"}, opts...)
+	if err != nil {
+		internalUtils.KLog.Logger.Err(err).Send()
+	}
+
+	// 2 - find the subvolume
+	err = g.Add(cnst.OpDiscoverState,
+		herd.WithDeps(cnst.OpMountState),
+		TimedCallback(cnst.OpDiscoverState,
+			func(_ context.Context) error {
+				subvolPath := s.path("/run/initramfs/cos-state", s.RootSubvolume)
+				if _, err := os.Stat(subvolPath); err != nil {
+					return fmt.Errorf("subvolume %s not found in the state partition: %w", s.RootSubvolume, err)
 				}
+				internalUtils.KLog.Logger.Debug().Str("subvolume", s.RootSubvolume).Str("path", subvolPath).Msg("subvolume found")
+				return nil
+			},
+		))
+	if err != nil {
+		internalUtils.KLog.Logger.Err(err).Send()
+	}
+
+	// 3 - Mount the subvolume as Rootdir
+	err = g.Add(cnst.OpMountRoot,
+		herd.WithDeps(cnst.OpDiscoverState),
+		TimedCallback(cnst.OpMountRoot,
+			func(ctx context.Context) error {
+				fstab, err := op.MountOPWithFstab(
+					ctx,
+					internalUtils.GetState(),
+					s.Rootdir,
+					"btrfs",
+					[]string{
+						s.RootMountMode,
+						fmt.Sprintf("subvol=%s", s.RootSubvolume),
+						"suid",
+						"dev",
+						"exec",
+						"async",
+					}, 10*time.Second)
+				s.AddToFstab(fstab...)
 				return err
 			},
 		),
@@ -114,6 +157,25 @@ func (s *State) MountRootDagStep(g *herd.Graph) error {
 	return err
 }
 
+// mountStateDagStep adds the step to mount the state partition under /run/initramfs/cos-state
+// with the given mount options.
+func (s *State) mountStateDagStep(g *herd.Graph, options []string, opts ...herd.OpOption) error {
+	return g.Add(cnst.OpMountState, append(opts,
+		TimedCallback(cnst.OpMountState,
+			func(ctx context.Context) error {
+				fstab, err := op.MountOPWithFstab(
+					ctx,
+					internalUtils.GetState(),
+					s.path("/run/initramfs/cos-state"),
+					internalUtils.DiskFSType(internalUtils.GetState()),
+					options, 60*time.Second)
+				s.AddToFstab(fstab...)
+				return err
+			},
+		))...,
+	)
+}
+
 // WaitForSysrootDagStep waits for the s.Rootdir and s.Rootdir/system paths to be there
 // Useful for livecd/netboot as we want to run steps after s.Rootdir is ready but we don't mount it ourselves.
 func (s *State) WaitForSysrootDagStep(g *herd.Graph) error {
@@ -160,10 +222,25 @@ func (s *State) WaitForSysrootDagStep(g *herd.Graph) error {
 }
 
 // LVMActivation will try to activate lvm volumes/groups on the system.
-func (s *State) LVMActivation(g *herd.Graph) error {
-	return g.Add(cnst.OpLvmActivate, TimedCallback(cnst.OpLvmActivate, func(_ context.Context) error {
+func (s *State) LVMActivation(g *herd.Graph, opts ...herd.OpOption) error {
+	return g.Add(cnst.OpLvmActivate, append(opts, TimedCallback(cnst.OpLvmActivate, func(_ context.Context) error {
 		return internalUtils.ActivateLVM()
-	}))
+	}))...)
+}
+
+// MdadmAssembleDagStep will try to assemble the software RAID arrays on the system.
+func (s *State) MdadmAssembleDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	return g.Add(cnst.OpMdadmAssemble, append(opts, TimedCallback(cnst.OpMdadmAssemble, func(_ context.Context) error {
+		return internalUtils.AssembleMD()
+	}))...)
+}
+
+// SANAttachDagStep logs into the iSCSI targets and connects the NVMe-oF subsystems given on the cmdline, so the
+// COS_* labels on those volumes show up before anything looks for them.
+func (s *State) SANAttachDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	return g.Add(cnst.OpSANAttach, append(opts, TimedCallback(cnst.OpSANAttach, func(_ context.Context) error {
+		return internalUtils.AttachSAN()
+	}))...)
 }
 
 // RunKcrypt unlocks encrypted partitions using the appropriate encryptor.
@@ -0,0 +1,233 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/kairos-io/immucore/pkg/schema"
+	"github.com/spectrocloud-labs/herd"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadPluginSteps reads the steps declared in the yaml files of dir, in the order of the files. A missing dir has no
+// steps. The files that cannot be read are skipped and returned as errors with the steps of the others.
+func LoadPluginSteps(dir string) ([]schema.PluginStep, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	yml, _ := filepath.Glob(filepath.Join(dir, "*.yml"))
+	files = append(files, yml...)
+	slices.Sort(files)
+
+	var steps []schema.PluginStep
+	var errs []error
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var file schema.PluginSteps
+		// A typo in a field would otherwise leave the step silently out of order.
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+			errs = append(errs, fmt.Errorf("parsing %s: %w", f, err))
+			continue
+		}
+		steps = append(steps, file.Steps...)
+	}
+	return steps, errors.Join(errs...)
+}
+
+// checkPluginStep returns why step cannot be added, if it cannot.
+func checkPluginStep(step schema.PluginStep) error {
+	switch {
+	case step.Name == "":
+		return errors.New("step without a name")
+	case (step.Command == "") == (step.Stage == ""):
+		return fmt.Errorf("step %s: needs either a command or a stage", step.Name)
+	case step.Timeout != nil && *step.Timeout < 0:
+		return fmt.Errorf("step %s: negative timeout", step.Name)
+	}
+	switch step.OnFailure {
+	case "", cnst.PluginStepFail, cnst.PluginStepIgnore, cnst.PluginStepFatal:
+		return nil
+	default:
+		return fmt.Errorf("step %s: unknown on_failure %q, expected %s, %s or %s", step.Name, step.OnFailure, cnst.PluginStepFail, cnst.PluginStepIgnore, cnst.PluginStepFatal)
+	}
+}
+
+// AddPluginSteps adds to g the steps for mode, after the ops they depend on and before the ops they are run before,
+// which are either ops of g or other steps. The steps that are invalid, named like an op of g, refer to ops that are
+// not there or would make a loop are left out and returned as errors, so a broken file does not break the boot.
+func (s *State) AddPluginSteps(g *herd.Graph, mode string, steps []schema.PluginStep) error {
+	added := map[string]bool{}
+	for _, layer := range g.Analyze() {
+		for _, op := range layer {
+			added[op.Name] = true
+		}
+	}
+	var errs []error
+	var pending []schema.PluginStep
+	names := map[string]bool{}
+	for _, step := range steps {
+		if len(step.Modes) > 0 && !slices.Contains(step.Modes, mode) {
+			continue
+		}
+		if err := checkPluginStep(step); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if added[step.Name] || names[step.Name] {
+			errs = append(errs, fmt.Errorf("step %s: there is already an op with that name", step.Name))
+			continue
+		}
+		names[step.Name] = true
+		pending = append(pending, step)
+	}
+
+	// Adding a step only once everything it depends on is there keeps herd from creating dangling or circular
+	// dependencies.
+	for len(pending) > 0 {
+		var left []schema.PluginStep
+		for _, step := range pending {
+			ready := true
+			for _, d := range pluginStepRefs(step) {
+				ready = ready && added[d]
+			}
+			if !ready {
+				left = append(left, step)
+				continue
+			}
+			if loop := beforeLoop(g, step); len(loop) > 0 {
+				errs = append(errs, fmt.Errorf("step %s: cannot run before %s, which it runs after", step.Name, strings.Join(loop, ", ")))
+				continue
+			}
+			if err := g.Add(step.Name, s.pluginStepOptions(step)...); err != nil {
+				errs = append(errs, fmt.Errorf("step %s: %w", step.Name, err))
+				continue
+			}
+			added[step.Name] = true
+			for _, b := range step.Before {
+				if err := runAfter(g, b, step.Name); err != nil {
+					errs = append(errs, fmt.Errorf("step %s: running %s after it: %w", step.Name, b, err))
+				}
+			}
+		}
+		if len(left) == len(pending) {
+			break
+		}
+		pending = left
+	}
+	for _, step := range pending {
+		var missing []string
+		for _, d := range pluginStepRefs(step) {
+			if !added[d] {
+				missing = append(missing, d)
+			}
+		}
+		errs = append(errs, fmt.Errorf("step %s: refers to %s, which are not ops of the %s graph", step.Name, strings.Join(missing, ", "), mode))
+	}
+	return errors.Join(errs...)
+}
+
+// pluginStepRefs returns the ops step runs after or before.
+func pluginStepRefs(step schema.PluginStep) []string {
+	return slices.Concat(step.Deps, step.WeakDeps, step.Before)
+}
+
+// beforeLoop returns the ops step is to run before that it also runs after, directly or not.
+func beforeLoop(g *herd.Graph, step schema.PluginStep) []string {
+	var loop []string
+	for _, b := range step.Before {
+		for _, d := range append(slices.Clone(step.Deps), step.WeakDeps...) {
+			if d == b || g.DependsOn(d, b) {
+				loop = append(loop, b)
+				break
+			}
+		}
+	}
+	return loop
+}
+
+// runAfter makes the op name of g weakly depend on deps too. herd cannot change an op once added, so it is added
+// again with the same options and the new dependencies.
+func runAfter(g *herd.Graph, name string, deps ...string) error {
+	op := g.State(name)
+	opts := []herd.OpOption{herd.WithCallback(op.Callback...)}
+	var strong []string
+	for _, d := range op.Dependencies {
+		if !slices.Contains(op.WeakDependencies, d) {
+			strong = append(strong, d)
+		}
+	}
+	if len(strong) > 0 {
+		opts = append(opts, herd.WithDeps(strong...))
+	}
+	opts = append(opts, herd.WithWeakDeps(append(slices.Clone(op.WeakDependencies), deps...)...))
+	if op.WeakDeps {
+		opts = append(opts, herd.WeakDeps)
+	}
+	if op.Background {
+		opts = append(opts, herd.Background)
+	}
+	if op.Fatal {
+		opts = append(opts, herd.FatalOp)
+	}
+	if op.Ignored {
+		opts = append(opts, herd.EnableIf(func() bool { return false }))
+	}
+	return g.Add(name, opts...)
+}
+
+func (s *State) pluginStepOptions(step schema.PluginStep) []herd.OpOption {
+	opts := []herd.OpOption{
+		herd.WithDeps(step.Deps...),
+		herd.WithWeakDeps(step.WeakDeps...),
+		timedCallback(step.Name, func() time.Duration {
+			if step.Timeout == nil {
+				return internalUtils.StepTimeout(step.Name)
+			}
+			return internalUtils.CmdlineSeconds(cnst.CmdlineStepTimeoutPrefix+step.Name+"=", *step.Timeout)
+		}, s.runPluginStep(step)),
+	}
+	if step.OnFailure == cnst.PluginStepFatal {
+		opts = append(opts, herd.FatalOp)
+	}
+	return opts
+}
+
+// runPluginStep runs the command or the stage of step, with the error the failure policy gives.
+func (s *State) runPluginStep(step schema.PluginStep) func(context.Context) error {
+	return func(ctx context.Context) error {
+		var err error
+		if step.Stage != "" {
+			internalUtils.KLog.Logger.Info().Str("step", step.Name).Str("stage", step.Stage).Msg("Running stage")
+			err = internalUtils.RunStage(step.Stage)
+		} else {
+			var out string
+			out, err = internalUtils.CommandWithPathContext(ctx, step.Command)
+			internalUtils.KLog.Logger.Debug().Str("step", step.Name).Str("cmd", step.Command).Str("out", out).Msg("Plugin step")
+			if err != nil {
+				err = fmt.Errorf("running %q: %w: %s", step.Command, err, strings.TrimSpace(out))
+			}
+		}
+		if err != nil && step.OnFailure == cnst.PluginStepIgnore {
+			internalUtils.KLog.Logger.Warn().Err(err).Str("step", step.Name).Msg("Plugin step failed, ignoring it")
+			return nil
+		}
+		return err
+	}
+}
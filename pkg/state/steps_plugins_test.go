@@ -0,0 +1,198 @@
+package state_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	"github.com/kairos-io/immucore/pkg/schema"
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud-labs/herd"
+)
+
+var _ = Describe("Plugin steps", func() {
+	var g *herd.Graph
+	var s *state.State
+	noop := herd.WithCallback(func(_ context.Context) error { return nil })
+
+	BeforeEach(func() {
+		g = herd.DAG(herd.EnableInit)
+		s = &state.State{}
+		Expect(g.Add(cnst.OpMountRoot, noop)).To(Succeed())
+		Expect(g.Add(cnst.OpMountOEM, noop, herd.WithDeps(cnst.OpMountRoot))).To(Succeed())
+	})
+
+	names := func() []string {
+		var out []string
+		for _, layer := range g.Analyze() {
+			for _, op := range layer {
+				out = append(out, op.Name)
+			}
+		}
+		return out
+	}
+
+	It("loads the steps of the yaml files in order", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "20-token.yaml"), []byte(`
+steps:
+- name: fetch-token
+  command: curl -o /run/token http://10.0.0.1/token
+  deps: [mount-oem]
+  timeout: 30
+  on_failure: ignore
+`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "10-dongle.yml"), []byte(`
+steps:
+- name: mount-dongle
+  stage: dongle
+  modes: [normal, uki]
+  weak_deps: [mount-root]
+`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "README"), []byte("not a step"), 0644)).To(Succeed())
+
+		steps, err := state.LoadPluginSteps(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(steps).To(HaveLen(2))
+		Expect(steps[0].Name).To(Equal("mount-dongle"))
+		Expect(steps[0].Modes).To(Equal([]string{"normal", "uki"}))
+		Expect(steps[0].WeakDeps).To(Equal([]string{cnst.OpMountRoot}))
+		Expect(steps[1].Name).To(Equal("fetch-token"))
+		Expect(*steps[1].Timeout).To(Equal(30))
+		Expect(steps[1].OnFailure).To(Equal(cnst.PluginStepIgnore))
+	})
+
+	It("keeps the good files when one is broken", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("steps: [oops"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("steps:\n- name: ok\n  command: 'true'\n"), 0644)).To(Succeed())
+		steps, err := state.LoadPluginSteps(dir)
+		Expect(err).To(MatchError(ContainSubstring("a.yaml")))
+		Expect(steps).To(HaveLen(1))
+	})
+
+	It("reports the unknown fields", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("steps:\n- name: typo\n  command: 'true'\n  dependencies: [mount-oem]\n"), 0644)).To(Succeed())
+		steps, err := state.LoadPluginSteps(dir)
+		Expect(err).To(MatchError(ContainSubstring("field dependencies not found")))
+		Expect(steps).To(BeEmpty())
+	})
+
+	It("has no steps without the directory", func() {
+		steps, err := state.LoadPluginSteps(filepath.Join(GinkgoT().TempDir(), "missing"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(steps).To(BeEmpty())
+	})
+
+	It("adds the steps of the mode after their dependencies", func() {
+		err := s.AddPluginSteps(g, "normal", []schema.PluginStep{
+			{Name: "second", Command: "true", Deps: []string{"first"}},
+			{Name: "first", Command: "true", Deps: []string{cnst.OpMountOEM}},
+			{Name: "uki-only", Command: "true", Modes: []string{"uki"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names()).To(Equal([]string{"init", cnst.OpMountRoot, cnst.OpMountOEM, "first", "second"}))
+		Expect(g.State("second").Dependencies).To(Equal([]string{"first"}))
+	})
+
+	It("runs the ops named in before after the step, even when it fails", func() {
+		var ran []string
+		record := func(name string) herd.OpOption {
+			return herd.WithCallback(func(_ context.Context) error { ran = append(ran, name); return nil })
+		}
+		g = herd.DAG(herd.EnableInit)
+		Expect(g.Add(cnst.OpMountRoot, record(cnst.OpMountRoot))).To(Succeed())
+		Expect(g.Add(cnst.OpMountOEM, record(cnst.OpMountOEM), herd.WithDeps(cnst.OpMountRoot), herd.FatalOp)).To(Succeed())
+		Expect(s.AddPluginSteps(g, "normal", []schema.PluginStep{
+			{Name: "prepare-oem", Command: "exit 1", Deps: []string{cnst.OpMountRoot}, Before: []string{cnst.OpMountOEM}},
+		})).To(Succeed())
+
+		oem := g.State(cnst.OpMountOEM)
+		Expect(oem.Dependencies).To(ConsistOf(cnst.OpMountRoot, "prepare-oem"))
+		Expect(oem.WeakDependencies).To(Equal([]string{"prepare-oem"}))
+		Expect(oem.Fatal).To(BeTrue())
+		Expect(g.DependsOn(cnst.OpMountOEM, "prepare-oem")).To(BeTrue())
+
+		Expect(g.Run(context.Background())).To(Succeed())
+		Expect(g.State("prepare-oem").Error).To(HaveOccurred())
+		Expect(ran).To(Equal([]string{cnst.OpMountRoot, cnst.OpMountOEM}))
+	})
+
+	It("leaves out the steps that cannot be added", func() {
+		err := s.AddPluginSteps(g, "normal", []schema.PluginStep{
+			{Command: "true"},
+			{Name: "both", Command: "true", Stage: "dongle"},
+			{Name: "neither"},
+			{Name: "policy", Command: "true", OnFailure: "retry"},
+			{Name: cnst.OpMountOEM, Command: "true"},
+			{Name: "dangling", Command: "true", WeakDeps: []string{"unlock-dongle"}},
+			{Name: "after-dangling", Command: "true", Deps: []string{"dangling"}},
+			{Name: "loop-a", Command: "true", Deps: []string{"loop-b"}},
+			{Name: "loop-b", Command: "true", Deps: []string{"loop-a"}},
+			{Name: "before-root", Command: "true", Deps: []string{cnst.OpMountOEM}, Before: []string{cnst.OpMountRoot}},
+			{Name: "fine", Command: "true"},
+		})
+		Expect(err).To(HaveOccurred())
+		for _, reason := range []string{
+			"step without a name",
+			"step both: needs either a command or a stage",
+			"step neither: needs either a command or a stage",
+			`step policy: unknown on_failure "retry"`,
+			"step mount-oem: there is already an op with that name",
+			"step dangling: refers to unlock-dongle, which are not ops of the normal graph",
+			"step after-dangling: refers to dangling",
+			"step loop-a: refers to loop-b",
+			"step before-root: cannot run before mount-root, which it runs after",
+		} {
+			Expect(err.Error()).To(ContainSubstring(reason))
+		}
+		Expect(names()).To(ConsistOf("init", cnst.OpMountRoot, "fine", cnst.OpMountOEM))
+	})
+
+	Context("running", func() {
+		It("fails the step and skips its dependents when the command fails", func() {
+			Expect(s.AddPluginSteps(g, "normal", []schema.PluginStep{
+				{Name: "broken", Command: "echo no dongle; exit 3", Deps: []string{cnst.OpMountRoot}},
+				{Name: "after", Command: "true", Deps: []string{"broken"}},
+			})).To(Succeed())
+			Expect(g.Run(context.Background())).To(Succeed())
+			Expect(g.State("broken").Error).To(MatchError(ContainSubstring("no dongle")))
+			Expect(g.State("after").Executed).To(BeFalse())
+		})
+
+		It("ignores the failure when asked to", func() {
+			Expect(s.AddPluginSteps(g, "normal", []schema.PluginStep{
+				{Name: "broken", Command: "exit 3", OnFailure: cnst.PluginStepIgnore},
+				{Name: "after", Command: "true", Deps: []string{"broken"}},
+			})).To(Succeed())
+			Expect(g.Run(context.Background())).To(Succeed())
+			Expect(g.State("broken").Error).ToNot(HaveOccurred())
+			Expect(g.State("after").Executed).To(BeTrue())
+		})
+
+		It("stops the boot on a fatal failure", func() {
+			Expect(s.AddPluginSteps(g, "normal", []schema.PluginStep{
+				{Name: "broken", Command: "exit 3", OnFailure: cnst.PluginStepFatal},
+			})).To(Succeed())
+			Expect(g.Run(context.Background())).To(HaveOccurred())
+			Expect(g.State(cnst.OpMountOEM).Executed).To(BeFalse())
+		})
+
+		It("kills the command at its deadline", func() {
+			zero, one := 0, 1
+			Expect(s.AddPluginSteps(g, "normal", []schema.PluginStep{
+				{Name: "hung", Command: "sleep 30", Timeout: &one},
+				{Name: "unbounded", Command: "true", Timeout: &zero},
+			})).To(Succeed())
+			Expect(g.Run(context.Background())).To(Succeed())
+			var timeout *state.StepTimeoutError
+			Expect(errors.As(g.State("hung").Error, &timeout)).To(BeTrue())
+			Expect(g.State("unbounded").Error).ToNot(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/spectrocloud-labs/herd"
+)
+
+// FactoryResetDagStep reformats the partitions selected with rd.immucore.reset= once confirmed with their
+// filesystem UUIDs, see cnst.OpFactoryReset. It has to run before anything unlocks or mounts them. Every partition is
+// checked before any is touched: encrypted, mounted or unconfirmed ones make the whole reset fail, as mkfs on them
+// would lose the encryption, break the mounts or wipe a disk nobody meant to. The partitions already reset with one
+// of the tokens are left alone, which makes the step a no-op once done.
+func (s *State) FactoryResetDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	return g.Add(cnst.OpFactoryReset, append(opts, TimedCallback(cnst.OpFactoryReset, func(_ context.Context) error {
+		req, err := internalUtils.GetResetRequest()
+		if err != nil {
+			return err
+		}
+		var parts []internalUtils.ResetPartition
+		for _, label := range req.Labels {
+			device, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-label", label))
+			if err != nil {
+				return fmt.Errorf("finding partition %s: %w", label, err)
+			}
+			p := internalUtils.ResetPartition{Label: label, Device: device, FSType: internalUtils.DiskFSType(device), UUID: internalUtils.DiskFSUUID(device)}
+			switch {
+			case p.FSType == "crypto_LUKS":
+				return fmt.Errorf("partition %s is encrypted, reset it from recovery instead", label)
+			case internalUtils.IsMounted(device):
+				return fmt.Errorf("partition %s is mounted", label)
+			}
+			reset, err := req.CheckResetPartition(p, resetMarker(device, p.FSType))
+			if err != nil {
+				return err
+			}
+			if !reset {
+				internalUtils.KLog.Logger.Info().Str("partition", label).Msg("Partition already reset with this token, not resetting it again")
+				continue
+			}
+			parts = append(parts, p)
+		}
+		if len(parts) == 0 {
+			return nil
+		}
+
+		internalUtils.KLog.Logger.Warn().Str("target", req.Target).Interface("partitions", parts).Msg("Factory reset: reformatting partitions")
+		if err := internalUtils.RunYipStageInline(cnst.OpFactoryReset, internalUtils.BuildResetStage(parts)); err != nil {
+			return fmt.Errorf("reformatting partitions: %w", err)
+		}
+		for _, p := range parts {
+			if err := writeResetMarker(p.Device, p.UUID); err != nil {
+				internalUtils.KLog.Logger.Warn().Err(err).Str("partition", p.Label).Msg("Could not record the reset, the next boot with the same token resets it again")
+			}
+		}
+
+		if err := internalUtils.CreateIfNotExists("/run/cos/"); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join("/run/cos/", cnst.ResetSentinelName), []byte(req.Target), os.ModePerm)
+	}))...)
+}
+
+// resetMarker returns the token of the last reset of device, empty when it has none or cannot be mounted.
+func resetMarker(device, fsType string) string {
+	dir, err := os.MkdirTemp("", "immucore-reset")
+	if err != nil {
+		return ""
+	}
+	defer os.Remove(dir)
+	if err := internalUtils.Mount(device, dir, fsType, syscall.MS_RDONLY, ""); err != nil {
+		return ""
+	}
+	defer func() { _ = syscall.Unmount(dir, 0) }()
+	data, err := os.ReadFile(filepath.Join(dir, cnst.ResetMarker))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// writeResetMarker records token on the freshly formatted device.
+func writeResetMarker(device, token string) error {
+	dir, err := os.MkdirTemp("", "immucore-reset")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+	if err := internalUtils.Mount(device, dir, internalUtils.DiskFSType(device), 0, ""); err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, cnst.ResetMarker), []byte(token+"\n"), 0o600)
+	internalUtils.Sync()
+	return errors.Join(err, syscall.Unmount(dir, 0))
+}
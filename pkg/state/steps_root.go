@@ -0,0 +1,209 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/avast/retry-go"
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/kairos-io/immucore/pkg/op"
+	"github.com/spectrocloud-labs/herd"
+)
+
+// RootProvider brings up the root filesystem under State.Rootdir.
+// Each provider registers whatever ops it needs to reach the root (mount a partition, log into a target, fetch
+// an image...) but must always end in cnst.OpMountRoot, which is what the rest of the DAG depends on.
+// The opts given to Register apply to the first op the provider adds, so callers can order the whole chain after
+// whatever brings the disks up.
+type RootProvider interface {
+	Name() string
+	Register(s *State, g *herd.Graph, opts ...herd.OpOption) error
+}
+
+type rootProviderFunc struct {
+	name     string
+	register func(s *State, g *herd.Graph, opts ...herd.OpOption) error
+}
+
+func (p rootProviderFunc) Name() string { return p.name }
+
+func (p rootProviderFunc) Register(s *State, g *herd.Graph, opts ...herd.OpOption) error {
+	return p.register(s, g, opts...)
+}
+
+// rootProviders holds every known provider keyed by the name used in rd.immucore.rootprovider=.
+var rootProviders = map[string]RootProvider{
+	cnst.RootProviderLoop: rootProviderFunc{cnst.RootProviderLoop, func(s *State, g *herd.Graph, opts ...herd.OpOption) error {
+		return s.MountLoopRootDagStep(g, opts...)
+	}},
+	cnst.RootProviderSubvolume: rootProviderFunc{cnst.RootProviderSubvolume, func(s *State, g *herd.Graph, opts ...herd.OpOption) error {
+		if s.RootSubvolume == "" {
+			return fmt.Errorf("root provider %s needs a subvolume, set %s or %s", cnst.RootProviderSubvolume, cnst.CmdlineRootSubvolume, cnst.CmdlineBtrfsRoot)
+		}
+		return s.MountRootSubvolumeDagStep(g, opts...)
+	}},
+	cnst.RootProviderBlock: rootProviderFunc{cnst.RootProviderBlock, func(s *State, g *herd.Graph, opts ...herd.OpOption) error {
+		return s.MountBlockRootDagStep(g, opts...)
+	}},
+	cnst.RootProviderNFS: rootProviderFunc{cnst.RootProviderNFS, func(s *State, g *herd.Graph, opts ...herd.OpOption) error {
+		return s.MountNFSRootDagStep(g, opts...)
+	}},
+	cnst.RootProviderISCSI: rootProviderFunc{cnst.RootProviderISCSI, func(s *State, g *herd.Graph, opts ...herd.OpOption) error {
+		return s.MountISCSIRootDagStep(g, opts...)
+	}},
+	cnst.RootProviderHTTP: rootProviderFunc{cnst.RootProviderHTTP, func(s *State, g *herd.Graph, opts ...herd.OpOption) error {
+		return s.MountHTTPRootDagStep(g, opts...)
+	}},
+}
+
+// RootProviderFor returns the provider registered under name. An empty name means the loop image.
+func RootProviderFor(name string) (RootProvider, error) {
+	if name == "" {
+		name = cnst.RootProviderLoop
+	}
+	p, ok := rootProviders[name]
+	if !ok {
+		known := make([]string, 0, len(rootProviders))
+		for k := range rootProviders {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown root provider %q, known providers: %v", name, known)
+	}
+	return p, nil
+}
+
+// MountRootDagStep will add the steps to mount the Rootdir for the system using the provider selected in s.RootProvider.
+// opts are handed to the provider, see RootProvider.
+func (s *State) MountRootDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	provider, err := RootProviderFor(s.RootProvider)
+	if err != nil {
+		internalUtils.KLog.Logger.Err(err).Send()
+		return err
+	}
+	internalUtils.KLog.Logger.Info().Str("provider", provider.Name()).Msg("Registering root provider")
+	return provider.Register(s, g, opts...)
+}
+
+// MountBlockRootDagStep mounts s.TargetDevice, the partition labeled after the boot state, straight as Rootdir, for
+// installs where active/passive are real partitions instead of images in COS_STATE.
+func (s *State) MountBlockRootDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	return g.Add(cnst.OpMountRoot, append(opts,
+		TimedCallback(cnst.OpMountRoot,
+			func(ctx context.Context) error {
+				fstab, err := op.MountOPWithFstab(
+					ctx,
+					s.TargetDevice,
+					s.Rootdir,
+					internalUtils.DiskFSType(s.TargetDevice),
+					[]string{
+						s.RootMountMode,
+						"suid",
+						"dev",
+						"exec",
+						"async",
+					}, 30*time.Second)
+				s.AddToFstab(fstab...)
+				return err
+			},
+		),
+	)...)
+}
+
+// MountNFSRootDagStep mounts root=nfs:server:/path[:options] as Rootdir. The export is always mounted read-only,
+// everything writable comes from the usual overlays and persistent binds.
+func (s *State) MountNFSRootDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	return g.Add(cnst.OpMountRoot, append(opts,
+		TimedCallback(cnst.OpMountRoot,
+			func(_ context.Context) error {
+				source, options, err := internalUtils.ParseNFSRoot(internalUtils.GetRootSpec())
+				if err != nil {
+					return err
+				}
+				fstab, err := op.MountCommandWithFstab(source, s.Rootdir, "nfs", append([]string{"ro"}, options...), 60*time.Second)
+				s.AddToFstab(fstab...)
+				return err
+			},
+		),
+	)...)
+}
+
+// MountNFSStateDagStep mounts the export from rd.immucore.nfs.state= over the persistent state target, so the
+// binds of a diskless node land on a per-host export instead of COS_PERSISTENT.
+// Runs once the layout is loaded (StateDir comes from it) and the overlays and custom mounts the target may live
+// on are in place. Callers must make OpMountBind depend on it.
+func (s *State) MountNFSStateDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	return g.Add(cnst.OpMountNFSState,
+		append(opts, herd.WithDeps(cnst.OpLoadConfig, cnst.OpOverlayMount, cnst.OpCustomMounts),
+			TimedCallback(cnst.OpMountNFSState,
+				func(_ context.Context) error {
+					source, options, err := internalUtils.ParseNFSRoot(internalUtils.GetNFSStateSpec())
+					if err != nil {
+						return err
+					}
+					fstab, err := op.MountCommandWithFstab(source, s.path(s.StateDir), "nfs", append([]string{"rw"}, options...), 60*time.Second)
+					s.AddToFstab(fstab...)
+					return err
+				},
+			),
+		)...)
+}
+
+// MountISCSIRootDagStep mounts the root exactly like the loop provider does, as the LUN from root=iscsi: carries a
+// regular COS_STATE partition. The login is done by cnst.OpSANAttach, which callers register whenever
+// internalUtils.SANAttachRequested, so every iSCSI target goes through the same path.
+func (s *State) MountISCSIRootDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	return s.MountLoopRootDagStep(g, append(opts, herd.WithDeps(cnst.OpSANAttach))...)
+}
+
+// MountHTTPRootDagStep downloads the image from root=http(s)://... into RAM and loop mounts it as Rootdir.
+func (s *State) MountHTTPRootDagStep(g *herd.Graph, opts ...herd.OpOption) error {
+	err := g.Add(cnst.OpFetchRootImage, append(opts,
+		TimedCallback(cnst.OpFetchRootImage,
+			func(ctx context.Context) error {
+				url := internalUtils.GetRootSpec()
+				return retry.Do(
+					func() error {
+						return internalUtils.FetchToFile(ctx, url, cnst.HTTPRootImage)
+					},
+					retry.Context(ctx),
+					retry.Delay(2*time.Second),
+					retry.Attempts(5),
+					retry.OnRetry(func(n uint, err error) {
+						internalUtils.KLog.Logger.Warn().Err(err).Uint("try", n).Str("url", url).Msg("Fetching root image failed, retrying")
+					}),
+				)
+			},
+		),
+	)...)
+	if err != nil {
+		internalUtils.KLog.Logger.Err(err).Send()
+		return err
+	}
+
+	return g.Add(cnst.OpMountRoot,
+		herd.WithDeps(cnst.OpFetchRootImage),
+		TimedCallback(cnst.OpMountRoot,
+			func(ctx context.Context) error {
+				fstab, err := op.MountOPWithFstab(
+					ctx,
+					cnst.HTTPRootImage,
+					s.Rootdir,
+					internalUtils.DiskFSType(cnst.HTTPRootImage),
+					[]string{
+						s.RootMountMode,
+						"loop",
+						"suid",
+						"dev",
+						"exec",
+						"async",
+					}, 10*time.Second)
+				s.AddToFstab(fstab...)
+				return err
+			},
+		),
+	)
+}
@@ -0,0 +1,88 @@
+package state_test
+
+import (
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud-labs/herd"
+)
+
+var _ = Describe("root providers", func() {
+	DescribeTable("end in mount-root",
+		func(provider string, expectedOps ...string) {
+			g := herd.DAG(herd.EnableInit)
+			s := &state.State{Rootdir: "/sysroot", RootProvider: provider, RootSubvolume: "@active"}
+			Expect(s.SANAttachDagStep(g)).To(Succeed())
+			Expect(s.MountRootDagStep(g)).To(Succeed())
+
+			layers := g.Analyze()
+			root := layerOf(layers, cnst.OpMountRoot)
+			Expect(root).ToNot(Equal(-1), s.WriteDAG(g))
+			for _, o := range expectedOps {
+				Expect(layerOf(layers, o)).To(BeNumerically(">", 0), s.WriteDAG(g))
+				Expect(layerOf(layers, o)).To(BeNumerically("<", root), s.WriteDAG(g))
+			}
+		},
+		Entry("default is the loop image", "", cnst.OpMountState, cnst.OpDiscoverState),
+		Entry("loop", cnst.RootProviderLoop, cnst.OpMountState, cnst.OpDiscoverState),
+		Entry("subvolume", cnst.RootProviderSubvolume, cnst.OpMountState, cnst.OpDiscoverState),
+		Entry("block", cnst.RootProviderBlock),
+		Entry("nfs", cnst.RootProviderNFS),
+		Entry("iscsi attaches the SAN before mounting the state", cnst.RootProviderISCSI, cnst.OpSANAttach, cnst.OpMountState, cnst.OpDiscoverState),
+		Entry("http fetches the image first", cnst.RootProviderHTTP, cnst.OpFetchRootImage),
+	)
+
+	It("fails on an unknown provider", func() {
+		_, err := state.RootProviderFor("carrier-pigeon")
+		Expect(err).To(MatchError(ContainSubstring("carrier-pigeon")))
+	})
+
+	It("fails on a subvolume provider without subvolume", func() {
+		g := herd.DAG(herd.EnableInit)
+		s := &state.State{RootProvider: cnst.RootProviderSubvolume}
+		Expect(s.MountRootDagStep(g)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("nfs persistent state", func() {
+	It("is mounted after the layout and before the binds", func() {
+		g := herd.DAG(herd.EnableInit)
+		s := &state.State{Rootdir: "/sysroot", RootProvider: cnst.RootProviderNFS}
+		Expect(s.MountRootDagStep(g)).To(Succeed())
+		Expect(s.RootfsStageDagStep(g, herd.WithDeps(cnst.OpMountRoot))).To(Succeed())
+		Expect(s.LoadEnvLayoutDagStep(g)).To(Succeed())
+		Expect(s.MountBaseOverlayDagStep(g)).To(Succeed())
+		Expect(s.MountCustomOverlayDagStep(g)).To(Succeed())
+		Expect(s.MountCustomMountsDagStep(g)).To(Succeed())
+		Expect(s.MountNFSStateDagStep(g)).To(Succeed())
+		Expect(s.MountCustomBindsDagStep(g, herd.WithDeps(cnst.OpMountNFSState))).To(Succeed())
+
+		layers := g.Analyze()
+		nfsState := layerOf(layers, cnst.OpMountNFSState)
+		Expect(nfsState).To(BeNumerically(">", layerOf(layers, cnst.OpLoadConfig)), s.WriteDAG(g))
+		Expect(nfsState).To(BeNumerically(">", layerOf(layers, cnst.OpOverlayMount)), s.WriteDAG(g))
+		Expect(nfsState).To(BeNumerically(">", layerOf(layers, cnst.OpCustomMounts)), s.WriteDAG(g))
+		Expect(layerOf(layers, cnst.OpMountBind)).To(BeNumerically(">", nfsState), s.WriteDAG(g))
+	})
+})
+
+var _ = DescribeTable("root providers run after the given deps",
+	func(provider, first string) {
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("attach")).To(Succeed())
+		s := &state.State{Rootdir: "/sysroot", RootProvider: provider, RootSubvolume: "@active"}
+		Expect(s.SANAttachDagStep(g)).To(Succeed())
+		Expect(s.MountRootDagStep(g, herd.WithDeps("attach"))).To(Succeed())
+
+		layers := g.Analyze()
+		Expect(layerOf(layers, first)).To(BeNumerically(">", layerOf(layers, "attach")), s.WriteDAG(g))
+		Expect(layerOf(layers, cnst.OpMountRoot)).To(BeNumerically(">", layerOf(layers, "attach")), s.WriteDAG(g))
+	},
+	Entry("loop", cnst.RootProviderLoop, cnst.OpMountState),
+	Entry("subvolume", cnst.RootProviderSubvolume, cnst.OpMountState),
+	Entry("block", cnst.RootProviderBlock, cnst.OpMountRoot),
+	Entry("nfs", cnst.RootProviderNFS, cnst.OpMountRoot),
+	Entry("iscsi", cnst.RootProviderISCSI, cnst.OpMountState),
+	Entry("http", cnst.RootProviderHTTP, cnst.OpFetchRootImage),
+)
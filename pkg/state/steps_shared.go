@@ -109,30 +109,41 @@ func (s *State) InitramfsStageDagStep(g *herd.Graph, opts ...herd.OpOption) erro
 	return g.Add(cnst.OpInitramfsHook, append(opts, TimedCallback(cnst.OpInitramfsHook, s.RunStageOp("initramfs")))...)
 }
 
+// StageDagStep adds op, which runs the yip stage, one of the stages of the DAG points in constants.
+func (s *State) StageDagStep(g *herd.Graph, op, stage string, opts ...herd.OpOption) error {
+	return g.Add(op, append(opts, TimedCallback(op, s.RunStageOp(stage)))...)
+}
+
+// linkSysroot links /system and /oem to the ones under /sysroot, for the stages to find the cloud configs of the
+// system while it is not the root yet.
+func linkSysroot() {
+	if internalUtils.IsUKI() {
+		return
+	}
+	for _, p := range []string{"/system", "/oem"} {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			if err = os.Symlink(filepath.Join("/sysroot", p), p); err != nil {
+				internalUtils.KLog.Logger.Err(err).Msg("creating symlink")
+			}
+		}
+	}
+}
+
 // RunStageOp runs elemental run-stage stage. If its rootfs its special as it needs som symlinks
 // If its uki we don't symlink as we already have everything in the sysroot.
 func (s *State) RunStageOp(stage string) func(context.Context) error {
 	return func(_ context.Context) error {
 		switch stage {
 		case "rootfs":
-			if !internalUtils.IsUKI() {
-				if _, err := os.Stat("/system"); os.IsNotExist(err) {
-					err = os.Symlink("/sysroot/system", "/system")
-					if err != nil {
-						internalUtils.KLog.Logger.Err(err).Msg("creating symlink")
-					}
-				}
-				if _, err := os.Stat("/oem"); os.IsNotExist(err) {
-					err = os.Symlink("/sysroot/oem", "/oem")
-					if err != nil {
-						internalUtils.KLog.Logger.Err(err).Msg("creating symlink")
-					}
-				}
-			}
-
+			linkSysroot()
 			internalUtils.KLog.Logger.Info().Msg("Running rootfs stage")
 			_ = internalUtils.RunStage("rootfs")
 			return nil
+		case cnst.StagePreUnlock, cnst.StagePostMount, cnst.StagePreFstab:
+			linkSysroot()
+			internalUtils.KLog.Logger.Info().Str("stage", stage).Msg("Running stage")
+			_ = internalUtils.RunStage(stage)
+			return nil
 		case "initramfs":
 			// Not sure if it will work under UKI where the s.Rootdir is the current root already
 			internalUtils.KLog.Logger.Info().Msg("Running initramfs stage")
@@ -194,6 +205,7 @@ func (s *State) LoadEnvLayoutDagStep(g *herd.Graph, opts ...herd.OpOption) error
 
 				// Remove any duplicates
 				s.BindMounts = internalUtils.UniqueSlice(internalUtils.CleanupSlice(s.BindMounts))
+				s.BindSync = parseBindSync(env["PERSISTENT_STATE_SYNC"])
 
 				// Load Overlay config
 				overlayConfig := env["OVERLAY"]
@@ -240,8 +252,9 @@ func (s *State) MountOemDagStep(g *herd.Graph, opts ...herd.OpOption) error {
 					internalUtils.KLog.Logger.Debug().Msg("OEM label from cmdline empty, won't mount OEM")
 					return nil
 				}
-				operation := func(_ context.Context) error {
+				operation := func(ctx context.Context) error {
 					fstab, err := op.MountOPWithFstab(
+						ctx,
 						fmt.Sprintf("/dev/disk/by-label/%s", internalUtils.GetOemLabel()),
 						s.path("/oem"),
 						internalUtils.DiskFSType(fmt.Sprintf("/dev/disk/by-label/%s", internalUtils.GetOemLabel())),
@@ -252,9 +265,7 @@ func (s *State) MountOemDagStep(g *herd.Graph, opts ...herd.OpOption) error {
 							"exec",
 							"async",
 						}, time.Duration(internalUtils.GetOemTimeout())*time.Second)
-					for _, f := range fstab {
-						s.fstabs = append(s.fstabs, f)
-					}
+					s.AddToFstab(fstab...)
 					return err
 				}
 				return operation(ctx)
@@ -278,7 +289,7 @@ func (s *State) MountBaseOverlayDagStep(g *herd.Graph, opts ...herd.OpOption) er
 					err2 := operation.Run()
 					// No error, add fstab
 					if err2 == nil {
-						s.fstabs = append(s.fstabs, &operation.FstabEntry)
+						s.AddToFstab(&operation.FstabEntry)
 						return nil
 					}
 					// Error but its already mounted error, dont add fstab but dont return error
@@ -321,7 +332,7 @@ func (s *State) MountCustomOverlayDagStep(g *herd.Graph, opts ...herd.OpOption)
 							multierr = multierror.Append(multierr, err)
 							continue
 						}
-						s.fstabs = append(s.fstabs, &operation.FstabEntry)
+						s.AddToFstab(&operation.FstabEntry)
 						internalUtils.KLog.Logger.Debug().Str("what", p).Msg("Overlay mount done")
 					}
 					return multierr.ErrorOrNil()
@@ -333,7 +344,7 @@ func (s *State) MountCustomOverlayDagStep(g *herd.Graph, opts ...herd.OpOption)
 // MountCustomMountsDagStep will add mounting s.CustomMounts .
 func (s *State) MountCustomMountsDagStep(g *herd.Graph, opts ...herd.OpOption) error {
 	return g.Add(cnst.OpCustomMounts, append(opts, herd.WithDeps(cnst.OpLoadConfig),
-		TimedCallback(cnst.OpCustomMounts, func(_ context.Context) error {
+		TimedCallback(cnst.OpCustomMounts, func(ctx context.Context) error {
 			var err *multierror.Error
 			internalUtils.KLog.Logger.Debug().Interface("mounts", s.CustomMounts).Msg("Mounting custom mounts")
 
@@ -348,15 +359,14 @@ func (s *State) MountCustomMountsDagStep(g *herd.Graph, opts ...herd.OpOption) e
 					mountOptions = []string{"rw"}
 				}
 				fstab, err2 := op.MountOPWithFstab(
+					ctx,
 					what,
 					s.path(where),
 					fstype,
 					mountOptions,
 					3*time.Second,
 				)
-				for _, f := range fstab {
-					s.fstabs = append(s.fstabs, f)
-				}
+				s.AddToFstab(fstab...)
 
 				// If its COS_OEM and it fails then we can safely ignore, as it's not mandatory to have COS_OEM
 				if err2 != nil && !strings.Contains(what, "COS_OEM") {
@@ -381,13 +391,23 @@ func (s *State) MountCustomBindsDagStep(g *herd.Graph, opts ...herd.OpOption) er
 					var err *multierror.Error
 					internalUtils.KLog.Logger.Debug().Strs("mounts", s.BindMounts).Msg("Mounting binds")
 
+					// A failed migration or reset leaves the state as it was, which is still worth mounting
+					if _, err2 := s.MigrateBindStates(cnst.LogDir); err2 != nil {
+						internalUtils.KLog.Logger.Err(err2).Msg("Migrating persistent state paths")
+						err = multierror.Append(err, err2)
+					}
+					if err2 := s.ResetBindStates(); err2 != nil {
+						internalUtils.KLog.Logger.Err(err2).Msg("Resetting persistent state paths")
+						err = multierror.Append(err, err2)
+					}
+
 					for _, p := range s.SortedBindMounts() {
 						internalUtils.KLog.Logger.Debug().Str("what", p).Msg("Bind mount start")
-						operation := op.MountBind(p, s.Rootdir, s.StateDir)
+						operation := op.MountBind(p, s.Rootdir, s.StateDir, s.BindSync[filepath.Join("/", p)])
 						err2 := operation.Run()
 						if err2 == nil {
 							// Only append to fstabs if there was no error, otherwise we will try to mount it after switch_root
-							s.fstabs = append(s.fstabs, &operation.FstabEntry)
+							s.AddToFstab(&operation.FstabEntry)
 						}
 						// Append to errors only if it's not an already mounted error
 						if err2 != nil && !errors.Is(err2, cnst.ErrAlreadyMounted) {
@@ -642,6 +642,9 @@ func (s *State) UKIBootInitDagStep(g *herd.Graph) error {
 
 			// Print dag before exit, otherwise its never printed as we never exit the program
 			internalUtils.KLog.Logger.Info().Msg(s.WriteDAG(g))
+			if s.BeforeInit != nil {
+				s.BeforeInit(g)
+			}
 
 			internalUtils.KLog.Logger.Debug().Str("what", s.path(s.Rootdir)).Msg("Mount / RO")
 			// Close the logger before we remount the rootfs to not leave open file descriptors
@@ -654,6 +657,7 @@ func (s *State) UKIBootInitDagStep(g *herd.Graph) error {
 
 			internalUtils.SetLogger() // Set the logger again as we closed it
 			internalUtils.KLog.Logger.Debug().Msg("Executing init callback!")
+			internalUtils.ReleaseHardwareWatchdog()
 			if err := syscall.Exec("/sbin/init", []string{"/sbin/init"}, os.Environ()); err != nil {
 				// Try under bin
 				internalUtils.KLog.Logger.Warn().Err(err).Msg("Executing init failed, trying /bin/init")
@@ -669,7 +673,7 @@ func (s *State) UKIBootInitDagStep(g *herd.Graph) error {
 // UKIMountESPPartition tries to mount the ESP into /efi
 // Doesnt matter if it fails, its just for niceness.
 func (s *State) UKIMountESPPartition(g *herd.Graph, opts ...herd.OpOption) error {
-	return g.Add("mount-esp", append(opts, TimedCallback("mount-esp", func(_ context.Context) error {
+	return g.Add(cnst.OpUkiMountESP, append(opts, TimedCallback(cnst.OpUkiMountESP, func(ctx context.Context) error {
 		if !state.EfiBootFromInstall(internalUtils.KLog.Logger) {
 			internalUtils.KLog.Logger.Debug().Msg("Not mounting ESP as we think we are booting from removable media")
 			return nil
@@ -695,6 +699,7 @@ func (s *State) UKIMountESPPartition(g *herd.Graph, opts ...herd.OpOption) error
 					device := filepath.Join("/dev", cd.Name)
 					if !internalUtils.IsMounted(device) {
 						fstab, err := op.MountOPWithFstab(
+							ctx,
 							device,
 							s.path("/efi"),
 							"vfat",
@@ -702,9 +707,7 @@ func (s *State) UKIMountESPPartition(g *herd.Graph, opts ...herd.OpOption) error
 								"ro",
 							}, 5*time.Second,
 						)
-						for _, f := range fstab {
-							s.fstabs = append(s.fstabs, f)
-						}
+						s.AddToFstab(fstab...)
 						return err
 					}
 				}
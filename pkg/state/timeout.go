@@ -0,0 +1,118 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+)
+
+// StepTimeoutError is the error of a step that did not finish before its deadline.
+type StepTimeoutError struct {
+	Step    string
+	Timeout time.Duration
+}
+
+func (e *StepTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s, left running (%s%s=<seconds> changes the deadline)",
+		e.Timeout, cnst.CmdlineStepTimeoutPrefix, e.Step)
+}
+
+// Unwrap makes errors.Is(err, context.DeadlineExceeded) true for timeouts.
+func (e *StepTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// StepStillRunningError is the error of a step run again, by a retry, while the run that timed out has not returned.
+type StepStillRunningError struct {
+	Step string
+}
+
+func (e *StepStillRunningError) Error() string {
+	return "the run that timed out is still running, not starting it again"
+}
+
+// leftRunning holds the steps whose callback timed out and has not returned yet.
+var leftRunning = struct {
+	sync.Mutex
+	steps map[string]struct{}
+}{steps: map[string]struct{}{}}
+
+// withDeadline returns fn with a deadline of timeout passed via its ctx. Steps that do not watch their ctx cannot be
+// stopped, so when the deadline passes the step fails with a StepTimeoutError and fn is left running in the
+// background. Until it returns the step fails with a StepStillRunningError instead of running fn again next to it,
+// e.g. from a retry. A timeout of 0 returns fn as is.
+func withDeadline(name string, timeout time.Duration, fn func(context.Context) error) func(context.Context) error {
+	if timeout == 0 {
+		return fn
+	}
+	return func(ctx context.Context) error {
+		leftRunning.Lock()
+		_, running := leftRunning.steps[name]
+		leftRunning.Unlock()
+		if running {
+			internalUtils.KLog.Logger.Warn().Str("step", name).Msg("Step timed out before and is still running, not running it again")
+			return &StepStillRunningError{Step: name}
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() {
+			done <- fn(ctx)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			leftRunning.Lock()
+			leftRunning.steps[name] = struct{}{}
+			leftRunning.Unlock()
+			go func() {
+				<-done
+				leftRunning.Lock()
+				delete(leftRunning.steps, name)
+				leftRunning.Unlock()
+				internalUtils.KLog.Logger.Info().Str("step", name).Msg("Step left running returned")
+			}()
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ctx.Err()
+			}
+			internalUtils.KLog.Logger.Error().Str("step", name).Str("timeout", timeout.String()).Msg("Step timed out")
+			return &StepTimeoutError{Step: name, Timeout: timeout}
+		}
+	}
+}
+
+// WatchSteps logs the steps still running, and for how long, every interval until ctx is done, so a hung boot shows
+// where it hangs. An interval of 0 disables it.
+func WatchSteps(ctx context.Context, interval time.Duration) {
+	if interval == 0 {
+		return
+	}
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+			running := Running()
+			if len(running) == 0 {
+				continue
+			}
+			steps := make([]string, 0, len(running))
+			for _, r := range running {
+				steps = append(steps, fmt.Sprintf("%s (%s)", r.Name, r.Duration.Round(time.Second)))
+			}
+			internalUtils.KLog.Logger.Warn().Str("steps", strings.Join(steps, ", ")).Msg("Steps still running")
+		}
+	}()
+}
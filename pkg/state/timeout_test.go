@@ -0,0 +1,158 @@
+package state_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud-labs/herd"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("step deadlines", func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		state.ResetTimeline()
+		fs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "",
+		})
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	DescribeTable("StepTimeout",
+		func(cmdline, step string, expected time.Duration) {
+			Expect(fs.WriteFile("/proc/cmdline", []byte(cmdline), 0o600)).To(Succeed())
+			Expect(internalUtils.StepTimeout(step)).To(Equal(expected))
+		},
+		Entry("no deadline by default", "", cnst.OpMountOEM, time.Duration(0)),
+		Entry("own default", "", cnst.OpFetchRootImage, 1800*time.Second),
+		Entry("no deadline for unlocking", "rd.immucore.steptimeout=60", cnst.OpKcryptUnlock, time.Duration(0)),
+		Entry("custom default", "rd.immucore.steptimeout=60", cnst.OpMountOEM, 60*time.Second),
+		Entry("custom default leaves own defaults", "rd.immucore.steptimeout=60", cnst.OpFetchRootImage, 1800*time.Second),
+		Entry("per step", "rd.immucore.steptimeout=60 rd.immucore.steptimeout.mount-oem=5", cnst.OpMountOEM, 5*time.Second),
+		Entry("per step for another step", "rd.immucore.steptimeout.mount-oem=5", cnst.OpMountRoot, time.Duration(0)),
+		Entry("per step over its own default", "rd.immucore.steptimeout.unlock-all=30", cnst.OpKcryptUnlock, 30*time.Second),
+		Entry("disabled", "rd.immucore.steptimeout.mount-oem=0", cnst.OpMountOEM, time.Duration(0)),
+	)
+
+	It("passes the deadline to the step through its context", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.steptimeout=30"), 0o600)).To(Succeed())
+		var deadline time.Time
+		var hasDeadline bool
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("op", state.TimedCallback("op", func(ctx context.Context) error {
+			deadline, hasDeadline = ctx.Deadline()
+			return nil
+		}))).To(Succeed())
+		Expect(g.Run(context.Background())).To(Succeed())
+		Expect(hasDeadline).To(BeTrue())
+		Expect(deadline).To(BeTemporally("~", time.Now().Add(30*time.Second), 5*time.Second))
+	})
+
+	It("fails a hung step with a timeout and skips its dependents", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.steptimeout.stalled=1"), 0o600)).To(Succeed())
+		release := make(chan struct{})
+		defer close(release)
+		childRan := false
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("stalled", state.TimedCallback("stalled", func(_ context.Context) error {
+			// Does not watch its ctx, like a stuck command.
+			<-release
+			return nil
+		}))).To(Succeed())
+		Expect(g.Add("child", herd.WithDeps("stalled"), state.TimedCallback("child", func(_ context.Context) error {
+			childRan = true
+			return nil
+		}))).To(Succeed())
+
+		start := time.Now()
+		Expect(g.Run(context.Background())).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(childRan).To(BeFalse())
+
+		err := state.Timings()["stalled"].Err
+		var timeout *state.StepTimeoutError
+		Expect(errors.As(err, &timeout)).To(BeTrue())
+		Expect(timeout.Timeout).To(Equal(time.Second))
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+		s := &state.State{}
+		reason := s.FailureReason(g)
+		Expect(reason).To(ContainSubstring("stalled: timed out after 1s"))
+		Expect(reason).To(ContainSubstring("rd.immucore.steptimeout.stalled="))
+	})
+
+	It("does not run a step again while the run that timed out has not returned", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.steptimeout.stuck=1"), 0o600)).To(Succeed())
+		release := make(chan struct{})
+		var runs atomic.Int32
+		stuck := state.TimedCallback("stuck", func(_ context.Context) error {
+			runs.Add(1)
+			<-release
+			return nil
+		})
+
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("stuck", stuck)).To(Succeed())
+		r := state.NewRetrier(&state.State{}, g, GinkgoT().TempDir())
+		Expect(r.Run(context.Background())).To(Succeed())
+		Expect(r.Failed()).To(HaveLen(1))
+
+		Expect(r.Retry(context.Background())).To(Succeed())
+		Expect(runs.Load()).To(BeEquivalentTo(1))
+		var stillRunning *state.StepStillRunningError
+		Expect(errors.As(state.Timings()["stuck"].Err, &stillRunning)).To(BeTrue())
+
+		close(release)
+		Eventually(func() []internalUtils.FailedOp {
+			Expect(r.Retry(context.Background())).To(Succeed())
+			return r.Failed()
+		}).Should(BeEmpty())
+		Expect(runs.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("lets a step that watches its context return its own error", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.steptimeout.waiting=1"), 0o600)).To(Succeed())
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("waiting", state.TimedCallback("waiting", func(ctx context.Context) error {
+			<-ctx.Done()
+			return errors.New("gave up waiting for the device")
+		}))).To(Succeed())
+		Expect(g.Run(context.Background())).To(Succeed())
+		Expect(state.Timings()["waiting"].Err).To(HaveOccurred())
+	})
+
+	It("lists the steps still running", func() {
+		release := make(chan struct{})
+		started := make(chan struct{})
+		go func() {
+			state.RunTimed("slow", func() error {
+				close(started)
+				<-release
+				return nil
+			})
+		}()
+		<-started
+		time.Sleep(10 * time.Millisecond)
+		running := state.Running()
+		close(release)
+		Expect(running).To(HaveLen(1))
+		Expect(running[0].Name).To(Equal("slow"))
+		Expect(running[0].Duration).To(BeNumerically(">=", 10*time.Millisecond))
+		Eventually(state.Running).Should(BeEmpty())
+	})
+})
@@ -11,49 +11,148 @@ import (
 	"sync"
 	"time"
 
+	cnst "github.com/kairos-io/immucore/internal/constants"
 	internalUtils "github.com/kairos-io/immucore/internal/utils"
 	"github.com/spectrocloud-labs/herd"
 )
 
 // TimelineTraceFile is the basename of the machine-readable trace written under constants.LogDir.
-const TimelineTraceFile = "boot-timeline.json"
+const TimelineTraceFile = cnst.TimelineTraceFile
 
 // StepTiming holds the wall-clock duration of a single DAG step.
 type StepTiming struct {
 	Name     string
 	Duration time.Duration
 	Err      error
+	// Start and End are the time since the kernel booted (CLOCK_BOOTTIME), see internalUtils.BootTime.
+	Start time.Duration
+	End   time.Duration
+	// Lane is the lowest lane free when the step started: steps running at the same time never share one.
+	Lane int
+	// Concurrency is how many steps, this one included, were running at most while it ran.
+	Concurrency int
+	// SubSpans are the parts of the step recorded with internalUtils.RecordSubSpan, e.g. mount attempts.
+	SubSpans []internalUtils.SubSpan
 }
 
 // timeline is a process-global, mutex-guarded registry of step timings.
 // herd runs DAG ops concurrently, so every access is guarded.
 var timeline = struct {
 	sync.Mutex
-	steps map[string]StepTiming
-}{steps: map[string]StepTiming{}}
+	// steps is the latest run of each step, runs every run in start order, retries included.
+	steps   map[string]StepTiming
+	runs    []*StepTiming
+	running map[*StepTiming]bool
+	// progress is when a step last started or finished.
+	progress time.Duration
+	// listeners are told about every step that starts or finishes, see OnStep.
+	listeners map[int]func(StepEvent)
+	nextID    int
+}{steps: map[string]StepTiming{}, running: map[*StepTiming]bool{}, listeners: map[int]func(StepEvent){}}
 
-// recordTiming stores (or overwrites) the timing for a named step in a race-safe way.
-func recordTiming(name string, d time.Duration, err error) {
+// StepEvent is a step that started, or finished when Done is set.
+type StepEvent struct {
+	Step StepTiming
+	Done bool
+}
+
+// OnStep calls fn with every step that starts or finishes, from the goroutine running the step, until the returned
+// func is called.
+func OnStep(fn func(StepEvent)) (stop func()) {
 	timeline.Lock()
 	defer timeline.Unlock()
-	timeline.steps[name] = StepTiming{Name: name, Duration: d, Err: err}
+	id := timeline.nextID
+	timeline.nextID++
+	timeline.listeners[id] = fn
+	return func() {
+		timeline.Lock()
+		defer timeline.Unlock()
+		delete(timeline.listeners, id)
+	}
+}
+
+// notify calls the listeners with ev, without holding the lock so they can look at the timeline.
+func notify(ev StepEvent) {
+	timeline.Lock()
+	listeners := make([]func(StepEvent), 0, len(timeline.listeners))
+	for _, l := range timeline.listeners {
+		listeners = append(listeners, l)
+	}
+	timeline.Unlock()
+	for _, l := range listeners {
+		l(ev)
+	}
+}
+
+// startRun records that name started running.
+func startRun(name string) *StepTiming {
+	run := &StepTiming{Name: name, Start: internalUtils.BootTime()}
+	timeline.Lock()
+	lanes := map[int]bool{}
+	for r := range timeline.running {
+		lanes[r.Lane] = true
+	}
+	for lanes[run.Lane] {
+		run.Lane++
+	}
+	timeline.running[run] = true
+	for r := range timeline.running {
+		r.Concurrency = max(r.Concurrency, len(timeline.running))
+	}
+	timeline.runs = append(timeline.runs, run)
+	timeline.progress = run.Start
+	ev := StepEvent{Step: *run}
+	timeline.Unlock()
+	notify(ev)
+	return run
+}
+
+// endRun records that run finished after d with err, overwriting the timing of the previous run of the step.
+func endRun(run *StepTiming, d time.Duration, err error) {
+	timeline.Lock()
+	run.End = internalUtils.BootTime()
+	run.Duration = d
+	run.Err = err
+	delete(timeline.running, run)
+	timeline.steps[run.Name] = *run
+	timeline.progress = run.End
+	ev := StepEvent{Step: *run, Done: true}
+	timeline.Unlock()
+	notify(ev)
 }
 
 // RunTimed executes fn, measuring its wall-clock duration and recording it under name.
 // It returns the error fn returned, unchanged.
 func RunTimed(name string, fn func() error) error {
+	return runTimed(context.Background(), name, func(context.Context) error { return fn() })
+}
+
+// runTimed is RunTimed for callbacks, the sub-spans recorded with the ctx given to fn are kept with the step.
+func runTimed(ctx context.Context, name string, fn func(context.Context) error) error {
+	run := startRun(name)
+	ctx = internalUtils.WithSubSpans(ctx, func(sp internalUtils.SubSpan) {
+		timeline.Lock()
+		defer timeline.Unlock()
+		run.SubSpans = append(run.SubSpans, sp)
+	})
 	start := time.Now()
-	err := fn()
-	recordTiming(name, time.Since(start), err)
+	err := fn(ctx)
+	endRun(run, time.Since(start), err)
 	return err
 }
 
 // TimedCallback wraps a herd callback so its wall-clock duration is recorded under name,
 // and returns it as a herd.WithCallback OpOption. This is the drop-in replacement for
 // herd.WithCallback(fn) in step registrations: herd.WithCallback(fn) -> state.TimedCallback(name, fn).
+// fn gets the deadline of the step, see internalUtils.StepTimeout, through its ctx.
 func TimedCallback(name string, fn func(context.Context) error) herd.OpOption {
+	return timedCallback(name, func() time.Duration { return internalUtils.StepTimeout(name) }, fn)
+}
+
+// timedCallback is TimedCallback with the deadline returned by timeout when the step starts, 0 for none.
+func timedCallback(name string, timeout func() time.Duration, fn func(context.Context) error) herd.OpOption {
 	return herd.WithCallback(func(ctx context.Context) error {
-		return RunTimed(name, func() error { return fn(ctx) })
+		return runTimed(ctx, name, withDeadline(name, timeout(), fn))
 	})
 }
 
@@ -68,11 +167,53 @@ func Timings() map[string]StepTiming {
 	return out
 }
 
+// Runs returns a copy of every finished run of every step, in start order, retries included.
+func Runs() []StepTiming {
+	timeline.Lock()
+	defer timeline.Unlock()
+	out := make([]StepTiming, 0, len(timeline.runs))
+	for _, r := range timeline.runs {
+		if timeline.running[r] {
+			continue
+		}
+		run := *r
+		run.SubSpans = append([]internalUtils.SubSpan(nil), r.SubSpans...)
+		out = append(out, run)
+	}
+	return out
+}
+
+// Running returns the steps running now, oldest first, with how long they have been running as Duration.
+func Running() []StepTiming {
+	timeline.Lock()
+	defer timeline.Unlock()
+	now := internalUtils.BootTime()
+	var out []StepTiming
+	for _, r := range timeline.runs {
+		if timeline.running[r] {
+			run := *r
+			run.Duration = now - r.Start
+			out = append(out, run)
+		}
+	}
+	return out
+}
+
+// LastProgress returns when, since the kernel booted, a step last started or finished. 0 if none did yet.
+func LastProgress() time.Duration {
+	timeline.Lock()
+	defer timeline.Unlock()
+	return timeline.progress
+}
+
 // ResetTimeline clears all recorded timings. Mainly useful for tests.
 func ResetTimeline() {
 	timeline.Lock()
 	defer timeline.Unlock()
 	timeline.steps = map[string]StepTiming{}
+	timeline.runs = nil
+	timeline.running = map[*StepTiming]bool{}
+	timeline.progress = 0
 }
 
 // sortedTimings returns the recorded timings sorted slowest-first (ties broken by name).
@@ -110,25 +251,18 @@ func RenderTimeline() string {
 	return b.String()
 }
 
-// timelineEntry is the JSON shape of a single step in the trace file.
-type timelineEntry struct {
-	Name       string  `json:"name"`
-	DurationMs float64 `json:"duration_ms"`
-	Error      string  `json:"error,omitempty"`
-}
-
 // WriteTimelineTrace writes the boot timeline as machine-readable JSON to dir/boot-timeline.json,
 // slowest-first. It returns the path written.
 func WriteTimelineTrace(dir string) (string, error) {
 	steps := sortedTimings()
-	entries := make([]timelineEntry, 0, len(steps))
+	entries := make([]internalUtils.TimelineStep, 0, len(steps))
 	for _, s := range steps {
-		e := timelineEntry{
+		e := internalUtils.TimelineStep{
 			Name:       s.Name,
 			DurationMs: float64(s.Duration) / float64(time.Millisecond),
 		}
 		if s.Err != nil {
-			e.Error = s.Err.Error()
+			e.Error = internalUtils.RedactSecrets(s.Err.Error())
 		}
 		entries = append(entries, e)
 	}
@@ -149,7 +283,8 @@ func WriteTimelineTrace(dir string) (string, error) {
 }
 
 // LogTimeline emits the boot timeline to the logger (slowest-first, structured per step)
-// and writes the machine-readable trace under dir. Non-fatal: failures are logged, not returned.
+// and writes the machine-readable trace, and its Chrome trace and OTLP exports, under dir.
+// Non-fatal: failures are logged, not returned.
 func LogTimeline(dir string) {
 	for i, s := range sortedTimings() {
 		ev := internalUtils.KLog.Logger.Info().
@@ -168,4 +303,11 @@ func LogTimeline(dir string) {
 		return
 	}
 	internalUtils.KLog.Logger.Info().Str("path", path).Msg("Wrote boot timeline trace")
+
+	paths, err := WriteBootTraces(dir)
+	if err != nil {
+		internalUtils.KLog.Logger.Warn().Err(err).Str("dir", dir).Msg("Could not export boot traces")
+		return
+	}
+	internalUtils.KLog.Logger.Info().Strs("paths", paths).Msg("Exported boot traces")
 }
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
 	"github.com/kairos-io/immucore/pkg/state"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -102,3 +104,166 @@ var _ = Describe("step timing registry", func() {
 		Expect(parsed[0]).To(HaveKey("duration_ms"))
 	})
 })
+
+var _ = Describe("boot trace export", func() {
+	BeforeEach(func() {
+		state.ResetTimeline()
+	})
+
+	// runConcurrently runs two steps that are both running at some point.
+	runConcurrently := func() {
+		var started, done sync.WaitGroup
+		started.Add(2)
+		for _, name := range []string{"left", "right"} {
+			done.Add(1)
+			go func() {
+				defer done.Done()
+				state.RunTimed(name, func() error {
+					started.Done()
+					started.Wait()
+					return nil
+				})
+			}()
+		}
+		done.Wait()
+	}
+
+	It("records boottime timestamps, lanes and concurrency", func() {
+		runConcurrently()
+		state.RunTimed("after", func() error { return nil })
+
+		runs := state.Runs()
+		Expect(runs).To(HaveLen(3))
+		Expect(runs[0].Start).To(BeNumerically(">", 0))
+		Expect(runs[0].End).To(BeNumerically(">=", runs[0].Start))
+		Expect(runs[0].Concurrency).To(Equal(2))
+		Expect(runs[1].Concurrency).To(Equal(2))
+		Expect(runs[0].Lane).ToNot(Equal(runs[1].Lane))
+		Expect(runs[2].Name).To(Equal("after"))
+		Expect(runs[2].Concurrency).To(Equal(1))
+		Expect(runs[2].Lane).To(Equal(0))
+		Expect(runs[2].Start).To(BeNumerically(">=", max(runs[0].End, runs[1].End)))
+	})
+
+	It("keeps every run of a step and the sub-spans recorded through its context", func() {
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("mount-op", state.TimedCallback("mount-op", func(ctx context.Context) error {
+			start := internalUtils.BootTime()
+			internalUtils.RecordSubSpan(ctx, internalUtils.SubSpan{Name: "mount attempt 1", Start: start, End: internalUtils.BootTime(), Err: context.Canceled})
+			return nil
+		}))).To(Succeed())
+		Expect(g.Run(context.Background())).To(Succeed())
+		state.RunTimed("mount-op", func() error { return nil })
+
+		runs := state.Runs()
+		Expect(runs).To(HaveLen(2))
+		Expect(runs[0].SubSpans).To(HaveLen(1))
+		Expect(runs[0].SubSpans[0].Name).To(Equal("mount attempt 1"))
+		Expect(runs[0].SubSpans[0].Start).To(BeNumerically(">=", runs[0].Start))
+		Expect(runs[1].SubSpans).To(BeEmpty())
+		Expect(state.Timings()["mount-op"].SubSpans).To(BeEmpty())
+	})
+
+	It("exports a Chrome trace with steps on their lanes and sub-spans nested", func() {
+		runConcurrently()
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("mounting", state.TimedCallback("mounting", func(ctx context.Context) error {
+			internalUtils.RecordSubSpan(ctx, internalUtils.SubSpan{Name: "mount attempt 1", Start: internalUtils.BootTime(), End: internalUtils.BootTime()})
+			return context.Canceled
+		}))).To(Succeed())
+		_ = g.Run(context.Background())
+
+		data, err := state.ChromeTrace()
+		Expect(err).ToNot(HaveOccurred())
+		var trace struct {
+			TraceEvents []struct {
+				Name string                 `json:"name"`
+				Cat  string                 `json:"cat"`
+				Ph   string                 `json:"ph"`
+				Ts   float64                `json:"ts"`
+				Dur  float64                `json:"dur"`
+				Tid  int                    `json:"tid"`
+				Args map[string]interface{} `json:"args"`
+			} `json:"traceEvents"`
+		}
+		Expect(json.Unmarshal(data, &trace)).To(Succeed())
+
+		tids := map[string]int{}
+		for _, e := range trace.TraceEvents {
+			if e.Ph != "X" {
+				continue
+			}
+			tids[e.Name] = e.Tid
+			switch e.Name {
+			case "left", "right":
+				Expect(e.Args["concurrency"]).To(BeNumerically("==", 2))
+			case "mounting":
+				Expect(e.Cat).To(Equal("step"))
+				Expect(e.Args["error"]).To(Equal(context.Canceled.Error()))
+			case "mount attempt 1":
+				Expect(e.Cat).To(Equal("substep"))
+			}
+		}
+		Expect(tids).To(HaveLen(4))
+		Expect(tids["left"]).ToNot(Equal(tids["right"]))
+		Expect(tids["mount attempt 1"]).To(Equal(tids["mounting"]))
+	})
+
+	It("exports OTLP json with steps under the boot span and sub-spans under their step", func() {
+		g := herd.DAG(herd.EnableInit)
+		Expect(g.Add("mounting", state.TimedCallback("mounting", func(ctx context.Context) error {
+			internalUtils.RecordSubSpan(ctx, internalUtils.SubSpan{Name: "mount attempt 1", Start: internalUtils.BootTime(), End: internalUtils.BootTime()})
+			return nil
+		}))).To(Succeed())
+		Expect(g.Run(context.Background())).To(Succeed())
+
+		data, err := state.OTLPTrace()
+		Expect(err).ToNot(HaveOccurred())
+		var trace struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID           string `json:"traceId"`
+						SpanID            string `json:"spanId"`
+						ParentSpanID      string `json:"parentSpanId"`
+						Name              string `json:"name"`
+						StartTimeUnixNano string `json:"startTimeUnixNano"`
+						EndTimeUnixNano   string `json:"endTimeUnixNano"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		Expect(json.Unmarshal(data, &trace)).To(Succeed())
+		Expect(trace.ResourceSpans).To(HaveLen(1))
+		Expect(trace.ResourceSpans[0].ScopeSpans).To(HaveLen(1))
+		spans := trace.ResourceSpans[0].ScopeSpans[0].Spans
+		Expect(spans).To(HaveLen(3))
+		Expect(spans[0].Name).To(Equal("boot"))
+		Expect(spans[0].ParentSpanID).To(BeEmpty())
+		Expect(spans[1].Name).To(Equal("mounting"))
+		Expect(spans[1].ParentSpanID).To(Equal(spans[0].SpanID))
+		Expect(spans[2].Name).To(Equal("mount attempt 1"))
+		Expect(spans[2].ParentSpanID).To(Equal(spans[1].SpanID))
+		for _, sp := range spans {
+			Expect(sp.TraceID).To(HaveLen(32))
+			Expect(sp.SpanID).To(HaveLen(16))
+			Expect(sp.EndTimeUnixNano >= sp.StartTimeUnixNano).To(BeTrue())
+		}
+		start, err := strconv.ParseInt(spans[1].StartTimeUnixNano, 10, 64)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Unix(0, start)).To(BeTemporally("~", time.Now(), time.Minute))
+	})
+
+	It("writes both exports", func() {
+		state.RunTimed("traced", func() error { return nil })
+		dir := GinkgoT().TempDir()
+		paths, err := state.WriteBootTraces(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(paths).To(Equal([]string{filepath.Join(dir, "boot-trace.json"), filepath.Join(dir, "boot-trace.otlp.json")}))
+		for _, p := range paths {
+			data, err := os.ReadFile(p)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Valid(data)).To(BeTrue())
+		}
+	})
+})
@@ -0,0 +1,262 @@
+package state
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+)
+
+// traceService is the process name in the Chrome trace and the service.name of the OTLP spans.
+const traceService = "immucore"
+
+// chromeEvent is an event of the Chrome trace event format, see
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU.
+type chromeEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type chromeTrace struct {
+	TraceEvents     []chromeEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// traceRuns returns every run of every step with the run number of the step, 1 for the first one and more for the
+// retries.
+func traceRuns() ([]StepTiming, []int) {
+	runs := Runs()
+	nth := make([]int, len(runs))
+	seen := map[string]int{}
+	for i, r := range runs {
+		seen[r.Name]++
+		nth[i] = seen[r.Name]
+	}
+	return runs, nth
+}
+
+// ChromeTrace returns the boot timeline in the Chrome trace event format, to be opened in Perfetto or
+// chrome://tracing. Timestamps are since the kernel booted, each lane is a thread so steps running at the same time
+// are shown side by side, with their sub-spans nested under them.
+func ChromeTrace() ([]byte, error) {
+	runs, nth := traceRuns()
+	trace := chromeTrace{DisplayTimeUnit: "ms", TraceEvents: []chromeEvent{
+		{Name: "process_name", Ph: "M", Pid: 1, Args: map[string]interface{}{"name": traceService}},
+	}}
+	lanes := map[int]bool{}
+	for i, r := range runs {
+		if !lanes[r.Lane] {
+			lanes[r.Lane] = true
+			trace.TraceEvents = append(trace.TraceEvents, chromeEvent{
+				Name: "thread_name", Ph: "M", Pid: 1, Tid: r.Lane,
+				Args: map[string]interface{}{"name": fmt.Sprintf("lane %d", r.Lane)},
+			})
+		}
+		args := map[string]interface{}{"concurrency": r.Concurrency, "run": nth[i]}
+		if r.Err != nil {
+			args["error"] = internalUtils.RedactSecrets(r.Err.Error())
+		}
+		trace.TraceEvents = append(trace.TraceEvents, chromeEvent{
+			Name: r.Name, Cat: "step", Ph: "X", Ts: micros(r.Start), Dur: micros(r.End - r.Start), Pid: 1, Tid: r.Lane, Args: args,
+		})
+		for _, sp := range r.SubSpans {
+			e := chromeEvent{Name: sp.Name, Cat: "substep", Ph: "X", Ts: micros(sp.Start), Dur: micros(sp.End - sp.Start), Pid: 1, Tid: r.Lane}
+			if sp.Err != nil {
+				e.Args = map[string]interface{}{"error": internalUtils.RedactSecrets(sp.Err.Error())}
+			}
+			trace.TraceEvents = append(trace.TraceEvents, e)
+		}
+	}
+	return json.MarshalIndent(trace, "", "  ")
+}
+
+// OTLP json types, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding. Ids are hex encoded and
+// 64 bit integers are strings.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTrace struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP span kind and status codes.
+const (
+	otlpKindInternal = 1
+	otlpStatusOk     = 1
+	otlpStatusError  = 2
+)
+
+func otlpString(key, v string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &v}}
+}
+
+func otlpInt(key string, v int64) otlpAttribute {
+	s := strconv.FormatInt(v, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// otlpTraceID returns the trace id of this boot: the boot id the kernel gave it, so traces of the same boot sent
+// twice end up together.
+func otlpTraceID() string {
+	id := strings.ReplaceAll(internalUtils.BootID(), "-", "")
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		h := fnv.New128a()
+		_, _ = h.Write([]byte(id))
+		id = hex.EncodeToString(h.Sum(nil))
+	}
+	return id
+}
+
+// otlpSpanID returns a span id derived from parts, stable across exports of the same boot.
+func otlpSpanID(parts ...string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strings.Join(parts, "/")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// OTLPTrace returns the boot timeline as OTLP json, for a post-boot agent to send to an OpenTelemetry collector
+// (POST to /v1/traces). Every step is a child of a span covering the whole boot, sub-spans are children of their
+// step. The trace id is the boot id.
+func OTLPTrace() ([]byte, error) {
+	runs, nth := traceRuns()
+	traceID := otlpTraceID()
+	// Wall clock time of the kernel boot, to turn the CLOCK_BOOTTIME timestamps into unix ones.
+	booted := time.Now().Add(-internalUtils.BootTime())
+	unixNano := func(d time.Duration) string {
+		return strconv.FormatInt(booted.Add(d).UnixNano(), 10)
+	}
+	status := func(err error) otlpStatus {
+		if err != nil {
+			return otlpStatus{Code: otlpStatusError, Message: internalUtils.RedactSecrets(err.Error())}
+		}
+		return otlpStatus{Code: otlpStatusOk}
+	}
+
+	rootID := otlpSpanID(traceService)
+	root := otlpSpan{TraceID: traceID, SpanID: rootID, Name: "boot", Kind: otlpKindInternal, Status: status(nil)}
+	var spans []otlpSpan
+	var first, last time.Duration
+	for i, r := range runs {
+		if i == 0 || r.Start < first {
+			first = r.Start
+		}
+		last = max(last, r.End)
+		id := otlpSpanID(r.Name, strconv.Itoa(nth[i]))
+		spans = append(spans, otlpSpan{
+			TraceID: traceID, SpanID: id, ParentSpanID: rootID, Name: r.Name, Kind: otlpKindInternal,
+			StartTimeUnixNano: unixNano(r.Start), EndTimeUnixNano: unixNano(r.End),
+			Attributes: []otlpAttribute{
+				otlpInt("immucore.run", int64(nth[i])),
+				otlpInt("immucore.concurrency", int64(r.Concurrency)),
+				otlpInt("immucore.lane", int64(r.Lane)),
+				otlpInt("immucore.boottime_start_ns", int64(r.Start)),
+			},
+			Status: status(r.Err),
+		})
+		for j, sp := range r.SubSpans {
+			spans = append(spans, otlpSpan{
+				TraceID: traceID, SpanID: otlpSpanID(r.Name, strconv.Itoa(nth[i]), strconv.Itoa(j)), ParentSpanID: id,
+				Name: sp.Name, Kind: otlpKindInternal,
+				StartTimeUnixNano: unixNano(sp.Start), EndTimeUnixNano: unixNano(sp.End),
+				Status: status(sp.Err),
+			})
+		}
+	}
+	root.StartTimeUnixNano, root.EndTimeUnixNano = unixNano(first), unixNano(last)
+	// The boot is in error when a step still failed after the retries.
+	for _, t := range Timings() {
+		if t.Err != nil {
+			root.Status = otlpStatus{Code: otlpStatusError}
+		}
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttribute{
+		otlpString("service.name", traceService),
+		otlpString("host.boot_id", internalUtils.BootID()),
+	}
+	var ss otlpScopeSpans
+	ss.Scope.Name = traceService
+	ss.Spans = append([]otlpSpan{root}, spans...)
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return json.MarshalIndent(otlpTrace{ResourceSpans: []otlpResourceSpans{rs}}, "", "  ")
+}
+
+// WriteBootTraces writes the boot timeline under dir as a Chrome trace and as OTLP json. It returns the paths written.
+func WriteBootTraces(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, t := range []struct {
+		name   string
+		export func() ([]byte, error)
+	}{{cnst.ChromeTraceFile, ChromeTrace}, {cnst.OTLPTraceFile, OTLPTrace}} {
+		data, err := t.export()
+		if err != nil {
+			return paths, err
+		}
+		path := filepath.Join(dir, t.name)
+		if err = os.WriteFile(path, data, 0644); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
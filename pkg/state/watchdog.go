@@ -0,0 +1,60 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+)
+
+// PetWatchdog pets w every third of its timeout, until ctx is done or w is released, as long as a step started or
+// finished within the timeout or a step that may wait for the user is running. When the steps stop making progress it
+// stops petting it and the watchdog reboots the machine, so the timeout has to be longer than the slowest step.
+func PetWatchdog(ctx context.Context, w *internalUtils.Watchdog) {
+	if !w.Armed() {
+		return
+	}
+	interval := max(w.Timeout()/3, time.Second)
+	// Arming it counts as progress, the first step may take a moment to start.
+	armed := internalUtils.BootTime()
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		stalled := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+			if !w.Armed() {
+				return
+			}
+			since := internalUtils.BootTime() - max(LastProgress(), armed)
+			if since >= w.Timeout() && !waitingForUser() {
+				if !stalled {
+					internalUtils.KLog.Logger.Error().Str("since", since.Round(time.Second).String()).Msg("No step made progress, no longer petting the hardware watchdog")
+				}
+				stalled = true
+				continue
+			}
+			stalled = false
+			if err := w.Pet(); err != nil {
+				internalUtils.KLog.Logger.Warn().Err(err).Msg("Petting the hardware watchdog")
+			}
+		}
+	}()
+}
+
+// waitingForUser returns whether a step that may wait for the user, e.g. for a passphrase typed at the console, is
+// running. Those are the steps with no deadline by default in cnst.DefaultStepTimeouts, as long as none was given.
+func waitingForUser() bool {
+	defaults := cnst.DefaultStepTimeouts()
+	for _, r := range Running() {
+		if d, ok := defaults[r.Name]; ok && d == 0 && internalUtils.StepTimeout(r.Name) == 0 {
+			return true
+		}
+	}
+	return false
+}
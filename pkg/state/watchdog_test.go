@@ -0,0 +1,85 @@
+package state_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	cnst "github.com/kairos-io/immucore/internal/constants"
+	internalUtils "github.com/kairos-io/immucore/internal/utils"
+	"github.com/kairos-io/immucore/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+var _ = Describe("PetWatchdog", func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		state.ResetTimeline()
+		fs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+			"/proc/cmdline": "",
+		})
+		fakeCmdline, _ := fs.RawPath("/proc/cmdline")
+		GinkgoT().Setenv("HOST_PROC_CMDLINE", fakeCmdline)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("pets the watchdog while steps make progress and stops when they stall", func() {
+		dev := filepath.Join(GinkgoT().TempDir(), "watchdog")
+		Expect(os.WriteFile(dev, nil, 0600)).To(Succeed())
+		w, err := internalUtils.OpenWatchdog(dev, 2*time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		defer w.Disarm()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		state.RunTimed("step", func() error { return nil })
+		state.PetWatchdog(ctx, w)
+
+		// Petted once a second while the last step is less than the timeout old, then no more.
+		petted := func() (int, error) {
+			data, err := os.ReadFile(dev)
+			return len(data), err
+		}
+		Eventually(petted, 2*time.Second).Should(BeNumerically(">=", 1))
+		time.Sleep(2500 * time.Millisecond)
+		n, err := petted()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeNumerically("<=", 2))
+		Consistently(petted, 2500*time.Millisecond).Should(Equal(n))
+	})
+
+	It("keeps petting the watchdog while a step with no deadline waits longer than the timeout", func() {
+		dev := filepath.Join(GinkgoT().TempDir(), "watchdog")
+		Expect(os.WriteFile(dev, nil, 0600)).To(Succeed())
+		w, err := internalUtils.OpenWatchdog(dev, 2*time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		defer w.Disarm()
+		Expect(internalUtils.StepTimeout(cnst.OpKcryptUnlock)).To(BeZero())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		release := make(chan struct{})
+		defer close(release)
+		// Like unlock-all waiting for a passphrase.
+		go state.RunTimed(cnst.OpKcryptUnlock, func() error {
+			<-release
+			return nil
+		})
+		state.PetWatchdog(ctx, w)
+
+		// Still petted after twice the timeout, once a second.
+		Eventually(func() (int, error) {
+			data, err := os.ReadFile(dev)
+			return len(data), err
+		}, 5*time.Second).Should(BeNumerically(">=", 4))
+	})
+})